@@ -816,7 +816,7 @@ func TestProjectNameMustMatch(t *testing.T) {
 	// Create a new project
 	projectDir := t.TempDir()
 	pyaml := filepath.Join(projectDir, "Pulumi.yaml")
-	err := os.WriteFile(pyaml, []byte("name: my-project\nruntime: test"), 0o600)
+	err := os.WriteFile(pyaml, []byte("name: my-project\nruntime: nodejs"), 0o600)
 	require.NoError(t, err)
 	proj, err := workspace.LoadProject(pyaml)
 	require.NoError(t, err)
@@ -135,7 +135,7 @@ func TestChangeSecretsProvider_NoSecrets(t *testing.T) {
 	// Setup a dummy project in this directory
 	err := os.WriteFile("Pulumi.yaml", []byte(`
 name: testProject
-runtime: mock
+runtime: nodejs
 `), 0o600)
 	require.NoError(t, err)
 
@@ -235,7 +235,7 @@ func TestChangeSecretsProvider_WithSecrets(t *testing.T) {
 	// Setup a dummy project in this directory
 	err := os.WriteFile("Pulumi.yaml", []byte(`
 name: testProject
-runtime: mock
+runtime: nodejs
 `), 0o600)
 	require.NoError(t, err)
 
@@ -0,0 +1,380 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workspace
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
+)
+
+// bundleSettingsName is the name of the entry holding the workspace settings in a bundle written by W.Export.
+const bundleSettingsName = ".pulumi/workspace.json"
+
+func (pw *projectWorkspace) Export(projectDir string) ([]byte, error) {
+	if pw.inMemory {
+		return nil, errors.New("in-memory workspaces can't export bundles")
+	}
+	proj, projectPath, stackFiles, err := projectStackConfigFiles(projectDir)
+	if err != nil {
+		return nil, err
+	}
+	// The bundled settings are this workspace's, so they may only be paired with this workspace's project.
+	if abs, err := filepath.Abs(projectPath); err != nil {
+		return nil, err
+	} else if filepath.Clean(abs) != filepath.Clean(pw.project) {
+		return nil, fmt.Errorf("can't export the project '%v', which isn't the project of this workspace ('%v')",
+			projectPath, pw.project)
+	}
+	// The bundle only holds files within the project directory, so that it can be imported anywhere.
+	if proj.Extends != "" {
+		return nil, fmt.Errorf("can't export a project that extends another project ('%v')", proj.Extends)
+	}
+
+	var buffer bytes.Buffer
+	gw := gzip.NewWriter(&buffer)
+	writer := tar.NewWriter(gw)
+	for _, file := range append([]string{projectPath}, stackFiles...) {
+		rel, err := filepath.Rel(projectDir, file)
+		if err != nil {
+			return nil, err
+		}
+		if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("can't export stack config file '%v', which is outside of the project directory; "+
+				"move the project's stackConfigDir into the project", file)
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if err = writeBundleEntry(writer, filepath.ToSlash(rel), info.Mode().Perm(), b); err != nil {
+			return nil, err
+		}
+	}
+
+	settings, err := pw.exportSettings()
+	if err != nil {
+		return nil, err
+	}
+	if settings != nil {
+		if err = writeBundleEntry(writer, bundleSettingsName, 0o600, settings); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// exportSettings returns the workspace settings as JSON for a bundle, or nil if they are empty. The path of the
+// project file isn't exported, since it is recorded anew when the settings are imported.
+func (pw *projectWorkspace) exportSettings() ([]byte, error) {
+	defer pw.lockAllStacks()()
+	if pw.settings.IsEmpty() {
+		return nil, nil
+	}
+	settings := pw.settings.copyWith(func(v config.Value) config.Value { return v })
+	settings.ProjectPath = ""
+	settings.Format = SettingsFormatJSON
+	return marshalSettings(settings)
+}
+
+func (pw *projectWorkspace) Import(data []byte, destDir string) error {
+	if pw.inMemory {
+		return errors.New("in-memory workspaces can't import bundles")
+	}
+	destDir, err := filepath.Abs(destDir)
+	if err != nil {
+		return err
+	}
+
+	files, settingsData, err := readBundle(data)
+	if err != nil {
+		return err
+	}
+
+	// Load the project and check the settings, and every file, before writing any, so that a bundle that can't be
+	// imported leaves destDir untouched.
+	projectName, proj, err := loadBundleProject(files)
+	if err != nil {
+		return err
+	}
+	var settings Settings
+	if settingsData != nil {
+		b, _, err := settingsAsJSON(settingsData)
+		if err == nil {
+			err = ValidateSettings(b)
+		}
+		if err == nil {
+			err = json.Unmarshal(b, &settings)
+		}
+		if err != nil {
+			return fmt.Errorf("workspace bundle has invalid settings: %w", err)
+		}
+		settings.migrateConfig()
+	}
+	if existing, err := projectFileInDir(destDir); err == nil || !errors.Is(err, ErrProjectNotFound) {
+		if err == nil {
+			err = fmt.Errorf("'%s' already exists", existing)
+		}
+		return fmt.Errorf("can't import workspace bundle: %w", err)
+	}
+	for _, file := range files {
+		target := filepath.Join(destDir, filepath.FromSlash(file.name))
+		if _, err := os.Stat(target); err == nil {
+			return fmt.Errorf("can't import workspace bundle: '%s' already exists", target)
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	// Remove everything that was created if any file, or the settings, can't be written, so that the import can be
+	// retried.
+	projectPath := filepath.Join(destDir, projectName)
+	created, err := writeBundleFiles(destDir, files)
+	if err == nil && settingsData != nil {
+		imported := &projectWorkspace{
+			name:             proj.Name,
+			project:          projectPath,
+			settingsPathFunc: pw.settingsPathFunc,
+			settings:         &settings,
+			fs:               pw.fs,
+			store:            pw.store,
+		}
+		err = imported.Save()
+	}
+	if err != nil {
+		removeCreated(created)
+		return err
+	}
+	// Only update this workspace's settings once they have been saved, so that a failed import leaves them alone.
+	if settingsData != nil && projectPath == pw.project {
+		pw.Restore(&settings)
+	}
+	return nil
+}
+
+// writeBundleFiles writes the files of a bundle into destDir, none of which may exist yet. It returns the paths of
+// the files and directories that it created, in the order they were created, even if it fails part way through.
+func writeBundleFiles(destDir string, files []bundleFile) ([]string, error) {
+	var created []string
+	for _, file := range files {
+		target := filepath.Join(destDir, filepath.FromSlash(file.name))
+
+		// Create the missing directories one at a time, outermost first, so that they can be removed again.
+		var missing []string
+		for dir := filepath.Dir(target); ; dir = filepath.Dir(dir) {
+			if _, err := os.Stat(dir); err == nil {
+				break
+			} else if !os.IsNotExist(err) {
+				return created, err
+			}
+			missing = append(missing, dir)
+			if filepath.Dir(dir) == dir {
+				break
+			}
+		}
+		for i := len(missing) - 1; i >= 0; i-- {
+			if err := os.Mkdir(missing[i], 0o755); err != nil {
+				return created, err
+			}
+			created = append(created, missing[i])
+		}
+
+		f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, file.mode)
+		if err != nil {
+			return created, err
+		}
+		created = append(created, target)
+		_, err = f.Write(file.data)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return created, err
+		}
+	}
+	return created, nil
+}
+
+// removeCreated removes the files and directories created by writeBundleFiles, in the reverse order of their
+// creation.
+func removeCreated(created []string) {
+	for i := len(created) - 1; i >= 0; i-- {
+		if err := os.Remove(created[i]); err != nil && !os.IsNotExist(err) {
+			logging.V(5).Infof("could not remove %s after a failed import: %v", created[i], err)
+		}
+	}
+}
+
+// loadBundleProject finds the project file among the files of a workspace bundle, which must hold exactly one at its
+// top level, and loads it, returning its name along with the project.
+func loadBundleProject(files []bundleFile) (string, *Project, error) {
+	var found []bundleFile
+	for _, file := range files {
+		for _, name := range ProjectFileNames() {
+			for _, ext := range projectFileExts {
+				if file.name == name+ext {
+					found = append(found, file)
+				}
+			}
+		}
+	}
+	switch len(found) {
+	case 0:
+		return "", nil, errors.New("workspace bundle has no project file")
+	case 1:
+	default:
+		return "", nil, fmt.Errorf("workspace bundle has more than one project file ('%v' and '%v')",
+			found[0].name, found[1].name)
+	}
+
+	format := ProjectFormatYAML
+	if path.Ext(found[0].name) == ".json" {
+		format = ProjectFormatJSON
+	}
+	proj, err := LoadProjectBytes(found[0].data, format)
+	if err != nil {
+		return "", nil, fmt.Errorf("workspace bundle has an invalid project file '%v': %w", found[0].name, err)
+	}
+	return found[0].name, proj, nil
+}
+
+// bundleFile is a file read from a workspace bundle.
+type bundleFile struct {
+	name string // the slash-separated path of the file, relative to the project directory.
+	mode os.FileMode
+	data []byte
+}
+
+// readBundle reads the files of a workspace bundle written by W.Export, along with its settings, which are nil if the
+// bundle has none. Entries that aren't regular files, or whose paths would place them outside the directory the bundle
+// is imported into, are an error.
+func readBundle(data []byte) ([]bundleFile, []byte, error) {
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid workspace bundle: %w", err)
+	}
+	reader := tar.NewReader(gr)
+
+	var files []bundleFile
+	var settings []byte
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return files, settings, nil
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("invalid workspace bundle: %w", err)
+		}
+
+		name := path.Clean(header.Name)
+		if header.Typeflag != tar.TypeReg {
+			return nil, nil, fmt.Errorf("workspace bundle entry '%v' is not a regular file", header.Name)
+		}
+		if path.IsAbs(name) || name == "." || name == ".." || strings.HasPrefix(name, "../") {
+			return nil, nil, fmt.Errorf("workspace bundle entry '%v' is outside the project directory", header.Name)
+		}
+		b, err := io.ReadAll(reader)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid workspace bundle: %w", err)
+		}
+
+		if name == bundleSettingsName {
+			settings = b
+			continue
+		}
+		files = append(files, bundleFile{name: name, mode: header.FileInfo().Mode().Perm(), data: b})
+	}
+}
+
+func writeBundleEntry(writer *tar.Writer, name string, mode os.FileMode, data []byte) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     int64(mode),
+		Size:     int64(len(data)),
+	}
+	if err := writer.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := writer.Write(data)
+	return err
+}
+
+// projectStackConfigFiles loads the project in projectDir, returning it along with the path of its project file and
+// the paths of its stack config files in sorted order, honoring the project's `stackConfigDir`.
+func projectStackConfigFiles(projectDir string) (*Project, string, []string, error) {
+	projectPath, err := projectFileInDir(projectDir)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	proj, err := LoadProject(projectPath)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	stackDir := projectDir
+	if proj.StackConfigDir != "" {
+		stackDir = filepath.Join(projectDir, proj.StackConfigDir)
+	}
+	stackFiles, err := findStackConfigFiles(stackDir, projectPath)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	return proj, projectPath, stackFiles, nil
+}
+
+// findStackConfigFiles returns the paths of the stack config files in dir for the project file at projectPath, in
+// sorted order. Stack config files are named after the project file, as in `Pulumi.<stack>.yaml`.
+func findStackConfigFiles(dir, projectPath string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	ext := filepath.Ext(projectPath)
+	prefix := strings.TrimSuffix(filepath.Base(projectPath), ext) + "."
+	var files []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, ext) ||
+			len(name) <= len(prefix)+len(ext) {
+			continue
+		}
+		files = append(files, filepath.Join(dir, name))
+	}
+	return files, nil
+}
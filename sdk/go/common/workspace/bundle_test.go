@@ -0,0 +1,258 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workspace
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImportRoundtrip(t *testing.T) {
+	t.Parallel()
+
+	files := map[string]string{
+		"Pulumi.yaml": `name: proj
+runtime: nodejs
+stackConfigDir: stacks
+config:
+  region:
+    type: string
+    default: us-west-2
+`,
+		"stacks/Pulumi.dev.yaml":  "config:\n  proj:region: eu-west-1\n  proj:password:\n    secure: c2VjcmV0\n",
+		"stacks/Pulumi.prod.yaml": "config:\n  proj:region: us-east-1\n",
+		"index.ts":                "export {}\n",
+	}
+	src := writeProjectFiles(t, files)
+	settingsPath := SettingsPathUnder(t.TempDir())
+
+	w, err := NewFromWithSettingsPath(src, settingsPath)
+	require.NoError(t, err)
+	w.Settings().Stack = "dev"
+	w.Settings().StackConfig = map[tokens.QName]config.Map{
+		"dev": {config.MustMakeKey("proj", "token"): config.NewSecureValue("dG9rZW4=")},
+	}
+	require.NoError(t, w.Save())
+
+	data, err := w.Export(w.ProjectRoot())
+	require.NoError(t, err)
+
+	dest := filepath.Join(t.TempDir(), "imported")
+	require.NoError(t, w.Import(data, dest))
+
+	for _, name := range []string{"Pulumi.yaml", "stacks/Pulumi.dev.yaml", "stacks/Pulumi.prod.yaml"} {
+		b, err := os.ReadFile(filepath.Join(dest, filepath.FromSlash(name)))
+		require.NoError(t, err)
+		assert.Equal(t, files[name], string(b), name)
+	}
+	// Only the project's own files are bundled.
+	assert.NoFileExists(t, filepath.Join(dest, "index.ts"))
+
+	imported, err := NewFromWithSettingsPath(dest, settingsPath)
+	require.NoError(t, err)
+	assert.Equal(t, "dev", imported.Settings().Stack)
+	assert.Equal(t, w.Settings().StackConfig, imported.Settings().StackConfig)
+	assert.Equal(t, filepath.ToSlash(imported.ProjectPath()), imported.Settings().ProjectPath)
+	cfg, err := imported.LoadStackConfigFile("dev", dest)
+	require.NoError(t, err)
+	assert.Equal(t, config.NewSecureValue("c2VjcmV0"), cfg[config.MustMakeKey("proj", "password")])
+
+	// Importing again would overwrite the files that were just imported.
+	assert.ErrorContains(t, w.Import(data, dest), "already exists")
+}
+
+func TestImportRejectsUnsafeEntries(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{"Pulumi.yaml": "name: proj\nruntime: nodejs\n"})
+	w, err := NewFromWithSettingsPath(dir, SettingsPathUnder(t.TempDir()))
+	require.NoError(t, err)
+
+	bundle := func(header *tar.Header) []byte {
+		var buffer bytes.Buffer
+		gw := gzip.NewWriter(&buffer)
+		writer := tar.NewWriter(gw)
+		require.NoError(t, writer.WriteHeader(header))
+		require.NoError(t, writer.Close())
+		require.NoError(t, gw.Close())
+		return buffer.Bytes()
+	}
+
+	dest := t.TempDir()
+	err = w.Import(bundle(&tar.Header{Typeflag: tar.TypeReg, Name: "../escape.yaml", Mode: 0o600}), dest)
+	assert.EqualError(t, err, "workspace bundle entry '../escape.yaml' is outside the project directory")
+	err = w.Import(bundle(&tar.Header{Typeflag: tar.TypeSymlink, Name: "Pulumi.yaml", Linkname: "/etc/passwd"}), dest)
+	assert.EqualError(t, err, "workspace bundle entry 'Pulumi.yaml' is not a regular file")
+	assert.ErrorContains(t, w.Import([]byte("not a bundle"), dest), "invalid workspace bundle")
+
+	assert.EqualError(t, NewInMemory(&Project{Name: "proj"}).Import(nil, dest),
+		"in-memory workspaces can't import bundles")
+}
+
+func TestExportRejectsFilesOutsideTheProject(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"base.yaml":                     "name: base\nruntime: nodejs\n",
+		"extends/Pulumi.yaml":           "name: proj\nextends: ../base.yaml\n",
+		"outside/Pulumi.yaml":           "name: proj\nruntime: nodejs\nstackConfigDir: ../stacks\n",
+		"stacks/Pulumi.dev.yaml":        "config: {}\n",
+		"inside/Pulumi.yaml":            "name: proj\nruntime: nodejs\nstackConfigDir: stacks\n",
+		"inside/stacks/Pulumi.dev.yaml": "config: {}\n",
+	})
+	settingsPath := SettingsPathUnder(t.TempDir())
+	export := func(name string) error {
+		w, err := NewFromWithSettingsPath(filepath.Join(dir, name), settingsPath)
+		require.NoError(t, err)
+		_, err = w.Export(w.ProjectRoot())
+		return err
+	}
+
+	assert.EqualError(t, export("extends"), "can't export a project that extends another project ('../base.yaml')")
+	assert.ErrorContains(t, export("outside"), "which is outside of the project directory")
+	assert.NoError(t, export("inside"))
+}
+
+func TestExportRejectsAnotherProject(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"a/Pulumi.yaml": "name: a\nruntime: nodejs\n",
+		"b/Pulumi.yaml": "name: b\nruntime: nodejs\n",
+	})
+	w, err := NewFromWithSettingsPath(filepath.Join(dir, "a"), SettingsPathUnder(t.TempDir()))
+	require.NoError(t, err)
+
+	_, err = w.Export(filepath.Join(dir, "b"))
+	assert.ErrorContains(t, err, "which isn't the project of this workspace")
+	_, err = w.Export(filepath.Join(dir, "a", "."))
+	assert.NoError(t, err)
+
+	_, err = NewInMemory(&Project{Name: "proj"}).Export(dir)
+	assert.EqualError(t, err, "in-memory workspaces can't export bundles")
+}
+
+func TestImportRemovesWhatItWroteOnFailure(t *testing.T) {
+	t.Parallel()
+
+	src := writeProjectFiles(t, map[string]string{
+		"Pulumi.yaml":                   "name: proj\nruntime: nodejs\nstackConfigDir: stacks/nested\n",
+		"stacks/nested/Pulumi.dev.yaml": "config: {}\n",
+	})
+	w, err := NewFromWithSettingsPath(src, SettingsPathUnder(t.TempDir()))
+	require.NoError(t, err)
+	w.Settings().Stack = "dev"
+	require.NoError(t, w.Save())
+	data, err := w.Export(w.ProjectRoot())
+	require.NoError(t, err)
+
+	// The settings are saved after every file has been written, so failing to save them exercises the cleanup of
+	// both the files and the directories created for them.
+	parent := t.TempDir()
+	dest := filepath.Join(parent, "imported", "proj")
+	store := &failingSettingsStore{}
+	failing, err := NewFromWithSettingsStore(src, store)
+	require.NoError(t, err)
+	assert.ErrorContains(t, failing.Import(data, dest), "settings store is unavailable")
+	entries, err := os.ReadDir(parent)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Since nothing was left behind, the import can be retried.
+	require.NoError(t, w.Import(data, dest))
+	assert.FileExists(t, filepath.Join(dest, "stacks", "nested", "Pulumi.dev.yaml"))
+}
+
+// failingSettingsStore is a SettingsStore that can't save anything.
+type failingSettingsStore struct{}
+
+func (failingSettingsStore) Load(key string) ([]byte, bool, error) { return nil, false, nil }
+
+func (failingSettingsStore) Save(key string, data []byte) error {
+	return errors.New("settings store is unavailable")
+}
+
+func (failingSettingsStore) Delete(key string) error { return nil }
+
+func TestImportValidatesBeforeWriting(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{"Pulumi.yaml": "name: proj\nruntime: nodejs\n"})
+	w, err := NewFromWithSettingsPath(dir, SettingsPathUnder(t.TempDir()))
+	require.NoError(t, err)
+
+	bundle := func(files map[string]string) []byte {
+		var buffer bytes.Buffer
+		gw := gzip.NewWriter(&buffer)
+		writer := tar.NewWriter(gw)
+		for name, content := range files {
+			require.NoError(t, writeBundleEntry(writer, name, 0o600, []byte(content)))
+		}
+		require.NoError(t, writer.Close())
+		require.NoError(t, gw.Close())
+		return buffer.Bytes()
+	}
+
+	tests := []struct {
+		name     string
+		files    map[string]string
+		expected string
+	}{
+		{
+			name:     "invalid project",
+			files:    map[string]string{"Pulumi.yaml": "name: proj\n", "Pulumi.dev.yaml": "config: {}\n"},
+			expected: "workspace bundle has an invalid project file 'Pulumi.yaml'",
+		},
+		{
+			name: "project extends another",
+			files: map[string]string{
+				"Pulumi.yaml": "name: proj\nruntime: nodejs\nextends: ../base.yaml\n", "Pulumi.dev.yaml": "config: {}\n",
+			},
+			expected: "'extends' is not supported for a project that isn't loaded from a file",
+		},
+		{
+			name:     "no project",
+			files:    map[string]string{"Pulumi.dev.yaml": "config: {}\n"},
+			expected: "workspace bundle has no project file",
+		},
+		{
+			name: "invalid settings",
+			files: map[string]string{
+				"Pulumi.yaml": "name: proj\nruntime: nodejs\n", bundleSettingsName: `{"stack": 4}`,
+			},
+			expected: "workspace bundle has invalid settings",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			dest := filepath.Join(t.TempDir(), "imported")
+			assert.ErrorContains(t, w.Import(bundle(tt.files), dest), tt.expected)
+			assert.NoDirExists(t, dest)
+		})
+	}
+}
@@ -2,11 +2,13 @@ package workspace
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"sort"
 	"strings"
 
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
 )
 
 func formatMissingKeys(missingKeys []string) string {
@@ -98,6 +100,55 @@ func validateStackConfigValue(
 	return nil
 }
 
+// ErrUndeclaredStackConfig is wrapped by the errors that ValidateStackConfigTypes reports for stack config in the
+// project's namespace that the project's `config` block doesn't declare. Such errors are warnings rather than type
+// mismatches.
+var ErrUndeclaredStackConfig = errors.New("config not declared by the project")
+
+// ValidateStackConfigTypes checks the values in the config file of the given stack for the project in projectDir, as
+// read by W.LoadStackConfigFile, against the types declared in the project's `config` block. It returns an error for
+// each value that doesn't conform to its declared type and, wrapping ErrUndeclaredStackConfig, for each key in the
+// project's namespace that the project doesn't declare, in key order. Secure values are not checked, since checking
+// them would need their plaintext.
+func (proj *Project) ValidateStackConfigTypes(projectDir string, stack tokens.QName) []error {
+	path, err := stackConfigFilePath(stack, projectDir)
+	if err != nil {
+		return []error{err}
+	}
+	ps, err := LoadProjectStack(proj, path)
+	if err != nil {
+		return []error{fmt.Errorf("could not load stack config file '%s': %w", path, err)}
+	}
+
+	declared := make(map[config.Key]ProjectConfigType, len(proj.Config))
+	for projectConfigKey, projectConfigType := range proj.Config {
+		key, err := parseProjectConfigKey(proj.Name.String(), projectConfigKey)
+		if err != nil {
+			return []error{err}
+		}
+		declared[key] = projectConfigType
+	}
+
+	var errs []error
+	for _, key := range sortedConfigKeys(ps.Config) {
+		projectConfigType, ok := declared[key]
+		if !ok {
+			if key.Namespace() == proj.Name.String() {
+				errs = append(errs, fmt.Errorf("stack '%v' config key '%v': %w", stack, key, ErrUndeclaredStackConfig))
+			}
+			continue
+		}
+		value := ps.Config[key]
+		if !projectConfigType.IsExplicitlyTyped() || value.Secure() {
+			continue
+		}
+		if problem := configTypeProblem(projectConfigType, value); problem != "" {
+			errs = append(errs, fmt.Errorf("stack '%v' config key '%v': %s", stack, key, problem))
+		}
+	}
+	return errs
+}
+
 func createConfigValue(rawValue interface{}) (config.Value, error) {
 	if isPrimitiveValue(rawValue) {
 		configValueContent := fmt.Sprintf("%v", rawValue)
@@ -114,6 +165,38 @@ func createConfigValue(rawValue interface{}) (config.Value, error) {
 	return config.NewObjectValue(string(configValueJSON)), nil
 }
 
+// configTypeProblem describes why the plaintext stack config value doesn't coerce to the type of projectConfigType,
+// or returns "" if it does.
+func configTypeProblem(projectConfigType ProjectConfigType, value config.Value) string {
+	raw, err := value.Value(config.NopDecrypter)
+	if err != nil {
+		return err.Error()
+	}
+	var content interface{} = raw
+	if value.Object() {
+		if err := json.Unmarshal([]byte(raw), &content); err != nil {
+			return fmt.Sprintf("value is not valid JSON: %v", err)
+		}
+	}
+	if ValidateConfigValue(*projectConfigType.Type, projectConfigType.Items, content) {
+		return ""
+	}
+	return fmt.Sprintf("value '%v' does not coerce to type '%v'",
+		raw, InferFullTypeName(*projectConfigType.Type, projectConfigType.Items))
+}
+
+// parseProjectConfigKey parses a key of the project's `config` block, which is in the project's namespace unless it
+// names another.
+func parseProjectConfigKey(projectName, projectConfigKey string) (config.Key, error) {
+	if strings.Contains(projectConfigKey, ":") {
+		// key is already namespaced
+		return config.ParseKey(projectConfigKey)
+	}
+	// key is not namespaced
+	// use the project as default namespace
+	return config.MustMakeKey(projectName, projectConfigKey), nil
+}
+
 func mergeConfig(
 	stackName string,
 	project *Project,
@@ -133,19 +216,9 @@ func mergeConfig(
 	for _, projectConfigKey := range keys {
 		projectConfigType := project.Config[projectConfigKey]
 
-		var key config.Key
-		if strings.Contains(projectConfigKey, ":") {
-			// key is already namespaced
-			parsedKey, parseError := config.ParseKey(projectConfigKey)
-			if parseError != nil {
-				return parseError
-			}
-
-			key = parsedKey
-		} else {
-			// key is not namespaced
-			// use the project as default namespace
-			key = config.MustMakeKey(projectName, projectConfigKey)
+		key, err := parseProjectConfigKey(projectName, projectConfigKey)
+		if err != nil {
+			return err
 		}
 
 		stackValue, foundOnStack, err := stackConfig.Get(key, true)
@@ -214,6 +287,32 @@ func ValidateStackConfigAndApplyProjectConfig(
 	return mergeConfig(stackName, project, stackConfig, decrypter, true)
 }
 
+// ConfigDefaults returns the values that the project's `config` block gives every stack that doesn't set them itself:
+// the `value` or `default` of each key that has one. Keys that aren't namespaced are in the project's namespace.
+func (proj *Project) ConfigDefaults() (config.Map, error) {
+	defaults := config.Map{}
+	for projectConfigKey, projectConfigType := range proj.Config {
+		value := projectConfigType.Value
+		if projectConfigType.Default != nil {
+			value = projectConfigType.Default
+		}
+		if value == nil {
+			continue
+		}
+
+		key, err := parseProjectConfigKey(proj.Name.String(), projectConfigKey)
+		if err != nil {
+			return nil, err
+		}
+		configValue, err := createConfigValue(value)
+		if err != nil {
+			return nil, err
+		}
+		defaults[key] = configValue
+	}
+	return defaults, nil
+}
+
 // ApplyConfigDefaults applies the default values for the project configuration onto the stack configuration
 // without validating the contents of stack config values.
 // This is because sometimes during pulumi config ls and pulumi config get, if users are
@@ -0,0 +1,74 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workspace
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// dotenvEntry is a single `NAME=value` assignment read from a dotenv file.
+type dotenvEntry struct {
+	name  string
+	value string
+}
+
+// formatDotenvValue returns v as it is written on the right hand side of a dotenv assignment. Values that would not
+// read back verbatim unquoted are double quoted, with Go escapes for quotes, backslashes, and control characters.
+func formatDotenvValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \t\r\n\"'\\#$`") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// parseDotenv reads the assignments in a dotenv file. Blank lines and lines starting with `#` are ignored, and an
+// optional leading `export` keyword is allowed. Double quoted values are unescaped, single quoted values are taken
+// literally, and unquoted values are trimmed of surrounding whitespace.
+func parseDotenv(data []byte) ([]dotenvEntry, error) {
+	var entries []dotenvEntry
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+
+		name, value, ok := strings.Cut(line, "=")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" {
+			return nil, fmt.Errorf("line %d: expected an assignment of the form NAME=value", i+1)
+		}
+
+		value = strings.TrimSpace(value)
+		switch {
+		case strings.HasPrefix(value, `"`):
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid quoted value for %s", i+1, name)
+			}
+			value = unquoted
+		case strings.HasPrefix(value, "'"):
+			if len(value) < 2 || !strings.HasSuffix(value, "'") {
+				return nil, fmt.Errorf("line %d: invalid quoted value for %s", i+1, name)
+			}
+			value = value[1 : len(value)-1]
+		}
+
+		entries = append(entries, dotenvEntry{name: name, value: value})
+	}
+	return entries, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workspace
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+)
+
+// workspaceFS is the set of filesystem operations used to read and write workspace files. It lets tests substitute
+// slow or failing filesystems; osFS is the real implementation.
+type workspaceFS interface {
+	ReadFile(name string) ([]byte, error)
+	Lstat(name string) (os.FileInfo, error)
+	MkdirAll(path string, perm os.FileMode) error
+	CreateTemp(dir, pattern string) (workspaceFile, error)
+	Rename(oldpath, newpath string) error
+	Remove(name string) error
+}
+
+// workspaceFile is a file created by workspaceFS.CreateTemp.
+type workspaceFile interface {
+	io.Writer
+	Name() string
+	Chmod(mode os.FileMode) error
+	Sync() error
+	Close() error
+}
+
+// osFS implements workspaceFS using the os package.
+type osFS struct{}
+
+func (osFS) ReadFile(name string) ([]byte, error)         { return os.ReadFile(name) }
+func (osFS) Lstat(name string) (os.FileInfo, error)       { return os.Lstat(name) }
+func (osFS) MkdirAll(path string, perm os.FileMode) error { return os.MkdirAll(path, perm) }
+func (osFS) Rename(oldpath, newpath string) error         { return os.Rename(oldpath, newpath) }
+func (osFS) Remove(name string) error                     { return os.Remove(name) }
+
+func (osFS) CreateTemp(dir, pattern string) (workspaceFile, error) {
+	return os.CreateTemp(dir, pattern)
+}
+
+// atomicWriteChunkSize is the size of the writes atomicWriteFile makes, checking for cancellation between them.
+const atomicWriteChunkSize = 32 * 1024
+
+// atomicWriteFile provides a rename based atomic write through a temporary file, which is given the permissions perm.
+// If ctx is canceled before the rename, the temporary file is removed and the file at path is left untouched.
+func atomicWriteFile(ctx context.Context, fs workspaceFS, path string, b []byte, perm os.FileMode) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	tmp, err := fs.CreateTemp(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file %s: %w", path, err)
+	}
+	defer func() { contract.Ignore(fs.Remove(tmp.Name())) }()
+	defer contract.IgnoreClose(tmp)
+
+	if err = tmp.Chmod(perm); err != nil {
+		return fmt.Errorf("failed to set temporary file permission: %w", err)
+	}
+	for len(b) > 0 {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		n := len(b)
+		if n > atomicWriteChunkSize {
+			n = atomicWriteChunkSize
+		}
+		if _, err = tmp.Write(b[:n]); err != nil {
+			return fmt.Errorf("failed to write to temporary file: %w", err)
+		}
+		b = b[n:]
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return fs.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,422 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workspace
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// LintDiagnostic is an advisory finding about a project. Unlike the errors returned by Validate, lint diagnostics
+// never prevent a project from being loaded or used.
+type LintDiagnostic struct {
+	// Field is the project field the diagnostic refers to, e.g. "main" or "runtime.options".
+	Field string
+	// Message describes the finding.
+	Message string
+	// Severity is how serious the finding is. The zero value is LintWarning.
+	Severity LintSeverity
+}
+
+// LintSeverity classifies a LintDiagnostic.
+type LintSeverity int
+
+const (
+	// LintWarning marks a finding that is likely a mistake.
+	LintWarning LintSeverity = iota
+	// LintNote marks a purely informational finding, such as which of several modes a project uses.
+	LintNote
+)
+
+func (d LintDiagnostic) String() string {
+	return fmt.Sprintf("%s: %s", d.Field, d.Message)
+}
+
+// projectLinters is the list of advisory checks run by Project.Lint.
+var projectLinters = []func(proj *Project) []LintDiagnostic{
+	lintMainExtension,
+	lintRuntimeProfile,
+	lintExtendsShadows,
+	lintRuntimeOptionCase,
+	lintDuplicatePlugins,
+	lintEmptyRuntimeOptions,
+	lintUnknownPlatforms,
+	lintImportantTemplate,
+	lintPlaintextSensitiveRuntimeOptions,
+}
+
+// runtimeLinters holds the advisory checks that only apply to projects using a particular runtime, keyed by runtime
+// name. They are run by Project.Lint after the checks that apply to every project.
+var runtimeLinters = map[string][]func(proj *Project) []LintDiagnostic{
+	"go": {lintGoBinary},
+}
+
+// Lint runs advisory checks over the project and returns any findings, in a stable order. It does not repeat the
+// checks performed by Validate.
+func (proj *Project) Lint() []LintDiagnostic {
+	var diags []LintDiagnostic
+	for _, linter := range projectLinters {
+		diags = append(diags, linter(proj)...)
+	}
+	return diags
+}
+
+// mainExtensions lists the file extensions a `main` file is expected to have for each runtime. Runtimes that are not
+// listed here are not checked.
+var mainExtensions = map[string][]string{
+	"nodejs": {".js", ".ts", ".mjs", ".cjs", ".mts", ".cts", ".jsx", ".tsx"},
+	"python": {".py"},
+	"dotnet": {".csproj", ".fsproj", ".vbproj", ".dll"},
+	"yaml":   {".yaml", ".yml", ".json"},
+}
+
+// mainIsDirectory guesses whether main refers to a directory, based only on its spelling: a trailing separator, a
+// relative directory reference, or a final path component without an extension.
+func mainIsDirectory(main string) bool {
+	if strings.HasSuffix(main, "/") || strings.HasSuffix(main, "\\") {
+		return true
+	}
+	base := filepath.Base(main)
+	return base == "." || base == ".." || filepath.Ext(base) == ""
+}
+
+// lintMainExtension warns when a `main` file's extension doesn't belong to the project's runtime, e.g. an index.py
+// under the nodejs runtime.
+func lintMainExtension(proj *Project) []LintDiagnostic {
+	if proj.Main == "" || mainIsDirectory(proj.Main) {
+		return nil
+	}
+	exts, ok := mainExtensions[proj.Runtime.Name()]
+	if !ok {
+		return nil
+	}
+
+	ext := strings.ToLower(filepath.Ext(proj.Main))
+	for _, e := range exts {
+		if e == ext {
+			return nil
+		}
+	}
+
+	expected := append([]string(nil), exts...)
+	sort.Strings(expected)
+	return []LintDiagnostic{{
+		Field: "main",
+		Message: fmt.Sprintf("'%s' does not look like a %s program; expected a file ending in one of %s",
+			proj.Main, proj.Runtime.Name(), strings.Join(expected, ", ")),
+	}}
+}
+
+// lintImportantTemplate warns when a template is marked important, so that it is listed by default, but has neither
+// config prompts nor a description, from the template or else the project, to tell users what it is for.
+func lintImportantTemplate(proj *Project) []LintDiagnostic {
+	if proj.Template == nil || !proj.Template.Important || len(proj.Template.Config) > 0 {
+		return nil
+	}
+	if strings.TrimSpace(proj.Template.Description) != "" ||
+		(proj.Description != nil && strings.TrimSpace(*proj.Description) != "") {
+		return nil
+	}
+	return []LintDiagnostic{{
+		Field: "template.important",
+		Message: "template is marked important but has no config prompts and no description; " +
+			"describe the template or remove the flag",
+	}}
+}
+
+// lintRuntimeProfile runs the runtime specific linters registered for the project's runtime.
+func lintRuntimeProfile(proj *Project) []LintDiagnostic {
+	var diags []LintDiagnostic
+	for _, linter := range runtimeLinters[proj.Runtime.Name()] {
+		diags = append(diags, linter(proj)...)
+	}
+	return diags
+}
+
+// lintGoBinary checks the options of a go project that opts into running a prebuilt binary through the `binary`
+// runtime option. Such a project needs the binary's path, and a `main` alongside it is ambiguous, since `main` is only
+// used to build the program from source. Projects without `binary` are noted as building from source.
+func lintGoBinary(proj *Project) []LintDiagnostic {
+	binary, ok := proj.Runtime.Options()["binary"]
+	if !ok {
+		return []LintDiagnostic{{
+			Field:    "runtime.options.binary",
+			Message:  "no prebuilt binary is set, so the program is built from source",
+			Severity: LintNote,
+		}}
+	}
+
+	var diags []LintDiagnostic
+	if path, isString := binary.(string); !isString || strings.TrimSpace(path) == "" {
+		diags = append(diags, LintDiagnostic{
+			Field:   "runtime.options.binary",
+			Message: "binary must be set to the path of the prebuilt program",
+		})
+	}
+	if proj.Main != "" {
+		diags = append(diags, LintDiagnostic{
+			Field: "main",
+			Message: "main is ignored when runtime.options.binary is set; " +
+				"remove one of them to make clear how the program is run",
+		})
+	}
+	return diags
+}
+
+// LintMainTarget checks that `main` refers to the kind of path the project's runtime expects, given the directory
+// containing the project file. A go project that runs a prebuilt binary, set by the `binary` runtime option, expects
+// `main` to be a file, while one built from source expects `main` to be a package directory. Whether `main` is a
+// directory is decided as for WorkingDir. Like those of Lint, the findings are advisory; unlike Lint, the check reads
+// the filesystem, so it is separate.
+func (proj *Project) LintMainTarget(projectDir string) []LintDiagnostic {
+	if proj.Main == "" || proj.Runtime.Name() != "go" {
+		return nil
+	}
+	main, err := proj.ResolvedMain(projectDir)
+	if err != nil {
+		// A main that references an unset environment variable can't be checked.
+		return nil
+	}
+
+	_, binary := proj.Runtime.Options()["binary"]
+	isDir := mainRefersToDirectory(main, proj.Main)
+	switch {
+	case binary && isDir:
+		return []LintDiagnostic{{
+			Field: "main",
+			Message: fmt.Sprintf("'%s' is a directory, but runtime.options.binary is set, so main should be the "+
+				"prebuilt binary", proj.Main),
+		}}
+	case !binary && !isDir:
+		return []LintDiagnostic{{
+			Field: "main",
+			Message: fmt.Sprintf("'%s' is a file, but a go program built from source needs main to be its package "+
+				"directory; set runtime.options.binary to run a prebuilt binary", proj.Main),
+		}}
+	}
+	return nil
+}
+
+// lintExtendsShadows reports the attributes of a project loaded by LoadProject that replace values inherited through
+// `extends`, so that the overrides can be confirmed as intentional. Attributes redefined with the inherited value are
+// warned about, since they are most likely an accidental duplication that stops later changes to the base project
+// from being picked up.
+func lintExtendsShadows(proj *Project) []LintDiagnostic {
+	var diags []LintDiagnostic
+	for _, shadow := range proj.extendsShadows {
+		if shadow.unchanged {
+			diags = append(diags, LintDiagnostic{
+				Field: shadow.field,
+				Message: fmt.Sprintf("redefines the value inherited from '%s' without changing it; "+
+					"remove it to keep inheriting the value", proj.Extends),
+			})
+		} else {
+			diags = append(diags, LintDiagnostic{
+				Field:    shadow.field,
+				Message:  fmt.Sprintf("overrides the value inherited from '%s'", proj.Extends),
+				Severity: LintNote,
+			})
+		}
+	}
+	return diags
+}
+
+// lintRuntimeOptionCase warns about runtime options whose name differs only in case from one of the runtime's
+// KnownRuntimeOptions, e.g. `TypeScript` for `typescript`. Option names are case-sensitive, so such an option is
+// silently ignored by the runtime.
+func lintRuntimeOptionCase(proj *Project) []LintDiagnostic {
+	known := KnownRuntimeOptions[proj.Runtime.Name()]
+	options := proj.Runtime.Options()
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var diags []LintDiagnostic
+	for _, name := range names {
+		for _, canonical := range known {
+			if name != canonical && strings.EqualFold(name, canonical) {
+				diags = append(diags, LintDiagnostic{
+					Field: "runtime.options." + name,
+					Message: fmt.Sprintf("option names are case-sensitive, so '%s' is ignored by the %s runtime; "+
+						"did you mean '%s'?", name, proj.Runtime.Name(), canonical),
+				})
+				break
+			}
+		}
+	}
+	return diags
+}
+
+// lintDuplicatePlugins warns about plugins listed more than once with the same version and path. Duplicates that
+// disagree are rejected by Validate.
+func lintDuplicatePlugins(proj *Project) []LintDiagnostic {
+	if proj.Plugins == nil {
+		return nil
+	}
+
+	var diags []LintDiagnostic
+	for _, kind := range []struct {
+		field   string
+		plugins []PluginOptions
+	}{
+		{"plugins.providers", proj.Plugins.Providers},
+		{"plugins.languages", proj.Plugins.Languages},
+		{"plugins.analyzers", proj.Plugins.Analyzers},
+	} {
+		seen := make(map[string]bool, len(kind.plugins))
+		for _, plugin := range kind.plugins {
+			if seen[plugin.Name] {
+				diags = append(diags, LintDiagnostic{
+					Field:   kind.field,
+					Message: fmt.Sprintf("plugin '%s' is listed more than once; remove the duplicate entry", plugin.Name),
+				})
+			}
+			seen[plugin.Name] = true
+		}
+	}
+	return diags
+}
+
+// lintEmptyRuntimeOptions suggests collapsing a runtime whose options object is present but empty, which is
+// equivalent to naming the runtime on its own.
+func lintEmptyRuntimeOptions(proj *Project) []LintDiagnostic {
+	options := proj.Runtime.Options()
+	if options == nil || len(options) > 0 {
+		return nil
+	}
+	return []LintDiagnostic{{
+		Field: "runtime.options",
+		Message: fmt.Sprintf("options is empty, so the runtime can be written as `runtime: %s`",
+			proj.Runtime.Name()),
+		Severity: LintNote,
+	}}
+}
+
+// SensitiveRuntimeOptionPatterns match the names of runtime options that likely hold sensitive values, such as
+// `registryToken`. Project.Lint warns when such an option holds a plaintext value rather than a secret.
+var SensitiveRuntimeOptionPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)(token|password|passwd|secret|credential|api[-_]?key|private[-_]?key)`),
+}
+
+// envReferencePattern matches a value that is nothing but a reference to an environment variable, as in `$TOKEN` or
+// `${TOKEN}`, which doesn't hold the sensitive value itself.
+var envReferencePattern = regexp.MustCompile(`^\$(\{[A-Za-z_][A-Za-z0-9_]*\}|[A-Za-z_][A-Za-z0-9_]*)$`)
+
+// lintPlaintextSensitiveRuntimeOptions warns about runtime options, including options nested inside object values,
+// whose names match SensitiveRuntimeOptionPatterns but that hold a plaintext string rather than a secret. Values that
+// only reference an environment variable are left alone.
+func lintPlaintextSensitiveRuntimeOptions(proj *Project) []LintDiagnostic {
+	var diags []LintDiagnostic
+	var walk func(field string, options map[string]interface{})
+	walk = func(field string, options map[string]interface{}) {
+		names := make([]string, 0, len(options))
+		for name := range options {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			switch value := options[name].(type) {
+			case string:
+				if value == "" || envReferencePattern.MatchString(value) || !isSensitiveRuntimeOption(name) {
+					continue
+				}
+				diags = append(diags, LintDiagnostic{
+					Field: field + "." + name,
+					Message: fmt.Sprintf("'%s' looks sensitive but holds a plaintext value; store it as a secret, "+
+						"in the `secure: <ciphertext>` form of a secret config value, or reference an environment "+
+						"variable", name),
+				})
+			case map[string]interface{}, map[interface{}]interface{}:
+				if _, secret := secureRuntimeOption(value); secret {
+					continue
+				}
+				if nested, err := SimplifyMarshalledValue(value); err == nil {
+					if m, ok := nested.(map[string]interface{}); ok {
+						walk(field+"."+name, m)
+					}
+				}
+			}
+		}
+	}
+	walk("runtime.options", proj.Runtime.Options())
+	return diags
+}
+
+func isSensitiveRuntimeOption(name string) bool {
+	for _, pattern := range SensitiveRuntimeOptionPatterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// knownPlatformOS and knownPlatformArch list the operating systems and architectures that Go supports, which are the
+// names a platform is expected to use.
+var (
+	knownPlatformOS = []string{
+		"aix", "android", "darwin", "dragonfly", "freebsd", "illumos", "ios", "js", "linux", "netbsd", "openbsd",
+		"plan9", "solaris", "wasip1", "windows",
+	}
+	knownPlatformArch = []string{
+		"386", "amd64", "arm", "arm64", "loong64", "mips", "mips64", "mips64le", "mipsle", "ppc64", "ppc64le",
+		"riscv64", "s390x", "wasm",
+	}
+)
+
+// lintUnknownPlatforms warns about platforms whose operating system or architecture isn't one that Go knows, such as
+// "macos/arm64" for "darwin/arm64", since no machine would ever match them. Malformed platforms are rejected by
+// Validate.
+func lintUnknownPlatforms(proj *Project) []LintDiagnostic {
+	var diags []LintDiagnostic
+	for i, platform := range proj.Platforms {
+		goos, goarch, err := parsePlatform(platform)
+		if err != nil {
+			continue
+		}
+
+		var unknown []string
+		if !containsFold(knownPlatformOS, goos) {
+			unknown = append(unknown, fmt.Sprintf("operating system '%s'", goos))
+		}
+		if !containsFold(knownPlatformArch, goarch) {
+			unknown = append(unknown, fmt.Sprintf("architecture '%s'", goarch))
+		}
+		if len(unknown) > 0 {
+			diags = append(diags, LintDiagnostic{
+				Field: fmt.Sprintf("platforms[%d]", i),
+				Message: fmt.Sprintf("'%s' has an unknown %s; platforms use the names of runtime.GOOS and "+
+					"runtime.GOARCH, e.g. 'linux/amd64'", platform, strings.Join(unknown, " and ")),
+			})
+		}
+	}
+	return diags
+}
+
+// containsFold returns true if names contains name, ignoring case.
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
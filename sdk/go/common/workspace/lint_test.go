@@ -0,0 +1,428 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workspace
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLintMainExtension(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		runtime  string
+		main     string
+		expected []LintDiagnostic
+	}{
+		{name: "Unset", runtime: "nodejs"},
+		{name: "TypeScript", runtime: "nodejs", main: "src/index.ts"},
+		{name: "Python", runtime: "python", main: "app/__main__.py"},
+		{name: "Directory", runtime: "nodejs", main: "src/"},
+		{name: "DirectoryWithoutSlash", runtime: "python", main: "program"},
+		{name: "CurrentDirectory", runtime: "python", main: "."},
+		{name: "UnknownRuntime", runtime: "cobol", main: "main.cbl"},
+		{
+			name:    "PythonUnderNodejs",
+			runtime: "nodejs",
+			main:    "index.py",
+			expected: []LintDiagnostic{{
+				Field: "main",
+				Message: "'index.py' does not look like a nodejs program; expected a file ending in one of " +
+					".cjs, .cts, .js, .jsx, .mjs, .mts, .ts, .tsx",
+			}},
+		},
+		{
+			name:    "TypeScriptUnderPython",
+			runtime: "python",
+			main:    "index.ts",
+			expected: []LintDiagnostic{{
+				Field:   "main",
+				Message: "'index.ts' does not look like a python program; expected a file ending in one of .py",
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo(tt.runtime, nil), Main: tt.main}
+			assert.Equal(t, tt.expected, proj.Lint())
+		})
+	}
+}
+
+func TestLintImportantTemplate(t *testing.T) {
+	t.Parallel()
+
+	blank := "  "
+	described := "A static website on AWS"
+	warning := []LintDiagnostic{{
+		Field: "template.important",
+		Message: "template is marked important but has no config prompts and no description; " +
+			"describe the template or remove the flag",
+	}}
+
+	tests := []struct {
+		name        string
+		template    ProjectTemplate
+		description *string
+		expected    []LintDiagnostic
+	}{
+		{name: "Empty", template: ProjectTemplate{Important: true}, expected: warning},
+		{name: "BlankDescription", template: ProjectTemplate{Important: true, Description: "\n"}, expected: warning},
+		{
+			name:        "BlankProjectDescription",
+			template:    ProjectTemplate{Important: true},
+			description: &blank,
+			expected:    warning,
+		},
+		{name: "Described", template: ProjectTemplate{Important: true, Description: described}},
+		{name: "ProjectDescribed", template: ProjectTemplate{Important: true}, description: &described},
+		{
+			name: "ConfigPrompts",
+			template: ProjectTemplate{
+				Important: true,
+				Config:    map[string]ProjectTemplateConfigValue{"aws:region": {Default: "us-west-2"}},
+			},
+		},
+		{name: "NotImportant", template: ProjectTemplate{}},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			template := tt.template
+			proj := &Project{
+				Name:        "test",
+				Runtime:     NewProjectRuntimeInfo("nodejs", nil),
+				Description: tt.description,
+				Template:    &template,
+			}
+			assert.Equal(t, tt.expected, proj.Lint())
+		})
+	}
+}
+
+func TestLintGoBinary(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		main     string
+		options  map[string]interface{}
+		expected []LintDiagnostic
+	}{
+		{
+			name: "SourceMode",
+			expected: []LintDiagnostic{{
+				Field:    "runtime.options.binary",
+				Message:  "no prebuilt binary is set, so the program is built from source",
+				Severity: LintNote,
+			}},
+		},
+		{
+			name:    "Binary",
+			options: map[string]interface{}{"binary": "bin/app"},
+		},
+		{
+			name:    "BinaryWithMain",
+			main:    "cmd/app",
+			options: map[string]interface{}{"binary": "bin/app"},
+			expected: []LintDiagnostic{{
+				Field: "main",
+				Message: "main is ignored when runtime.options.binary is set; " +
+					"remove one of them to make clear how the program is run",
+			}},
+		},
+		{
+			name:    "EmptyBinary",
+			options: map[string]interface{}{"binary": ""},
+			expected: []LintDiagnostic{{
+				Field:   "runtime.options.binary",
+				Message: "binary must be set to the path of the prebuilt program",
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo("go", tt.options), Main: tt.main}
+			assert.Equal(t, tt.expected, proj.Lint())
+		})
+	}
+}
+
+func TestLintMainTarget(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"cmd/app/main.go": "package main\n",
+		"bin/app":         "",
+	})
+
+	const (
+		binaryIsDir  = "is a directory, but runtime.options.binary is set, so main should be the prebuilt binary"
+		sourceIsFile = "is a file, but a go program built from source needs main to be its package directory; " +
+			"set runtime.options.binary to run a prebuilt binary"
+	)
+	binary := map[string]interface{}{"binary": "bin/app"}
+
+	tests := []struct {
+		name     string
+		runtime  string
+		main     string
+		options  map[string]interface{}
+		expected string
+	}{
+		{name: "SourceWithDirectory", runtime: "go", main: "cmd/app"},
+		{name: "SourceWithFile", runtime: "go", main: "cmd/app/main.go", expected: "'cmd/app/main.go' " + sourceIsFile},
+		{name: "SourceWithMissingDirectory", runtime: "go", main: "cmd/other/"},
+		{name: "SourceWithMissingFile", runtime: "go", main: "other.go", expected: "'other.go' " + sourceIsFile},
+		{name: "BinaryWithFile", runtime: "go", main: "bin/app", options: binary},
+		{name: "BinaryWithDirectory", runtime: "go", main: "cmd/app", options: binary, expected: "'cmd/app' " + binaryIsDir},
+		{name: "BinaryWithMissingDirectory", runtime: "go", main: "out/", options: binary, expected: "'out/' " + binaryIsDir},
+		{name: "NoMain", runtime: "go", options: binary},
+		{name: "OtherRuntime", runtime: "nodejs", main: "cmd/app/main.go"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo(tt.runtime, tt.options), Main: tt.main}
+			diags := proj.LintMainTarget(dir)
+			if tt.expected == "" {
+				assert.Empty(t, diags)
+				return
+			}
+			assert.Equal(t, []LintDiagnostic{{Field: "main", Message: tt.expected}}, diags)
+		})
+	}
+}
+
+func TestLintExtendsShadows(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"base.yaml": `name: base
+runtime: nodejs
+author: Platform
+config:
+  aws:region: us-west-2
+  instanceSize: t3.micro
+`,
+		"Pulumi.yaml": `name: app
+extends: base.yaml
+runtime: python
+author: Platform
+config:
+  instanceSize: t3.large
+  replicas: 3
+`,
+	})
+
+	proj, err := LoadProject(filepath.Join(dir, "Pulumi.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, []LintDiagnostic{
+		{
+			Field: "author",
+			Message: "redefines the value inherited from 'base.yaml' without changing it; " +
+				"remove it to keep inheriting the value",
+		},
+		{
+			Field:    "config.instanceSize",
+			Message:  "overrides the value inherited from 'base.yaml'",
+			Severity: LintNote,
+		},
+		{
+			Field:    "runtime",
+			Message:  "overrides the value inherited from 'base.yaml'",
+			Severity: LintNote,
+		},
+	}, proj.Lint())
+}
+
+func TestLintExtendsOnlyAddsFields(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"base.yaml":   "name: base\nruntime: nodejs\nconfig:\n  aws:region: us-west-2\n",
+		"Pulumi.yaml": "name: app\nextends: base.yaml\ndescription: The app\nconfig:\n  replicas: 3\n",
+	})
+
+	proj, err := LoadProject(filepath.Join(dir, "Pulumi.yaml"))
+	require.NoError(t, err)
+	assert.Empty(t, proj.Lint())
+}
+
+func TestLintRuntimeOptionCase(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     string
+		runtime  string
+		options  map[string]interface{}
+		expected []LintDiagnostic
+	}{
+		{name: "Canonical", runtime: "nodejs", options: map[string]interface{}{"typescript": false}},
+		{name: "Unknown", runtime: "nodejs", options: map[string]interface{}{"someOption": true}},
+		{name: "UnknownRuntime", runtime: "cobol", options: map[string]interface{}{"TypeScript": false}},
+		{
+			name:    "MisCased",
+			runtime: "nodejs",
+			options: map[string]interface{}{"TypeScript": false, "nodeargs": "--inspect"},
+			expected: []LintDiagnostic{{
+				Field: "runtime.options.TypeScript",
+				Message: "option names are case-sensitive, so 'TypeScript' is ignored by the nodejs runtime; " +
+					"did you mean 'typescript'?",
+			}},
+		},
+		{
+			name:    "MisCasedCamelCase",
+			runtime: "python",
+			options: map[string]interface{}{"VirtualEnv": "venv"},
+			expected: []LintDiagnostic{{
+				Field: "runtime.options.VirtualEnv",
+				Message: "option names are case-sensitive, so 'VirtualEnv' is ignored by the python runtime; " +
+					"did you mean 'virtualenv'?",
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo(tt.runtime, tt.options)}
+			assert.Equal(t, tt.expected, proj.Lint())
+		})
+	}
+}
+
+func TestLintDuplicatePlugins(t *testing.T) {
+	t.Parallel()
+
+	proj, err := loadProjectFromText(t, `name: test
+runtime: nodejs
+plugins:
+  providers:
+    - name: aws
+      version: 5.0.0
+      path: plugins/aws
+    - name: gcp
+      path: plugins/gcp
+    - name: aws
+      version: 5.0.0
+      path: plugins/aws
+`)
+	require.NoError(t, err)
+	assert.Equal(t, []LintDiagnostic{{
+		Field:   "plugins.providers",
+		Message: "plugin 'aws' is listed more than once; remove the duplicate entry",
+	}}, proj.Lint())
+}
+
+func TestLintEmptyRuntimeOptions(t *testing.T) {
+	t.Parallel()
+
+	proj, err := loadProjectFromText(t, "name: test\nruntime:\n  name: nodejs\n  options: {}\n")
+	require.NoError(t, err)
+	assert.Equal(t, []LintDiagnostic{{
+		Field:    "runtime.options",
+		Message:  "options is empty, so the runtime can be written as `runtime: nodejs`",
+		Severity: LintNote,
+	}}, proj.Lint())
+
+	proj, err = loadProjectFromText(t, "name: test\nruntime:\n  name: nodejs\n  options:\n    typescript: false\n")
+	require.NoError(t, err)
+	assert.Empty(t, proj.Lint())
+
+	proj, err = loadProjectFromText(t, "name: test\nruntime: nodejs\n")
+	require.NoError(t, err)
+	assert.Empty(t, proj.Lint())
+}
+
+func TestLintPlaintextSensitiveRuntimeOptions(t *testing.T) {
+	t.Parallel()
+
+	proj, err := loadProjectFromText(t, `name: test
+runtime:
+  name: nodejs
+  options:
+    registryToken: abc123
+    npmPassword:
+      secure: c2VjcmV0
+    apiKey: ${API_KEY}
+    secretsDir: ""
+    typescript: true
+    registry:
+      url: https://registry.example.com
+      authToken: xyz
+`)
+	require.NoError(t, err)
+	message := func(name string) string {
+		return "'" + name + "' looks sensitive but holds a plaintext value; store it as a secret, in the " +
+			"`secure: <ciphertext>` form of a secret config value, or reference an environment variable"
+	}
+	assert.Equal(t, []LintDiagnostic{
+		{Field: "runtime.options.registry.authToken", Message: message("authToken")},
+		{Field: "runtime.options.registryToken", Message: message("registryToken")},
+	}, proj.Lint())
+
+	proj.Runtime.SetSecretOption("registryToken", "YWJjMTIz")
+	proj.Runtime.SetOption("registry", map[string]interface{}{"url": "https://registry.example.com"})
+	assert.Empty(t, proj.Lint())
+}
+
+func TestLintUnknownPlatforms(t *testing.T) {
+	t.Parallel()
+
+	proj := &Project{
+		Name:      "test",
+		Runtime:   NewProjectRuntimeInfo("go", map[string]interface{}{"binary": "bin/app"}),
+		Platforms: []string{"linux/amd64", "Darwin/ARM64", "macos/arm64", "linux/x86_64", "beos/ppc"},
+	}
+	assert.Equal(t, []LintDiagnostic{
+		{
+			Field: "platforms[2]",
+			Message: "'macos/arm64' has an unknown operating system 'macos'; platforms use the names of " +
+				"runtime.GOOS and runtime.GOARCH, e.g. 'linux/amd64'",
+		},
+		{
+			Field: "platforms[3]",
+			Message: "'linux/x86_64' has an unknown architecture 'x86_64'; platforms use the names of " +
+				"runtime.GOOS and runtime.GOARCH, e.g. 'linux/amd64'",
+		},
+		{
+			Field: "platforms[4]",
+			Message: "'beos/ppc' has an unknown operating system 'beos' and architecture 'ppc'; platforms use " +
+				"the names of runtime.GOOS and runtime.GOARCH, e.g. 'linux/amd64'",
+		},
+	}, proj.Lint())
+}
@@ -15,35 +15,394 @@
 package workspace
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/hashicorp/go-multierror"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/yamlutil"
+	"gopkg.in/yaml.v3"
 )
 
 // readFileStripUTF8BOM wraps os.ReadFile and also strips the UTF-8 Byte-order Mark (BOM) if present.
 func readFileStripUTF8BOM(path string) ([]byte, error) {
-	b, err := os.ReadFile(path)
+	return readFileStripUTF8BOMFrom(osFS{}, path)
+}
+
+// readFileStripUTF8BOMFrom is readFileStripUTF8BOM for a file in the given filesystem.
+func readFileStripUTF8BOMFrom(fs workspaceFS, path string) ([]byte, error) {
+	b, err := fs.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	// Strip UTF-8 BOM bytes if present to avoid problems with downstream parsing.
-	// References:
-	//   https://github.com/spkg/bom
-	//   https://en.wikipedia.org/wiki/Byte_order_mark
+	return stripUTF8BOM(b), nil
+}
+
+// stripUTF8BOM returns b without its UTF-8 BOM, if it has one, to avoid problems with downstream parsing.
+// References:
+//
+//	https://github.com/spkg/bom
+//	https://en.wikipedia.org/wiki/Byte_order_mark
+func stripUTF8BOM(b []byte) []byte {
 	if len(b) >= 3 &&
 		b[0] == 0xef &&
 		b[1] == 0xbb &&
 		b[2] == 0xbf {
 		b = b[3:]
 	}
+	return b
+}
+
+// errTrailingProjectContent is returned when a JSON project file has content after its top-level object.
+var errTrailingProjectContent = errors.New("unexpected trailing content in project file")
+
+// errMixedProjectFormat is returned when a JSON project file starts with a YAML document separator but the rest of it
+// isn't a JSON object.
+var errMixedProjectFormat = errors.New(
+	"project file starts with a YAML document separator ('---') but isn't a JSON object; " +
+		"remove the separator, or save the project as YAML")
+
+// stripLeadingDocumentSeparator returns the JSON project file contents b without a leading YAML `---` document
+// separator line, which some generators mistakenly emit before the JSON object. The separator is blanked out rather
+// than removed so that the positions reported for any later errors still match the file.
+func stripLeadingDocumentSeparator(b []byte) ([]byte, error) {
+	if !bytes.HasPrefix(b, []byte("---")) {
+		return b, nil
+	}
+	line, rest := b, []byte(nil)
+	if i := bytes.IndexByte(b, '\n'); i >= 0 {
+		line, rest = b[:i], b[i+1:]
+	}
+	isSeparator := len(bytes.TrimRight(line[3:], " \t\r")) == 0
+	if !isSeparator || !bytes.HasPrefix(bytes.TrimLeft(rest, " \t\r\n"), []byte("{")) {
+		return nil, errMixedProjectFormat
+	}
+	stripped := make([]byte, len(b))
+	copy(stripped, b)
+	copy(stripped, "   ")
+	return stripped, nil
+}
+
+// JSONPositionError is an error in a JSON project file, along with the position in the file it was found at.
+type JSONPositionError struct {
+	// Line is the 1-based line of the error.
+	Line int
+	// Column is the 1-based column of the error, counted in bytes. Type errors, including values that don't match the
+	// project schema, are reported at the last byte of the value at fault, or at the opening bracket of an object or
+	// array.
+	Column int
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *JSONPositionError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %v", e.Line, e.Column, e.Err)
+}
+
+func (e *JSONPositionError) Unwrap() error {
+	return e.Err
+}
+
+// newJSONPositionError returns a JSONPositionError for err, found after reading offset bytes of b.
+func newJSONPositionError(b []byte, offset int64, err error) *JSONPositionError {
+	// The offset is just past the byte at fault.
+	pos := int(offset) - 1
+	if pos < 0 {
+		pos = 0
+	} else if pos > len(b) {
+		pos = len(b)
+	}
+	before := b[:pos]
+	return &JSONPositionError{
+		Line:   bytes.Count(before, []byte("\n")) + 1,
+		Column: pos - bytes.LastIndexByte(before, '\n'),
+		Err:    err,
+	}
+}
+
+// readSchemaHint returns the schema URL of the yaml-language-server directive among the comments at the top of the
+// YAML document b, or "" if there is none.
+func readSchemaHint(b []byte) string {
+	for _, line := range strings.Split(string(b), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, yamlSchemaDirective) {
+			return strings.TrimSpace(strings.TrimPrefix(line, yamlSchemaDirective))
+		} else if line != "" && !strings.HasPrefix(line, "#") {
+			return ""
+		}
+	}
+	return ""
+}
+
+// unmarshalProjectDocument unmarshals the project file contents b into v. JSON documents are decoded as a single
+// top-level value, and any content after it other than whitespace is an error. JSON numbers are decoded as
+// json.Number, and syntax and type errors are reported as a *JSONPositionError. YAML documents may not repeat a key
+// within the same mapping.
+func unmarshalProjectDocument(marshaller encoding.Marshaler, b []byte, v interface{}) error {
+	if marshaller != encoding.JSON {
+		if marshaller == encoding.YAML {
+			if err := checkDuplicateYAMLKeys(b); err != nil {
+				return err
+			}
+		}
+		return marshaller.Unmarshal(b, v)
+	}
+
+	b, err := stripLeadingDocumentSeparator(b)
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	// Decode numbers as json.Number so that large integers aren't rounded through float64.
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		var syntaxErr *json.SyntaxError
+		var typeErr *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &syntaxErr):
+			return newJSONPositionError(b, syntaxErr.Offset, err)
+		case errors.As(err, &typeErr):
+			return newJSONPositionError(b, typeErr.Offset, err)
+		}
+		return err
+	}
+	end := dec.InputOffset()
+	if _, err := dec.Token(); err != io.EOF {
+		// Point at the first byte after the value that isn't whitespace.
+		trailing := len(bytes.TrimLeft(b[end:], " \t\r\n"))
+		return newJSONPositionError(b, int64(len(b)-trailing)+1, errTrailingProjectContent)
+	}
+	return nil
+}
 
+// withJSONPositions returns err with each *projectValueError in it, or among its errors if it is a
+// *multierror.Error, wrapped in a *JSONPositionError giving the position of the value at fault in the JSON project file
+// b. Values that aren't found in b, such as those inherited through `extends`, are left without a position.
+func withJSONPositions(b []byte, err error) error {
+	var offsets map[string]int64
+	position := func(err error) error {
+		valueErr, ok := err.(*projectValueError)
+		if !ok {
+			return err
+		}
+		if offsets == nil {
+			offsets = jsonValueOffsets(b)
+		}
+		offset, ok := offsets[valueErr.location]
+		if !ok {
+			return err
+		}
+		return newJSONPositionError(b, offset, valueErr)
+	}
+
+	errs, ok := err.(*multierror.Error)
+	if !ok {
+		return position(err)
+	}
+	positioned := &multierror.Error{ErrorFormat: errs.ErrorFormat}
+	for _, err := range errs.Errors {
+		positioned.Errors = append(positioned.Errors, position(err))
+	}
+	return positioned
+}
+
+// jsonValueOffsets returns the offset of every value in the JSON document b, keyed by the value's JSON pointer as
+// reported by the schema validator. The offset is just past the value's last byte, or just past the opening bracket
+// of an object or array, matching the offsets of type errors. b is expected to have been decoded successfully already;
+// if it hasn't, the offsets of the values read before the error are returned.
+func jsonValueOffsets(b []byte) map[string]int64 {
+	b, err := stripLeadingDocumentSeparator(b)
+	if err != nil {
+		return nil
+	}
+	offsets := make(map[string]int64)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	var walk func(pointer string) error
+	walk = func(pointer string) error {
+		token, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		offsets[pointer] = dec.InputOffset()
+		switch token {
+		case json.Delim('{'):
+			for dec.More() {
+				key, err := dec.Token()
+				if err != nil {
+					return err
+				}
+				if err = walk(pointer + "/" + escapeJSONPointer(key.(string))); err != nil {
+					return err
+				}
+			}
+		case json.Delim('['):
+			for i := 0; dec.More(); i++ {
+				if err := walk(pointer + "/" + strconv.Itoa(i)); err != nil {
+					return err
+				}
+			}
+		default:
+			return nil
+		}
+		// Read the closing bracket.
+		_, err = dec.Token()
+		return err
+	}
+	_ = walk("")
+	return offsets
+}
+
+// escapeJSONPointer escapes a key for use in a JSON pointer the way the schema validator does.
+func escapeJSONPointer(key string) string {
+	key = strings.ReplaceAll(key, "~", "~0")
+	key = strings.ReplaceAll(key, "/", "~1")
+	return url.PathEscape(key)
+}
+
+// checkDuplicateYAMLKeys returns an error naming the first key that is repeated within a mapping of the YAML
+// document b, at any depth. YAML decoders keep just the last value of a repeated key, so a repeated `runtime` or
+// config key would otherwise be silently overridden. Syntax errors are left to the unmarshal to report.
+func checkDuplicateYAMLKeys(b []byte) error {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil //nolint:nilerr
+	}
+	return findDuplicateYAMLKey(&doc)
+}
+
+func findDuplicateYAMLKey(node *yaml.Node) error {
+	if node.Kind == yaml.MappingNode {
+		lines := make(map[string]int, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key := node.Content[i]
+			// Merge keys (`<<`) may appear more than once, and the mappings they merge may override each other.
+			if key.Kind != yaml.ScalarNode || key.Tag == "!!merge" {
+				continue
+			}
+			if line, has := lines[key.Value]; has {
+				return fmt.Errorf("duplicate key '%v' at line %d; it is already defined at line %d",
+					key.Value, key.Line, line)
+			}
+			lines[key.Value] = key.Line
+		}
+	}
+	// Aliases aren't followed: the nodes they refer to are checked where they are defined.
+	for _, child := range node.Content {
+		if err := findDuplicateYAMLKey(child); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitInlineStackDocuments splits the contents b of a YAML project file into the project document and the inline stack
+// documents that follow it, which start at the first `---` document marker after the project's content. The stack
+// documents are nil if there are none. Document markers always start at the beginning of a line, and can't appear
+// within the content of a document.
+func splitInlineStackDocuments(b []byte) ([]byte, []byte) {
+	sawContent := false
+	for offset := 0; offset < len(b); {
+		end := bytes.IndexByte(b[offset:], '\n')
+		if end < 0 {
+			end = len(b)
+		} else {
+			end += offset + 1
+		}
+		line := bytes.TrimRight(b[offset:end], "\r\n")
+
+		isMarker := bytes.HasPrefix(line, []byte("---")) &&
+			(len(line) == 3 || line[3] == ' ' || line[3] == '\t')
+		switch {
+		case isMarker && sawContent:
+			return b[:offset], b[offset:]
+		case isMarker:
+			// A marker before any content starts the project document.
+			sawContent = len(bytes.TrimSpace(line[3:])) > 0
+		default:
+			trimmed := bytes.TrimSpace(line)
+			if len(trimmed) > 0 && trimmed[0] != '#' {
+				sawContent = true
+			}
+		}
+		offset = end
+	}
 	return b, nil
 }
 
+// parseInlineStackDocuments parses the inline stack documents that follow the project in a YAML project file into the
+// config of each stack they declare. Each document must name its stack with a `stack` attribute, and may hold the
+// stack's config in a `config` attribute, written as in a stack config file. Empty documents are ignored.
+func parseInlineStackDocuments(project *Project, b []byte) (map[tokens.QName]config.Map, error) {
+	stacks := make(map[tokens.QName]config.Map)
+	dec := yaml.NewDecoder(bytes.NewReader(b))
+	for i := 1; ; i++ {
+		var raw interface{}
+		if err := dec.Decode(&raw); err == io.EOF {
+			return stacks, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("invalid inline stack document %d: %w", i, err)
+		}
+		if raw == nil {
+			continue
+		}
+
+		doc, err := SimplifyMarshalledProject(raw)
+		if err != nil {
+			return nil, fmt.Errorf("inline stack document %d must be an object with 'stack' and 'config' attributes", i)
+		}
+		for key := range doc {
+			if key != "stack" && key != "config" {
+				return nil, fmt.Errorf("inline stack document %d has unknown attribute '%v'; "+
+					"only 'stack' and 'config' are allowed", i, key)
+			}
+		}
+		name, _ := doc["stack"].(string)
+		if name == "" {
+			return nil, fmt.Errorf("inline stack document %d must declare the stack it configures with a 'stack' "+
+				"attribute", i)
+		}
+		if !tokens.IsQName(name) {
+			return nil, fmt.Errorf("inline stack document %d: '%v' is not a valid stack name", i, name)
+		}
+		stack := tokens.QName(name)
+		if _, has := stacks[stack]; has {
+			return nil, fmt.Errorf("stack '%v' is configured by more than one inline stack document", stack)
+		}
+
+		// Namespace the config with the project's name, as for a stack config file.
+		namespaced, err := encoding.YAML.Marshal(stackConfigNamespacedWithProject(project, doc))
+		if err != nil {
+			return nil, err
+		}
+		var parsed struct {
+			Config config.Map `yaml:"config"`
+		}
+		if err = encoding.YAML.Unmarshal(namespaced, &parsed); err != nil {
+			return nil, fmt.Errorf("inline stack document %d has invalid config: %w", i, err)
+		}
+		if parsed.Config == nil {
+			parsed.Config = make(config.Map)
+		}
+		stacks[stack] = parsed.Config
+	}
+}
+
 // Rewrite config values to make them namespaced. Using the project name as the default namespace
 // for example:
 //
@@ -86,38 +445,163 @@ func stackConfigNamespacedWithProject(project *Project, projectStack map[string]
 
 // LoadProject reads a project definition from a file.
 func LoadProject(path string) (*Project, error) {
+	project, _, err := loadProject(osFS{}, path, LoadOptions{}, false /*allowMissingRuntime*/)
+	return project, err
+}
+
+// ProjectFormat is a format that a project definition can be written in.
+type ProjectFormat string
+
+const (
+	// ProjectFormatYAML is the format of Pulumi.yaml and Pulumi.yml project files.
+	ProjectFormatYAML ProjectFormat = "yaml"
+	// ProjectFormatJSON is the format of Pulumi.json project files.
+	ProjectFormatJSON ProjectFormat = "json"
+)
+
+// LoadProjectBytes reads a project definition from data, written in the given format, without touching the disk. The
+// project is validated as by LoadProject. Since there is no file to resolve it against, a project that uses `extends`
+// is an error.
+func LoadProjectBytes(data []byte, format ProjectFormat) (*Project, error) {
+	var marshaller encoding.Marshaler
+	switch format {
+	case ProjectFormatYAML:
+		marshaller = encoding.YAML
+	case ProjectFormatJSON:
+		marshaller = encoding.JSON
+	default:
+		return nil, fmt.Errorf("unknown project format '%v'", format)
+	}
+
+	project, _, err := loadProjectData(
+		nil, "", marshaller, stripUTF8BOM(data), LoadOptions{}, false /*allowMissingRuntime*/)
+	return project, err
+}
+
+// LoadProjectForScaffold reads a project definition from a file that may not have chosen its runtime yet, as happens
+// while `pulumi new` scaffolds a project. A missing runtime is not an error: the project is returned with an empty
+// Runtime and needsRuntime set to true. Everything else is validated as by LoadProject.
+func LoadProjectForScaffold(path string) (project *Project, needsRuntime bool, err error) {
+	return loadProject(osFS{}, path, LoadOptions{}, true /*allowMissingRuntime*/)
+}
+
+// scaffoldRuntimePlaceholder stands in for the missing runtime of a scaffold project while it is validated.
+const scaffoldRuntimePlaceholder = "scaffold"
+
+// projectPermissionError wraps an error reading the project file at path that was caused by the file's permissions
+// in an actionable message, rather than the bare path error. The original error is preserved for errors.Is.
+func projectPermissionError(path string, err error) error {
+	return fmt.Errorf("cannot read project file at %s: permission denied; check file permissions: %w", path, err)
+}
+
+// LoadOptions controls how LoadProjectWithOptions reads a project file.
+type LoadOptions struct {
+	// ExpandEnv replaces `${NAME}` references to environment variables in the project's string values, such as
+	// `main` or `backend.url`, with the variables' values. `${NAME:-default}` uses default if NAME is unset or empty,
+	// and `$$` stands for a literal `$`. References to unset variables without a default are an error. The expansion
+	// happens before the project is validated, and only string values are expanded, not attribute names. The
+	// `template` section is left as is, since its defaults use the same syntax for references of their own.
+	ExpandEnv bool
+
+	// RuntimeSpecs enables checking the runtime options against the spec of the project's runtime, keyed by runtime
+	// name. Runtimes that aren't listed use their built-in spec, if they have one. When RuntimeSpecs is nil, the
+	// options aren't checked.
+	RuntimeSpecs map[string]RuntimeOptionSpec
+}
+
+// LoadProjectWithOptions reads a project definition from a file, using the given options. Note that saving a project
+// loaded with ExpandEnv writes out the expanded values.
+func LoadProjectWithOptions(path string, opts LoadOptions) (*Project, error) {
+	project, _, err := loadProject(osFS{}, path, opts, false /*allowMissingRuntime*/)
+	return project, err
+}
+
+// LoadProjectWithRuntimeSpecs reads a project definition from a file and checks its runtime options against specs, as
+// described by LoadOptions.RuntimeSpecs. If specs is nil, the options are checked against just the built-in specs.
+func LoadProjectWithRuntimeSpecs(path string, specs map[string]RuntimeOptionSpec) (*Project, error) {
+	if specs == nil {
+		specs = map[string]RuntimeOptionSpec{}
+	}
+	return LoadProjectWithOptions(path, LoadOptions{RuntimeSpecs: specs})
+}
+
+func loadProject(fs workspaceFS, path string, opts LoadOptions, allowMissingRuntime bool) (*Project, bool, error) {
 	contract.Requiref(path != "", "path", "must not be empty")
 
 	marshaller, err := marshallerForPath(path)
 	if err != nil {
-		return nil, fmt.Errorf("can not read '%s': %w", path, err)
+		return nil, false, fmt.Errorf("can not read '%s': %w", path, err)
 	}
 
-	b, err := readFileStripUTF8BOM(path)
-	if err != nil {
-		return nil, fmt.Errorf("could not read '%s': %w", path, err)
+	b, err := readFileStripUTF8BOMFrom(fs, path)
+	if errors.Is(err, os.ErrPermission) {
+		return nil, false, projectPermissionError(path, err)
+	} else if err != nil {
+		return nil, false, fmt.Errorf("could not read '%s': %w", path, err)
+	}
+
+	return loadProjectData(fs, path, marshaller, b, opts, allowMissingRuntime)
+}
+
+// loadProjectData decodes and validates the project definition b, read from the file at path in fs. An empty path
+// means b wasn't read from a file, in which case fs may be nil.
+func loadProjectData(
+	fs workspaceFS, path string, marshaller encoding.Marshaler, b []byte, opts LoadOptions, allowMissingRuntime bool,
+) (*Project, bool, error) {
+	source := "project"
+	if path != "" {
+		source = fmt.Sprintf("'%s'", path)
+	}
+
+	var inlineStacks []byte
+	if marshaller == encoding.YAML {
+		b, inlineStacks = splitInlineStackDocuments(b)
 	}
 
 	var raw interface{}
-	err = marshaller.Unmarshal(b, &raw)
+	err := unmarshalProjectDocument(marshaller, b, &raw)
+	if err != nil {
+		return nil, false, fmt.Errorf("could not unmarshal %s: %w", source, err)
+	}
+
+	raw, extends, err := resolveExtends(fs, path, raw, nil)
 	if err != nil {
-		return nil, fmt.Errorf("could not unmarshal '%s': %w", path, err)
+		return nil, false, fmt.Errorf("could not load %s: %w", source, err)
+	}
+
+	if opts.ExpandEnv {
+		if raw, err = expandEnvInValue("", raw); err != nil {
+			return nil, false, fmt.Errorf("could not load %s: %w", source, err)
+		}
+	}
+
+	needsRuntime := false
+	if allowMissingRuntime {
+		if projectDef, err := SimplifyMarshalledProject(raw); err == nil {
+			if runtime, has := projectDef["runtime"]; !has || runtime == nil || runtime == "" {
+				projectDef["runtime"] = scaffoldRuntimePlaceholder
+				raw, needsRuntime = projectDef, true
+			}
+		}
 	}
 
 	err = ValidateProject(raw)
 	if err != nil {
-		return nil, fmt.Errorf("could not validate '%s': %w", path, err)
+		if marshaller == encoding.JSON {
+			err = withJSONPositions(b, err)
+		}
+		return nil, false, fmt.Errorf("could not validate %s: %w", source, err)
 	}
 
 	// just before marshalling, we will rewrite the config values
 	projectDef, err := SimplifyMarshalledProject(raw)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
 	projectDef, rewriteError := RewriteConfigPathIntoStackConfigDir(projectDef)
 	if rewriteError != nil {
-		return nil, rewriteError
+		return nil, false, rewriteError
 	}
 
 	projectDef = RewriteShorthandConfigValues(projectDef)
@@ -126,16 +610,571 @@ func LoadProject(path string) (*Project, error) {
 	var project Project
 	err = marshaller.Unmarshal(modifiedProject, &project)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	err = project.Validate()
+	err = project.validate(needsRuntime)
 	if err != nil {
-		return nil, fmt.Errorf("could not unmarshal '%s': %w", path, err)
+		return nil, false, fmt.Errorf("could not unmarshal %s: %w", source, err)
+	}
+
+	if err = validateRuntimeOptionsDepth(project.Runtime.Options(), MaxRuntimeOptionsDepth); err != nil {
+		return nil, false, fmt.Errorf("could not validate %s: %w", source, err)
+	}
+	if opts.RuntimeSpecs != nil && !needsRuntime {
+		err = validateRuntimeOptions(project.Runtime.Name(), project.Runtime.Options(), opts.RuntimeSpecs)
+		if err != nil {
+			if marshaller == encoding.JSON {
+				err = withJSONPositions(b, err)
+			}
+			return nil, false, fmt.Errorf("could not validate %s: %w", source, err)
+		}
+	}
+
+	if needsRuntime {
+		project.Runtime = ProjectRuntimeInfo{}
 	}
 
+	if inlineStacks != nil {
+		if project.InlineStacks, err = parseInlineStackDocuments(&project, inlineStacks); err != nil {
+			return nil, false, fmt.Errorf("could not load %s: %w", source, err)
+		}
+		project.inlineStackDocuments = inlineStacks
+	}
+
+	if marshaller == encoding.YAML {
+		project.schemaHint = readSchemaHint(b)
+	}
 	project.raw = b
-	return &project, nil
+	if extends != nil {
+		project.extendsShadows = extends.shadows
+		if len(extends.inherited) > 0 {
+			project.extendsInherited = extends.inherited
+			if project.extendsLoaded, err = project.attributes(); err != nil {
+				return nil, false, fmt.Errorf("could not load %s: %w", source, err)
+			}
+		}
+	}
+	if path != "" {
+		if info, err := fs.Lstat(path); err == nil {
+			project.sourceIsSymlink = info.Mode()&os.ModeSymlink != 0
+		}
+	}
+	return &project, needsRuntime, nil
+}
+
+// expandEnvInValue expands the environment variable references in the strings within v, the value of the project
+// attribute at field, as described by LoadOptions.ExpandEnv. Maps and lists are expanded in place.
+func expandEnvInValue(field string, v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case string:
+		return expandEnvReferences(field, v)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			if field == "" && key == "template" {
+				// Template config defaults hold `${key}` and `${env:NAME}` references of their own, which are
+				// resolved when the template is used.
+				continue
+			}
+			child := key
+			if field != "" {
+				child = field + "." + key
+			}
+			expanded, err := expandEnvInValue(child, v[key])
+			if err != nil {
+				return nil, err
+			}
+			v[key] = expanded
+		}
+		return v, nil
+	case map[interface{}]interface{}:
+		simplified, err := SimplifyMarshalledValue(v)
+		if err != nil {
+			return nil, err
+		}
+		return expandEnvInValue(field, simplified)
+	case []interface{}:
+		for i, item := range v {
+			expanded, err := expandEnvInValue(fmt.Sprintf("%s[%d]", field, i), item)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = expanded
+		}
+		return v, nil
+	default:
+		return v, nil
+	}
+}
+
+// expandEnvReferences expands the `${NAME}` and `${NAME:-default}` references and `$$` escapes in s, the value of the
+// project attribute at field. A `$` that starts neither is kept as is.
+func expandEnvReferences(field, s string) (string, error) {
+	var sb strings.Builder
+	for {
+		i := strings.IndexByte(s, '$')
+		if i < 0 || i == len(s)-1 {
+			sb.WriteString(s)
+			return sb.String(), nil
+		}
+		sb.WriteString(s[:i])
+
+		switch s[i+1] {
+		case '$':
+			sb.WriteByte('$')
+			s = s[i+2:]
+		case '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("project attribute '%v' has an unterminated '${' reference", field)
+			}
+			reference := s[i+2 : i+2+end]
+			name, def, hasDefault := strings.Cut(reference, ":-")
+			if name == "" {
+				return "", fmt.Errorf("project attribute '%v' has a '${}' reference without a variable name", field)
+			}
+			value, ok := os.LookupEnv(name)
+			switch {
+			case ok && (value != "" || !hasDefault):
+				sb.WriteString(value)
+			case hasDefault:
+				sb.WriteString(def)
+			default:
+				return "", fmt.Errorf("project attribute '%v' references environment variable '%v', which is not set",
+					field, name)
+			}
+			s = s[i+2+end+1:]
+		default:
+			sb.WriteByte('$')
+			s = s[i+1:]
+		}
+	}
+}
+
+// MaxRuntimeOptionsDepth is the deepest that runtime options may be nested in a project file loaded by LoadProject.
+// The options map itself is at depth 1. Set it to zero or less to disable the check.
+var MaxRuntimeOptionsDepth = 32
+
+// validateRuntimeOptionsDepth returns an error if options nests maps or lists more than maxDepth levels deep.
+func validateRuntimeOptionsDepth(options map[string]interface{}, maxDepth int) error {
+	if maxDepth <= 0 || options == nil {
+		return nil
+	}
+	if runtimeOptionsExceedDepth(options, 1, maxDepth) {
+		return fmt.Errorf("runtime options are nested more than %d levels deep", maxDepth)
+	}
+	return nil
+}
+
+func runtimeOptionsExceedDepth(v interface{}, depth, maxDepth int) bool {
+	var children []interface{}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for _, child := range v {
+			children = append(children, child)
+		}
+	case map[interface{}]interface{}:
+		for _, child := range v {
+			children = append(children, child)
+		}
+	case []interface{}:
+		children = v
+	default:
+		return false
+	}
+
+	if depth > maxDepth {
+		return true
+	}
+	for _, child := range children {
+		if runtimeOptionsExceedDepth(child, depth+1, maxDepth) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveExtends merges the projects named by the `extends` attribute of raw, the decoded project file at path, into
+// raw. Parents are resolved recursively, relative to the file that names them. chain holds the files already being
+// resolved, and is used to detect cycles. It also describes how raw relates to its parents, or returns nil if raw
+// doesn't extend another project.
+func resolveExtends(
+	fs workspaceFS, path string, raw interface{}, chain []string,
+) (interface{}, *extendsInfo, error) {
+	child, err := SimplifyMarshalledProject(raw)
+	if err != nil {
+		// Leave it to validation to report that the project isn't a well-formed object.
+		return raw, nil, nil //nolint:nilerr
+	}
+	extends, has := child["extends"]
+	if !has || extends == nil {
+		return raw, nil, nil
+	}
+	parentPath, ok := extends.(string)
+	if !ok || parentPath == "" {
+		return nil, nil, errors.New("'extends' must be a non-empty path to a project file")
+	}
+	if path == "" {
+		return nil, nil, errors.New("'extends' is not supported for a project that isn't loaded from a file")
+	}
+
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	chain = append(chain, absPath)
+
+	if !filepath.IsAbs(parentPath) {
+		parentPath = filepath.Join(filepath.Dir(absPath), parentPath)
+	}
+	for _, p := range chain {
+		if p == parentPath {
+			return nil, nil, fmt.Errorf("'extends' cycle detected: %s -> %s", strings.Join(chain, " -> "), parentPath)
+		}
+	}
+
+	marshaller, err := marshallerForPath(parentPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can not read extended project '%s': %w", parentPath, err)
+	}
+	b, err := readFileStripUTF8BOMFrom(fs, parentPath)
+	if errors.Is(err, os.ErrPermission) {
+		return nil, nil, projectPermissionError(parentPath, err)
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("could not read extended project '%s': %w", parentPath, err)
+	}
+	var parentRaw interface{}
+	if err = unmarshalProjectDocument(marshaller, b, &parentRaw); err != nil {
+		return nil, nil, fmt.Errorf("could not unmarshal extended project '%s': %w", parentPath, err)
+	}
+	parent, err := SimplifyMarshalledProject(parentRaw)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not load extended project '%s': %w", parentPath, err)
+	}
+	resolved, _, err := resolveExtends(fs, parentPath, parent, chain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resolvedParent := resolved.(map[string]interface{})
+	return mergeExtendedProject(resolvedParent, child), &extendsInfo{
+		shadows:   findExtendsShadows(resolvedParent, child),
+		inherited: findInheritedAttributes(resolvedParent, child),
+	}, nil
+}
+
+// mergeExtendedProject overlays a child project on the project it extends, returning a new project. The merge works
+// on the top-level attributes of the project:
+//
+//   - attributes the child omits, or sets to null, are inherited from the parent;
+//   - object attributes (such as `config`, `backend` and `template`) are merged key-by-key, with the child's entry
+//     replacing the parent's entry for the same key;
+//   - `runtime` and all other attributes, including lists, are replaced wholesale by the child's value.
+func mergeExtendedProject(parent, child map[string]interface{}) map[string]interface{} {
+	merged := make(map[string]interface{}, len(parent)+len(child))
+	for k, v := range parent {
+		merged[k] = v
+	}
+
+	for k, childValue := range child {
+		if childValue == nil {
+			continue
+		}
+
+		childMap, childIsMap := childValue.(map[string]interface{})
+		parentMap, parentIsMap := merged[k].(map[string]interface{})
+		if k == "runtime" || !childIsMap || !parentIsMap {
+			merged[k] = childValue
+			continue
+		}
+
+		m := make(map[string]interface{}, len(parentMap)+len(childMap))
+		for pk, pv := range parentMap {
+			m[pk] = pv
+		}
+		for ck, cv := range childMap {
+			m[ck] = cv
+		}
+		merged[k] = m
+	}
+
+	return merged
+}
+
+// extendsInfo describes how a project relates to the projects it extends.
+type extendsInfo struct {
+	// shadows are the attributes of the project that replace inherited ones.
+	shadows []extendsShadow
+	// inherited are the attributes that the project inherits rather than sets itself.
+	inherited []inheritedAttribute
+}
+
+// extendsShadow records a project attribute that replaces a value inherited through `extends`.
+type extendsShadow struct {
+	// field is the shadowed attribute, e.g. "runtime", or "config.aws:region" for an entry of an object attribute.
+	field string
+	// unchanged is true if the local value is the same as the inherited one.
+	unchanged bool
+}
+
+// findExtendsShadows returns the attributes of child that replace an attribute of parent when the two are merged by
+// mergeExtendedProject, sorted by field. The project name and `extends` itself are expected to differ between a
+// project and its parent, and are not reported.
+func findExtendsShadows(parent, child map[string]interface{}) []extendsShadow {
+	var shadows []extendsShadow
+	for k, childValue := range child {
+		parentValue := parent[k]
+		if k == "name" || k == "extends" || childValue == nil || parentValue == nil {
+			continue
+		}
+
+		childMap, childIsMap := childValue.(map[string]interface{})
+		parentMap, parentIsMap := parentValue.(map[string]interface{})
+		if k == "runtime" || !childIsMap || !parentIsMap {
+			shadows = append(shadows, extendsShadow{field: k, unchanged: reflect.DeepEqual(parentValue, childValue)})
+			continue
+		}
+		for ck, cv := range childMap {
+			if pv, has := parentMap[ck]; has {
+				shadows = append(shadows, extendsShadow{field: k + "." + ck, unchanged: reflect.DeepEqual(pv, cv)})
+			}
+		}
+	}
+	sort.Slice(shadows, func(i, j int) bool { return shadows[i].field < shadows[j].field })
+	return shadows
+}
+
+// inheritedAttribute is a project attribute that is inherited through `extends`: either a whole top-level attribute,
+// such as `runtime`, or a single entry of an object attribute, such as the `aws:region` entry of `config`.
+type inheritedAttribute struct {
+	field string // the top-level attribute.
+	key   string // the entry of the object attribute, or empty if the whole attribute is inherited.
+}
+
+// findInheritedAttributes returns the attributes that child inherits from parent when the two are merged by
+// mergeExtendedProject, sorted by field and key.
+func findInheritedAttributes(parent, child map[string]interface{}) []inheritedAttribute {
+	var inherited []inheritedAttribute
+	for k, parentValue := range parent {
+		if k == "extends" || parentValue == nil {
+			continue
+		}
+		childValue := child[k]
+		if childValue == nil {
+			inherited = append(inherited, inheritedAttribute{field: k})
+			continue
+		}
+
+		childMap, childIsMap := childValue.(map[string]interface{})
+		parentMap, parentIsMap := parentValue.(map[string]interface{})
+		if k == "runtime" || !childIsMap || !parentIsMap {
+			continue
+		}
+		for pk := range parentMap {
+			if _, has := childMap[pk]; !has {
+				inherited = append(inherited, inheritedAttribute{field: k, key: pk})
+			}
+		}
+	}
+	sort.Slice(inherited, func(i, j int) bool {
+		if inherited[i].field != inherited[j].field {
+			return inherited[i].field < inherited[j].field
+		}
+		return inherited[i].key < inherited[j].key
+	})
+	return inherited
+}
+
+// attributes returns the project's attributes as they would be written to a YAML project file, for comparing the
+// project's values against those it was loaded with.
+func (proj *Project) attributes() (map[string]interface{}, error) {
+	b, err := yaml.Marshal(proj)
+	if err != nil {
+		return nil, err
+	}
+	var raw interface{}
+	if err = yaml.Unmarshal(b, &raw); err != nil {
+		return nil, err
+	}
+	return SimplifyMarshalledProject(raw)
+}
+
+// lookupAttribute returns the value of the attribute a within attrs, and whether it is set.
+func lookupAttribute(attrs map[string]interface{}, a inheritedAttribute) (interface{}, bool) {
+	v, has := attrs[a.field]
+	if !has || a.key == "" {
+		return v, has
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, false
+	}
+	v, has = m[a.key]
+	return v, has
+}
+
+// marshalOwnAttributes marshals a project that was loaded through `extends` with m, leaving out the attributes that
+// it inherited and that still have the values it was loaded with, so that saving the project doesn't copy its
+// parents' attributes into its own file. Attributes are written in the same order as by m.Marshal, and YAML files
+// keep their comments.
+func (proj *Project) marshalOwnAttributes(m encoding.Marshaler) ([]byte, error) {
+	current, err := proj.attributes()
+	if err != nil {
+		return nil, err
+	}
+
+	var full []byte
+	if m == encoding.JSON {
+		full, err = m.Marshal(proj)
+	} else {
+		full, err = yaml.Marshal(proj)
+	}
+	if err != nil {
+		return nil, err
+	}
+	// JSON is YAML, so either format can be edited as YAML nodes, which keep the attributes in order.
+	var doc yaml.Node
+	if err = yaml.Unmarshal(full, &doc); err != nil {
+		return nil, err
+	}
+	root := doc.Content[0]
+
+	for _, a := range proj.extendsInherited {
+		loaded, wasSet := lookupAttribute(proj.extendsLoaded, a)
+		value, isSet := lookupAttribute(current, a)
+		if !wasSet || !isSet || !reflect.DeepEqual(loaded, value) {
+			continue
+		}
+		if a.key == "" {
+			removeYAMLMappingKey(root, a.field)
+		} else if object := yamlMappingValue(root, a.field); object != nil {
+			removeYAMLMappingKey(object, a.key)
+		}
+	}
+
+	if m == encoding.JSON {
+		var buf bytes.Buffer
+		if err = writeYAMLNodeAsJSON(&buf, root); err != nil {
+			return nil, err
+		}
+		var indented bytes.Buffer
+		if err = json.Indent(&indented, buf.Bytes(), "", "    "); err != nil {
+			return nil, err
+		}
+		indented.WriteByte('\n')
+		return indented.Bytes(), nil
+	}
+	if len(proj.raw) > 0 {
+		return yamlutil.Edit(proj.raw, root)
+	}
+	return yamlutil.YamlEncode(root)
+}
+
+// yamlMappingValue returns the value of key in the YAML mapping node, or nil if it has none.
+func yamlMappingValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// removeYAMLMappingKey removes key and its value from the YAML mapping node.
+func removeYAMLMappingKey(mapping *yaml.Node, key string) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content = append(mapping.Content[:i], mapping.Content[i+2:]...)
+			return
+		}
+	}
+}
+
+// writeYAMLNodeAsJSON writes n, a YAML node decoded from a JSON document, back to buf as compact JSON.
+func writeYAMLNodeAsJSON(buf *bytes.Buffer, n *yaml.Node) error {
+	writeString := func(s string) error {
+		enc := json.NewEncoder(buf)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(s); err != nil {
+			return err
+		}
+		// Drop the newline that Encode adds.
+		buf.Truncate(buf.Len() - 1)
+		return nil
+	}
+
+	switch n.Kind {
+	case yaml.MappingNode:
+		buf.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeString(n.Content[i].Value); err != nil {
+				return err
+			}
+			buf.WriteByte(':')
+			if err := writeYAMLNodeAsJSON(buf, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case yaml.SequenceNode:
+		buf.WriteByte('[')
+		for i, item := range n.Content {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeYAMLNodeAsJSON(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case yaml.ScalarNode:
+		if n.ShortTag() == "!!str" {
+			return writeString(n.Value)
+		}
+		// Numbers, booleans and null are written as they were read.
+		buf.WriteString(n.Value)
+	default:
+		return fmt.Errorf("unexpected YAML node kind %v in a JSON document", n.Kind)
+	}
+	return nil
+}
+
+// ValidateUniqueNames loads the project files at paths, for example every project found by a scan of a monorepo,
+// and returns an error listing each project name that is used by more than one of them along with the files that
+// use it. Projects that share a name are easily confused by tooling, even though their workspace settings are kept
+// apart. Errors loading any of the projects are reported as well.
+func ValidateUniqueNames(paths []string) error {
+	var errs *multierror.Error
+	byName := make(map[tokens.PackageName][]string)
+	for _, path := range paths {
+		proj, err := LoadProject(path)
+		if err != nil {
+			errs = multierror.Append(errs, err)
+			continue
+		}
+		byName[proj.Name] = append(byName[proj.Name], path)
+	}
+
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if dups := byName[tokens.PackageName(name)]; len(dups) > 1 {
+			errs = multierror.Append(errs, fmt.Errorf(
+				"project name '%v' is used by multiple projects: %v", name, strings.Join(dups, ", ")))
+		}
+	}
+	return errs.ErrorOrNil()
 }
 
 // LoadProjectStack reads a stack definition from a file.
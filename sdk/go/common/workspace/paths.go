@@ -21,11 +21,13 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	user "github.com/tweekmonster/luser"
 
 	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/fsutil"
 )
 
@@ -58,7 +60,7 @@ const (
 	// IgnoreFile is the name of the file that we use to control what to upload to the service.
 	IgnoreFile = ".pulumiignore"
 
-	// ProjectFile is the base name of a project file.
+	// ProjectFile is the default base name of a project file; see SetProjectFileNames.
 	ProjectFile = "Pulumi"
 	// RepoFile is the name of the file that holds information specific to the entire repository.
 	RepoFile = "settings.json"
@@ -72,6 +74,10 @@ const (
 	// It defaults to the '<user's home>/.pulumi' if not specified.
 	PulumiHomeEnvVar = "PULUMI_HOME"
 
+	// PulumiProjectFileEnvVar is the path of a project file to use instead of searching for one. When it is set,
+	// project detection uses it regardless of the working directory.
+	PulumiProjectFileEnvVar = "PULUMI_PROJECT_FILE"
+
 	// PolicyPackFile is the base name of a Pulumi policy pack file.
 	PolicyPackFile = "PulumiPolicy"
 )
@@ -99,7 +105,7 @@ func DetectProjectStackPath(stackName tokens.QName) (*Project, string, error) {
 		return nil, "", err
 	}
 
-	fileName := fmt.Sprintf("%s.%s%s", ProjectFile, qnameFileName(stackName), filepath.Ext(projPath))
+	fileName := stackFileName(projPath, stackName)
 
 	if proj.StackConfigDir != "" {
 		return proj, filepath.Join(filepath.Dir(projPath), proj.StackConfigDir, fileName), nil
@@ -108,11 +114,64 @@ func DetectProjectStackPath(stackName tokens.QName) (*Project, string, error) {
 	return proj, filepath.Join(filepath.Dir(projPath), fileName), nil
 }
 
+// stackFileName returns the base name of the config file of the given stack for the project file at projectPath. It
+// is named after the project file, like Pulumi.<stack-name>.yaml for Pulumi.yaml.
+func stackFileName(projectPath string, stackName tokens.QName) string {
+	ext := filepath.Ext(projectPath)
+	base := strings.TrimSuffix(filepath.Base(projectPath), ext)
+	return fmt.Sprintf("%s.%s%s", base, qnameFileName(stackName), ext)
+}
+
 var ErrProjectNotFound = errors.New("no project file found")
 
+var (
+	projectFileNamesLock sync.RWMutex
+	projectFileNames     = []string{ProjectFile}
+)
+
+// ProjectFileNames returns the base names, without extension, of the files that are recognized as project files. It
+// defaults to just ProjectFile.
+func ProjectFileNames() []string {
+	projectFileNamesLock.RLock()
+	defer projectFileNamesLock.RUnlock()
+	return append([]string(nil), projectFileNames...)
+}
+
+// SetProjectFileNames sets the base names, without extension, of the files that are recognized as project files, for
+// programs that embed Pulumi under a different name. For example, after SetProjectFileNames("Acme", ProjectFile),
+// project detection and loading, including NewFrom, find Acme.yaml as well as Pulumi.yaml. Stack config files are
+// named after the project file, like Acme.dev.yaml. Calling it with no names restores the default.
+func SetProjectFileNames(names ...string) {
+	for _, name := range names {
+		contract.Requiref(name != "", "names", "must not contain empty names")
+	}
+
+	projectFileNamesLock.Lock()
+	defer projectFileNamesLock.Unlock()
+	if len(names) == 0 {
+		projectFileNames = []string{ProjectFile}
+	} else {
+		projectFileNames = append([]string(nil), names...)
+	}
+}
+
 // DetectProjectPathFrom locates the closest project from the given path, searching "upwards" in the directory
-// hierarchy.  If no project is found, an empty path is returned.
+// hierarchy for a Pulumi.yaml, Pulumi.yml or Pulumi.json file.  If no project is found, an empty path is returned. It
+// is an error for the closest directory with a project file to have several of them. If the PULUMI_PROJECT_FILE
+// environment variable is set, the project file it names is used instead of searching.
 func DetectProjectPathFrom(dir string) (string, error) {
+	if projectFile := os.Getenv(PulumiProjectFileEnvVar); projectFile != "" {
+		path, err := filepath.Abs(projectFile)
+		if err != nil {
+			return "", err
+		}
+		if !isProject(path) {
+			return "", fmt.Errorf("%s is set to '%s', which is not a Pulumi.yaml project file",
+				PulumiProjectFileEnvVar, projectFile)
+		}
+		return path, nil
+	}
+
 	path, err := fsutil.WalkUp(dir, isProject, func(s string) bool {
 		return true
 	})
@@ -135,7 +194,40 @@ func DetectProjectPathFrom(dir string) (string, error) {
 			"no Pulumi.yaml project file found (searching upwards from %s). If you have not "+
 				"created a project yet, use `pulumi new` to do so: %w", dir, ErrProjectNotFound)
 	}
-	return path, nil
+
+	// WalkUp stops at the first project file it sees in a directory, so check the directory for others.
+	return projectFileInDir(filepath.Dir(path))
+}
+
+// projectFileExts lists the extensions of project files, in the order in which DetectProjectPathFrom looks for them.
+var projectFileExts = []string{".yaml", ".yml", ".json"}
+
+// projectFileInDir returns the path of the project file in dir, looking for each of ProjectFileNames with each of
+// projectFileExts in turn. It is an error for dir to hold more than one project file, e.g. both Pulumi.yaml and
+// Pulumi.json, as it isn't clear which one is meant.
+func projectFileInDir(dir string) (string, error) {
+	var found []string
+	for _, name := range ProjectFileNames() {
+		for _, ext := range projectFileExts {
+			if path := filepath.Join(dir, name+ext); isProject(path) {
+				found = append(found, path)
+			}
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("no Pulumi.yaml project file found in %s: %w", dir, ErrProjectNotFound)
+	case 1:
+		return found[0], nil
+	default:
+		names := make([]string, len(found))
+		for i, path := range found {
+			names[i] = filepath.Base(path)
+		}
+		return "", fmt.Errorf("found more than one project file in %s (%s); remove all but one",
+			dir, strings.Join(names, ", "))
+	}
 }
 
 // DetectPolicyPackPathFrom locates the closest Pulumi policy project from the given path,
@@ -187,6 +279,17 @@ func SaveProject(proj *Project) error {
 	return proj.Save(path)
 }
 
+// SaveProjectTo validates the project and saves it to the project file at path, in the format implied by the file's
+// extension. Unlike Project.Save, an invalid project is reported as an error rather than a failed precondition. The
+// file is replaced atomically, so a save that is interrupted leaves the previous contents intact.
+func SaveProjectTo(proj *Project, path string) error {
+	contract.Requiref(proj != nil, "proj", "must not be nil")
+	if err := proj.Validate(); err != nil {
+		return fmt.Errorf("could not save project to '%s': %w", path, err)
+	}
+	return proj.Save(path)
+}
+
 func SaveProjectStack(stackName tokens.QName, stack *ProjectStack) error {
 	_, path, err := DetectProjectStackPath(stackName)
 	if err != nil {
@@ -199,7 +302,12 @@ func SaveProjectStack(stackName tokens.QName, stack *ProjectStack) error {
 // isProject returns true if the path references what appears to be a valid project.  If problems are detected -- like
 // an incorrect extension -- they are logged to the provided diag.Sink (if non-nil).
 func isProject(path string) bool {
-	return isMarkupFile(path, ProjectFile)
+	for _, name := range ProjectFileNames() {
+		if isMarkupFile(path, name) {
+			return true
+		}
+	}
+	return false
 }
 
 // isPolicyPack returns true if the path references what appears to be a valid policy pack project.
@@ -15,8 +15,10 @@
 package workspace
 
 import (
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
@@ -143,3 +145,94 @@ func TestDetectProjectUnreadableParent(t *testing.T) {
 	_, _, err = DetectProjectAndPath()
 	assert.ErrorIs(t, err, ErrProjectNotFound)
 }
+
+//nolint:paralleltest // mutates environment
+func TestDetectProjectPathFromEnvOverride(t *testing.T) {
+	tmpDir := mkTempDir(t)
+	projectDir := filepath.Join(tmpDir, "project")
+	require.NoError(t, os.Mkdir(projectDir, 0o700))
+	projectPath := filepath.Join(projectDir, "Pulumi.yaml")
+	require.NoError(t, os.WriteFile(projectPath, []byte("name: env_project\nruntime: nodejs\n"), 0o600))
+	otherDir := filepath.Join(tmpDir, "other")
+	require.NoError(t, os.Mkdir(otherDir, 0o700))
+
+	t.Setenv(PulumiProjectFileEnvVar, projectPath)
+	path, err := DetectProjectPathFrom(otherDir)
+	require.NoError(t, err)
+	assert.Equal(t, projectPath, path)
+
+	notAProject := filepath.Join(projectDir, "index.ts")
+	require.NoError(t, os.WriteFile(notAProject, []byte(""), 0o600))
+	for _, invalid := range []string{filepath.Join(tmpDir, "missing", "Pulumi.yaml"), notAProject, projectDir} {
+		t.Setenv(PulumiProjectFileEnvVar, invalid)
+		_, err = DetectProjectPathFrom(otherDir)
+		assert.EqualError(t, err,
+			fmt.Sprintf("PULUMI_PROJECT_FILE is set to '%s', which is not a Pulumi.yaml project file", invalid))
+	}
+}
+
+//nolint:paralleltest // mutates the recognized project file names
+func TestProjectFileNames(t *testing.T) {
+	SetProjectFileNames("Acme", ProjectFile)
+	t.Cleanup(func() { SetProjectFileNames() })
+	assert.Equal(t, []string{"Acme", ProjectFile}, ProjectFileNames())
+
+	projectDir := mkTempDir(t)
+	projectPath := filepath.Join(projectDir, "Acme.yaml")
+	require.NoError(t, os.WriteFile(projectPath, []byte("name: acme_project\nruntime: nodejs\n"), 0o600))
+	subDir := filepath.Join(projectDir, "src")
+	require.NoError(t, os.Mkdir(subDir, 0o700))
+
+	path, err := DetectProjectPathFrom(subDir)
+	require.NoError(t, err)
+	assert.Equal(t, projectPath, path)
+
+	w, err := NewFromWithSettingsPath(subDir, SettingsPathUnder(t.TempDir()))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(filepath.Base(w.WorkspaceSettingsFile()), "acme_project-"))
+
+	stackPath, err := stackConfigFilePath("dev", projectDir)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(projectDir, "Acme.dev.yaml"), stackPath)
+
+	SetProjectFileNames()
+	assert.Equal(t, []string{ProjectFile}, ProjectFileNames())
+	_, err = DetectProjectPathFrom(subDir)
+	assert.ErrorIs(t, err, ErrProjectNotFound)
+}
+
+//nolint:paralleltest // mutates environment
+func TestNewFromJSONProject(t *testing.T) {
+	t.Setenv(PulumiHomeEnvVar, t.TempDir())
+
+	dir, err := filepath.Abs(filepath.Join("testdata", "json-project"))
+	require.NoError(t, err)
+	path, err := DetectProjectPathFrom(dir)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "Pulumi.json"), path)
+
+	w, err := NewFrom(dir)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(filepath.Base(w.WorkspaceSettingsFile()), "json-project-"))
+}
+
+func TestDetectProjectPathFromAmbiguous(t *testing.T) {
+	t.Parallel()
+
+	project := "name: test\nruntime: nodejs\n"
+	dir := writeProjectFiles(t, map[string]string{
+		"Pulumi.yaml":       project,
+		"Pulumi.json":       `{"name": "test", "runtime": "nodejs"}`,
+		"src/index.ts":      "",
+		"nested/Pulumi.yml": project,
+	})
+
+	_, err := DetectProjectPathFrom(filepath.Join(dir, "src"))
+	assert.EqualError(t, err, fmt.Sprintf(
+		"found more than one project file in %s (Pulumi.yaml, Pulumi.json); remove all but one", dir))
+
+	// The closest project file wins, whatever the files further up.
+	path, err := DetectProjectPathFrom(filepath.Join(dir, "nested"))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "nested", "Pulumi.yml"), path)
+}
@@ -15,17 +15,24 @@
 package workspace
 
 import (
+	"bytes"
+	"context"
 	_ "embed"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"math"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
+	"github.com/blang/semver"
 	"github.com/hashicorp/go-multierror"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
@@ -57,6 +64,12 @@ func init() {
 	ProjectSchema = compiler.MustCompile("blob://project.json")
 }
 
+// ProjectSchemaJSON returns the JSON schema document that project files are validated against, compiled as
+// ProjectSchema, for editors and external validators. Each call returns a new copy.
+func ProjectSchemaJSON() []byte {
+	return []byte(projectSchema)
+}
+
 // Analyzers is a list of analyzers to run on this project.
 type Analyzers []tokens.QName
 
@@ -76,7 +89,8 @@ type ProjectTemplate struct {
 type ProjectTemplateConfigValue struct {
 	// Description is an optional description for the config value.
 	Description string `json:"description,omitempty" yaml:"description,omitempty"`
-	// Default is an optional default value for the config value.
+	// Default is an optional default value for the config value. A number or boolean default is held in its textual
+	// form, e.g. "3" or "true".
 	Default string `json:"default,omitempty" yaml:"default,omitempty"`
 	// Secret may be set to true to indicate that the config value should be encrypted.
 	Secret bool `json:"secret,omitempty" yaml:"secret,omitempty"`
@@ -94,7 +108,8 @@ type ProjectOptions struct {
 }
 
 type PluginOptions struct {
-	Name    string `json:"name" yaml:"name"`
+	Name string `json:"name" yaml:"name"`
+	// Version is an exact version, or a semver range such as ">=4.2.0 <5.0.0"; see Project.ResolvePluginVersion.
 	Version string `json:"version,omitempty" yaml:"version,omitempty"`
 	Path    string `json:"path" yaml:"path"`
 }
@@ -142,12 +157,21 @@ func (configType *ProjectConfigType) TypeName() string {
 //
 // TODO[pulumi/pulumi#423]: use DOM based marshalling so we can roundtrip the seralized structure perfectly.
 type Project struct {
+	// Schema is an optional URL of a JSON schema describing the project file, which editors use to offer completions.
+	// It is preserved when the project is saved, but otherwise ignored.
+	Schema string `json:"$schema,omitempty" yaml:"$schema,omitempty"`
 	// Name is a required fully qualified name.
 	Name tokens.PackageName `json:"name" yaml:"name"`
+	// DisplayName is an optional human-friendly title for the project, which unlike Name may contain spaces and
+	// punctuation. See Title.
+	DisplayName string `json:"displayName,omitempty" yaml:"displayName,omitempty"`
 	// Runtime is a required runtime that executes code.
 	Runtime ProjectRuntimeInfo `json:"runtime" yaml:"runtime"`
 	// Main is an optional override for the program's main entry-point location.
 	Main string `json:"main,omitempty" yaml:"main,omitempty"`
+	// Extends is an optional path, relative to this project file, of a project file whose attributes this project
+	// inherits. LoadProject merges the extended project into this one; see mergeExtendedProject for the rules.
+	Extends string `json:"extends,omitempty" yaml:"extends,omitempty"`
 
 	// Description is an optional informational description.
 	Description *string `json:"description,omitempty" yaml:"description,omitempty"`
@@ -176,17 +200,99 @@ type Project struct {
 
 	Plugins *Plugins `json:"plugins,omitempty" yaml:"plugins,omitempty"`
 
+	// Platforms is an optional list of the platforms, in the form "os/arch", that this project supports. When empty,
+	// all platforms are supported.
+	Platforms []string `json:"platforms,omitempty" yaml:"platforms,omitempty"`
+
+	// Include is an optional list of glob patterns selecting the source files that make up the program. When empty,
+	// all files are included. See MatchSource for the pattern syntax.
+	Include []string `json:"include,omitempty" yaml:"include,omitempty"`
+	// Exclude is an optional list of glob patterns selecting source files to leave out of the program, even if they
+	// are matched by Include.
+	Exclude []string `json:"exclude,omitempty" yaml:"exclude,omitempty"`
+
+	// RequiredEnv is an optional list of environment variables that must be set for the program to run. See CheckEnv.
+	RequiredEnv []string `json:"requiredEnv,omitempty" yaml:"requiredEnv,omitempty"`
+
+	// Engines optionally declares the versions of the tools the project is compatible with, mapping the name of the
+	// Pulumi CLI (`pulumi`), a language runtime (e.g. `nodejs`) or a plugin (e.g. `aws`) to a semver range such as
+	// ">=3.100.0 <4.0.0". Engines that aren't listed are unconstrained. See CheckEngines.
+	Engines map[string]string `json:"engines,omitempty" yaml:"engines,omitempty"`
+
+	// InlineStacks holds the config of the stacks declared by YAML documents that follow the project in its project
+	// file, keyed by stack name. Each such document names its stack with a `stack` attribute and holds its config in
+	// a `config` attribute. It is only set by LoadProject, and saving the project writes the documents back as they
+	// were read.
+	InlineStacks map[tokens.QName]config.Map `json:"-" yaml:"-"`
+
 	// Handle additional keys, albeit in a way that will remove comments and trivia.
 	AdditionalKeys map[string]interface{} `yaml:",inline"`
 
 	// The original byte representation of the file, used to attempt trivia-preserving edits
 	raw []byte
+
+	// Whether the file this project was loaded from is a symbolic link.
+	sourceIsSymlink bool
+
+	// The attributes of the project file that replace values inherited through `extends`, reported by Lint.
+	extendsShadows []extendsShadow
+
+	// The attributes inherited through `extends`, and the project's attributes as loaded. Saving the project leaves
+	// out the inherited attributes that still have their loaded values.
+	extendsInherited []inheritedAttribute
+	extendsLoaded    map[string]interface{}
+
+	// The inline stack documents that followed the project in its project file, written back when it is saved.
+	inlineStackDocuments []byte
+
+	// The schema URL of the yaml-language-server comment directive written at the top of the file when it is saved as
+	// YAML. See SetSchemaHint.
+	schemaHint string
+}
+
+// yamlSchemaDirective is the comment that tells the YAML language server, and the editors that use it, which schema
+// a YAML file follows. The schema's URL follows it on the same line.
+const yamlSchemaDirective = "# yaml-language-server: $schema="
+
+// withSchemaHint returns the YAML document b with any yaml-language-server directive removed from the comments at its
+// top, since saving a project edits the file it was loaded from, and a directive for url added, unless url is empty.
+func withSchemaHint(b []byte, url string) []byte {
+	lines := strings.SplitAfter(string(b), "\n")
+	var result strings.Builder
+	if url != "" {
+		result.WriteString(yamlSchemaDirective + url + "\n")
+	}
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			result.WriteString(strings.Join(lines[i:], ""))
+			break
+		}
+		if !strings.HasPrefix(trimmed, yamlSchemaDirective) {
+			result.WriteString(line)
+		}
+	}
+	return []byte(result.String())
+}
+
+// SetSchemaHint sets the schema URL of the `# yaml-language-server: $schema=<url>` comment directive that is written
+// at the top of the project file when it is saved as YAML, so that editors fetch completions for it. Projects loaded
+// from a YAML file that starts with such a directive keep it. An empty url removes the directive.
+func (proj *Project) SetSchemaHint(url string) {
+	proj.schemaHint = url
 }
 
 func (proj Project) RawValue() []byte {
 	return proj.raw
 }
 
+// SourceIsSymlink returns true if the project was loaded through a symbolic link, e.g. a Pulumi.yaml that links to a
+// shared project file. Saving such a project back to the same path writes through to the link's target unless
+// ProjectSaveOptions.ReplaceSymlink is set.
+func (proj *Project) SourceIsSymlink() bool {
+	return proj.sourceIsSymlink
+}
+
 func isPrimitiveValue(value interface{}) bool {
 	switch value.(type) {
 	case string, int, bool:
@@ -338,14 +444,55 @@ func ValidateProject(raw interface{}) error {
 		return errors.New("project is missing a 'name' attribute")
 	}
 	if strName, ok := name.(string); !ok || strName == "" {
-		return errors.New("project is missing a non-empty string 'name' attribute")
+		return &projectValueError{
+			location: "/name",
+			err:      errors.New("project is missing a non-empty string 'name' attribute"),
+		}
 	}
 	if _, ok := project["runtime"]; !ok {
 		return errors.New("project is missing a 'runtime' attribute")
 	}
+	if err := validateNoSecureConfigValues(project["config"]); err != nil {
+		return err
+	}
 
 	// Let everything else be caught by jsonschema
-	if err = ProjectSchema.Validate(project); err == nil {
+	return schemaValidationErrors(ProjectSchema.Validate(project))
+}
+
+// validateNoSecureConfigValues rejects encrypted values, written as `key: {secure: ...}`, in the project's `config`
+// block. The project file is shared by every stack, so it has no secrets provider to decrypt them with.
+func validateNoSecureConfigValues(configBlock interface{}) error {
+	values, ok := configBlock.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if value, ok := values[key].(map[string]interface{}); ok {
+			if _, secure := value["secure"]; secure {
+				return fmt.Errorf("project config '%v' has a secure value, but secrets can't be stored in the project "+
+					"file; set it for each stack with `pulumi config set --secret` instead", key)
+			}
+		}
+	}
+	return nil
+}
+
+// schemaValidationErrors flattens the error returned by validating a value against a JSON schema into one error per
+// violation, each prefixed with the location of the offending value.
+func schemaValidationErrors(err error) error {
+	return schemaValidationErrorsAt("", err)
+}
+
+// schemaValidationErrorsAt is like schemaValidationErrors for a value found at the given location, such as
+// "/runtime/options", within the project.
+func schemaValidationErrorsAt(location string, err error) error {
+	if err == nil {
 		return nil
 	}
 	validationError, ok := err.(*jsonschema.ValidationError)
@@ -356,13 +503,16 @@ func ValidateProject(raw interface{}) error {
 	var errs *multierror.Error
 	var appendError func(err *jsonschema.ValidationError)
 	appendError = func(err *jsonschema.ValidationError) {
-		if err.InstanceLocation != "" && err.Message != "" {
+		if instanceLocation := location + err.InstanceLocation; instanceLocation != "" && err.Message != "" {
 			errorf := func(path, message string, args ...interface{}) error {
 				contract.Requiref(path != "", "path", "path must not be empty")
 				return fmt.Errorf("%s: %s", path, fmt.Sprintf(message, args...))
 			}
 
-			errs = multierror.Append(errs, errorf("#"+err.InstanceLocation, "%v", err.Message))
+			errs = multierror.Append(errs, &projectValueError{
+				location: instanceLocation,
+				err:      errorf("#"+instanceLocation, "%v", err.Message),
+			})
 		}
 		for _, err := range err.Causes {
 			appendError(err)
@@ -373,6 +523,21 @@ func ValidateProject(raw interface{}) error {
 	return errs
 }
 
+// projectValueError is an error about the value found at a location within a project, given as a JSON pointer such
+// as "/runtime/options". Loading a JSON project file reports it along with the position of the value in the file.
+type projectValueError struct {
+	location string
+	err      error
+}
+
+func (e *projectValueError) Error() string {
+	return e.err.Error()
+}
+
+func (e *projectValueError) Unwrap() error {
+	return e.err
+}
+
 func InferFullTypeName(typeName string, itemsType *ProjectConfigItemsType) string {
 	if itemsType != nil {
 		return fmt.Sprintf("array<%v>", InferFullTypeName(itemsType.Type, itemsType.Items))
@@ -445,18 +610,80 @@ func configKeyIsNamespacedByProject(projectName string, configKey string) bool {
 }
 
 func (proj *Project) Validate() error {
+	return proj.validate(false /*scaffolding*/)
+}
+
+// validate is Validate. If scaffolding is true, the runtime may be scaffoldRuntimePlaceholder, which stands in for
+// the runtime that a project loaded by LoadProjectForScaffold hasn't chosen yet.
+func (proj *Project) validate(scaffolding bool) error {
 	if proj.Name == "" {
 		return errors.New("project is missing a 'name' attribute")
 	}
+	if err := validateProjectNameForPaths(proj.Name); err != nil {
+		return err
+	}
 	if proj.Runtime.Name() == "" {
 		return errors.New("project is missing a 'runtime' attribute")
 	}
+	if !scaffolding || proj.Runtime.Name() != scaffoldRuntimePlaceholder {
+		if err := validateRuntimeName(proj.Runtime.Name()); err != nil {
+			return err
+		}
+	}
+
+	if proj.DisplayName != "" && strings.TrimSpace(proj.DisplayName) == "" {
+		return errors.New("project 'displayName' must not be blank")
+	}
+	if err := validateToolchain(proj.Runtime.Options()); err != nil {
+		return err
+	}
+
+	if err := validatePlatforms(proj.Platforms); err != nil {
+		return err
+	}
+	if err := validateSourceGlobs("include", proj.Include); err != nil {
+		return err
+	}
+	if err := validateSourceGlobs("exclude", proj.Exclude); err != nil {
+		return err
+	}
+	for _, name := range proj.RequiredEnv {
+		if name == "" || strings.Contains(name, "=") {
+			return fmt.Errorf("invalid required environment variable name '%v'", name)
+		}
+	}
+	if err := validateEngines(proj.Engines); err != nil {
+		return err
+	}
+	if proj.Template != nil {
+		if err := validateSecretTemplateDefaults(proj.Template.Config); err != nil {
+			return err
+		}
+		if err := validateTemplateConfigReferences(proj.Template.Config); err != nil {
+			return err
+		}
+	}
+	if proj.Plugins != nil {
+		for _, plugins := range [][]PluginOptions{proj.Plugins.Providers, proj.Plugins.Languages, proj.Plugins.Analyzers} {
+			if err := validatePluginDuplicates(plugins); err != nil {
+				return err
+			}
+		}
+	}
 
 	projectName := proj.Name.String()
 	for configKey, configType := range proj.Config {
 		if configType.Default != nil && configType.Value != nil {
 			return fmt.Errorf("project config '%v' cannot have both a 'default' and 'value' attribute", configKey)
 		}
+		if configType.Secret && (configType.Default != nil || configType.Value != nil) {
+			attr := "value"
+			if configType.Default != nil {
+				attr = "default"
+			}
+			return fmt.Errorf("project config '%v' is secret, so it must not have a plaintext '%v' in the project "+
+				"file; set it for each stack with `pulumi config set --secret` instead", configKey, attr)
+		}
 
 		configTypeName := configType.TypeName()
 
@@ -502,175 +729,1471 @@ func (proj *Project) Validate() error {
 	return nil
 }
 
-// TrustResourceDependencies returns whether this project's runtime can be trusted to accurately report
-// dependencies. All languages supported by Pulumi today do this correctly. This option remains useful when bringing
-// up new Pulumi languages.
-func (proj *Project) TrustResourceDependencies() bool {
-	return true
+// parsePlatform splits a platform of the form "os/arch" into its parts.
+func parsePlatform(platform string) (string, string, error) {
+	goos, goarch, ok := strings.Cut(platform, "/")
+	if !ok || goos == "" || goarch == "" || strings.Contains(goarch, "/") || strings.ContainsAny(platform, " \t") {
+		return "", "", fmt.Errorf("invalid platform '%v': expected the form 'os/arch', e.g. 'linux/amd64'", platform)
+	}
+	return goos, goarch, nil
 }
 
-// Save writes a project definition to a file.
-func (proj *Project) Save(path string) error {
-	contract.Requiref(path != "", "path", "must not be empty")
-	contract.Requiref(proj != nil, "proj", "must not be nil")
-	contract.Requiref(proj.Validate() == nil, "proj", "Validate()")
-	return save(path, proj, false /*mkDirAll*/)
+// validateProjectNameForPaths checks that name is a valid project name, as described by tokens.ValidateProjectName, and
+// doesn't start with a dot. Project names become part of file names, such as those of workspace settings files, so
+// this keeps a name from making a path that escapes its directory or names a hidden file.
+func validateProjectNameForPaths(name tokens.PackageName) error {
+	if err := tokens.ValidateProjectName(string(name)); err != nil {
+		return fmt.Errorf("invalid project name '%v': %w", name, err)
+	}
+	if strings.HasPrefix(string(name), ".") {
+		return fmt.Errorf("invalid project name '%v': project names may not start with a period", name)
+	}
+	return nil
 }
 
-type PolicyPackProject struct {
-	// Runtime is a required runtime that executes code.
-	Runtime ProjectRuntimeInfo `json:"runtime" yaml:"runtime"`
-	// Version specifies the version of the policy pack. If set, it will override the
-	// version specified in `package.json` for Node.js policy packs.
-	Version string `json:"version,omitempty" yaml:"version,omitempty"`
-
-	// Main is an optional override for the program's main entry-point location.
-	Main string `json:"main,omitempty" yaml:"main,omitempty"`
-
-	// Description is an optional informational description.
-	Description *string `json:"description,omitempty" yaml:"description,omitempty"`
-	// Author is an optional author that created this project.
-	Author *string `json:"author,omitempty" yaml:"author,omitempty"`
-	// Website is an optional website for additional info about this project.
-	Website *string `json:"website,omitempty" yaml:"website,omitempty"`
-	// License is the optional license governing this project's usage.
-	License *string `json:"license,omitempty" yaml:"license,omitempty"`
-
-	// The original byte representation of the file, used to attempt trivia-preserving edits
-	raw []byte
+// validatePlatforms checks that each platform is of the form "os/arch" and that no platform is listed more than once.
+// Platforms are compared case-insensitively, as SupportsPlatform matches them, so "Linux/AMD64" duplicates
+// "linux/amd64".
+func validatePlatforms(platforms []string) error {
+	seen := make(map[string]string, len(platforms))
+	for _, platform := range platforms {
+		if _, _, err := parsePlatform(platform); err != nil {
+			return err
+		}
+		normalized := strings.ToLower(platform)
+		if previous, has := seen[normalized]; has {
+			if previous == platform {
+				return fmt.Errorf("platform '%v' is listed more than once", platform)
+			}
+			return fmt.Errorf("platforms '%v' and '%v' are the same platform; platforms are not case-sensitive",
+				previous, platform)
+		}
+		seen[normalized] = platform
+	}
+	return nil
 }
 
-func (proj PolicyPackProject) RawValue() []byte {
-	return proj.raw
+// templateConfigReferencePattern matches a reference to another template config value, e.g. `${aws:region}`, in the
+// default of a template config value.
+var templateConfigReferencePattern = regexp.MustCompile(`\$\{([^}]+)\}`)
+
+// SecretTemplateDefaultPatterns are the patterns that the default of a secret template config value must match in
+// full, so that the default references a secret source rather than holding the secret itself. By default a secret
+// default may only reference an environment variable, as in `${env:MY_SECRET}`.
+var SecretTemplateDefaultPatterns = []*regexp.Regexp{
+	regexp.MustCompile(`^\$\{env:[A-Za-z_][A-Za-z0-9_]*\}$`),
 }
 
-func (proj *PolicyPackProject) Validate() error {
-	if proj.Runtime.Name() == "" {
-		return errors.New("project is missing a 'runtime' attribute")
+// UnmarshalJSON decodes a template config value. Like YAML, it accepts a number or boolean default, holding it in its
+// textual form.
+func (v *ProjectTemplateConfigValue) UnmarshalJSON(data []byte) error {
+	type plainValue ProjectTemplateConfigValue
+	var payload struct {
+		plainValue
+		Default json.RawMessage `json:"default,omitempty"`
+	}
+	if err := json.Unmarshal(data, &payload); err != nil {
+		return err
 	}
+	*v = ProjectTemplateConfigValue(payload.plainValue)
 
+	def := bytes.TrimSpace(payload.Default)
+	if len(def) == 0 || string(def) == "null" {
+		return nil
+	}
+	if err := json.Unmarshal(def, &v.Default); err == nil {
+		return nil
+	}
+	if def[0] == '{' || def[0] == '[' {
+		return fmt.Errorf("template config default %s must be a string, number or boolean", def)
+	}
+	v.Default = string(def)
 	return nil
 }
 
-// Save writes a project definition to a file.
-func (proj *PolicyPackProject) Save(path string) error {
-	contract.Requiref(path != "", "path", "must not be empty")
-	contract.Requiref(proj != nil, "proj", "must not be nil")
-	contract.Requiref(proj.Validate() == nil, "proj", "Validate()")
-	return save(path, proj, false /*mkDirAll*/)
+// IsSecretSourceReference returns true if the value is secret and its default references a secret source, i.e.
+// matches one of SecretTemplateDefaultPatterns.
+func (v ProjectTemplateConfigValue) IsSecretSourceReference() bool {
+	if !v.Secret {
+		return false
+	}
+	for _, pattern := range SecretTemplateDefaultPatterns {
+		if pattern.MatchString(v.Default) {
+			return true
+		}
+	}
+	return false
 }
 
-type PluginProject struct {
-	// Runtime is a required runtime that executes code.
-	Runtime ProjectRuntimeInfo `json:"runtime" yaml:"runtime"`
+// TemplateConfigReferences returns the keys of the other template config values referenced by the default, in the
+// order in which they appear. A secret source reference, see IsSecretSourceReference, doesn't reference other values.
+func (v ProjectTemplateConfigValue) TemplateConfigReferences() []string {
+	if v.IsSecretSourceReference() {
+		return nil
+	}
+	var refs []string
+	for _, match := range templateConfigReferencePattern.FindAllStringSubmatch(v.Default, -1) {
+		refs = append(refs, match[1])
+	}
+	return refs
 }
 
-func (proj *PluginProject) Validate() error {
-	if proj.Runtime.Name() == "" {
-		return errors.New("project is missing a 'runtime' attribute")
+// validateSecretTemplateDefaults checks that the default of every secret template config value, if it has one,
+// references a secret source rather than holding a literal secret.
+func validateSecretTemplateDefaults(cfg map[string]ProjectTemplateConfigValue) error {
+	keys := make([]string, 0, len(cfg))
+	for key := range cfg {
+		keys = append(keys, key)
 	}
+	sort.Strings(keys)
 
+	for _, key := range keys {
+		v := cfg[key]
+		if v.Secret && v.Default != "" && !v.IsSecretSourceReference() {
+			return fmt.Errorf("template config '%v' is secret, so its default must reference a secret source, "+
+				"such as `${env:NAME}`, rather than hold a literal value", key)
+		}
+	}
 	return nil
 }
 
-// ProjectStack holds stack specific information about a project.
-type ProjectStack struct {
-	// SecretsProvider is this stack's secrets provider.
-	SecretsProvider string `json:"secretsprovider,omitempty" yaml:"secretsprovider,omitempty"`
-	// EncryptedKey is the KMS-encrypted ciphertext for the data key used for secrets encryption.
-	// Only used for cloud-based secrets providers.
-	EncryptedKey string `json:"encryptedkey,omitempty" yaml:"encryptedkey,omitempty"`
-	// EncryptionSalt is this stack's base64 encoded encryption salt.  Only used for
-	// passphrase-based secrets providers.
-	EncryptionSalt string `json:"encryptionsalt,omitempty" yaml:"encryptionsalt,omitempty"`
-	// Config is an optional config bag.
-	Config config.Map `json:"config,omitempty" yaml:"config,omitempty"`
-
-	// The original byte representation of the file, used to attempt trivia-preserving edits
-	raw []byte
-}
-
-func (ps ProjectStack) RawValue() []byte {
-	return ps.raw
-}
+// validateTemplateConfigReferences checks that every `${key}` reference in the defaults of the template config names
+// another value of the template config, and that the references don't form a cycle.
+func validateTemplateConfigReferences(cfg map[string]ProjectTemplateConfigValue) error {
+	keys := make([]string, 0, len(cfg))
+	for key := range cfg {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
 
-// Save writes a project definition to a file.
-func (ps *ProjectStack) Save(path string) error {
-	contract.Requiref(path != "", "path", "must not be empty")
-	contract.Requiref(ps != nil, "ps", "must not be nil")
-	return save(path, ps, true /*mkDirAll*/)
-}
+	for _, key := range keys {
+		for _, ref := range cfg[key].TemplateConfigReferences() {
+			if _, has := cfg[ref]; !has {
+				return fmt.Errorf("template config '%v' default references unknown config '%v'", key, ref)
+			}
+		}
+	}
 
-type ProjectRuntimeInfo struct {
-	name    string
-	options map[string]interface{}
-}
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int, len(cfg))
+	var visit func(key string, path []string) error
+	visit = func(key string, path []string) error {
+		switch state[key] {
+		case visited:
+			return nil
+		case visiting:
+			for i, k := range path {
+				if k == key {
+					path = path[i:]
+					break
+				}
+			}
+			return fmt.Errorf("template config defaults form a cycle: %v", strings.Join(append(path, key), " -> "))
+		}
 
-func NewProjectRuntimeInfo(name string, options map[string]interface{}) ProjectRuntimeInfo {
-	return ProjectRuntimeInfo{
-		name:    name,
-		options: options,
+		state[key] = visiting
+		for _, ref := range cfg[key].TemplateConfigReferences() {
+			if err := visit(ref, append(path, key)); err != nil {
+				return err
+			}
+		}
+		state[key] = visited
+		return nil
 	}
+	for _, key := range keys {
+		if err := visit(key, nil); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-func (info *ProjectRuntimeInfo) Name() string {
-	return info.name
+// ExpandRuntime converts a runtime given in the bare string form, e.g. `runtime: nodejs`, to the equivalent object
+// form with an empty options map, so that callers can add options to it. The runtime is saved in the object form from
+// then on, e.g. `runtime: {name: nodejs}`, even if no options are added. It is a no-op if the runtime is already in
+// the object form.
+func (proj *Project) ExpandRuntime() {
+	if proj.Runtime.options == nil {
+		proj.Runtime.options = make(map[string]interface{})
+	}
+	proj.Runtime.objectForm = true
 }
 
-func (info *ProjectRuntimeInfo) Options() map[string]interface{} {
-	return info.options
-}
+// WithDefaults returns a copy of the project with the defaults for its runtime's options, as declared by
+// RuntimeJSONSchema, filled in wherever the options don't set them. The filled in options are marked as defaulted and
+// aren't written out when the project is saved, so that saving the result keeps the project file minimal. Setting a
+// defaulted option with ProjectRuntimeInfo.SetOption makes it explicit.
+func (proj *Project) WithDefaults() *Project {
+	result := *proj
 
-func (info *ProjectRuntimeInfo) SetOption(key string, value interface{}) {
-	if info.options == nil {
-		info.options = make(map[string]interface{})
+	options := make(map[string]interface{}, len(proj.Runtime.options))
+	for k, v := range proj.Runtime.options {
+		options[k] = v
 	}
-	info.options[key] = value
-}
-
-func (info ProjectRuntimeInfo) MarshalYAML() (interface{}, error) {
-	if info.options == nil || len(info.options) == 0 {
-		return info.name, nil
+	defaulted := make(map[string]bool, len(proj.Runtime.defaulted))
+	for k, v := range proj.Runtime.defaulted {
+		defaulted[k] = v
+	}
+	for k, v := range runtimeOptionDefaults(proj.Runtime.name) {
+		if _, has := options[k]; !has {
+			options[k] = v
+			defaulted[k] = true
+		}
 	}
 
-	return map[string]interface{}{
-		"name":    info.name,
-		"options": info.options,
-	}, nil
+	result.Runtime = ProjectRuntimeInfo{
+		name:       proj.Runtime.name,
+		options:    options,
+		defaulted:  defaulted,
+		objectForm: proj.Runtime.objectForm,
+	}
+	return &result
 }
 
-func (info ProjectRuntimeInfo) MarshalJSON() ([]byte, error) {
-	if info.options == nil || len(info.options) == 0 {
-		return json.Marshal(info.name)
+// Clone returns a deep copy of the project, which can be changed without affecting the original. This includes the
+// maps handed out by ProjectRuntimeInfo.Options, which are otherwise shared.
+func (proj *Project) Clone() *Project {
+	result := *proj
+
+	result.Runtime = ProjectRuntimeInfo{name: proj.Runtime.name, objectForm: proj.Runtime.objectForm}
+	if proj.Runtime.options != nil {
+		result.Runtime.options = deepCopyValue(proj.Runtime.options).(map[string]interface{})
+	}
+	if proj.Runtime.defaulted != nil {
+		result.Runtime.defaulted = make(map[string]bool, len(proj.Runtime.defaulted))
+		for k, v := range proj.Runtime.defaulted {
+			result.Runtime.defaulted[k] = v
+		}
 	}
 
-	return json.Marshal(map[string]interface{}{
-		"name":    info.name,
-		"options": info.options,
-	})
-}
+	result.Description = cloneStringPtr(proj.Description)
+	result.Author = cloneStringPtr(proj.Author)
+	result.Website = cloneStringPtr(proj.Website)
+	result.License = cloneStringPtr(proj.License)
+
+	if proj.Config != nil {
+		result.Config = make(map[string]ProjectConfigType, len(proj.Config))
+		for k, v := range proj.Config {
+			v.Type = cloneStringPtr(v.Type)
+			v.Items = v.Items.clone()
+			v.Default = deepCopyValue(v.Default)
+			v.Value = deepCopyValue(v.Value)
+			result.Config[k] = v
+		}
+	}
+	if proj.Template != nil {
+		template := *proj.Template
+		if template.Config != nil {
+			template.Config = make(map[string]ProjectTemplateConfigValue, len(proj.Template.Config))
+			for k, v := range proj.Template.Config {
+				template.Config[k] = v
+			}
+		}
+		result.Template = &template
+	}
+	if proj.Backend != nil {
+		backend := *proj.Backend
+		result.Backend = &backend
+	}
+	if proj.Options != nil {
+		options := *proj.Options
+		result.Options = &options
+	}
+	if proj.Plugins != nil {
+		result.Plugins = &Plugins{
+			Providers: append([]PluginOptions(nil), proj.Plugins.Providers...),
+			Languages: append([]PluginOptions(nil), proj.Plugins.Languages...),
+			Analyzers: append([]PluginOptions(nil), proj.Plugins.Analyzers...),
+		}
+	}
 
-func (info *ProjectRuntimeInfo) UnmarshalJSON(data []byte) error {
-	if err := json.Unmarshal(data, &info.name); err == nil {
-		return nil
+	result.Platforms = append([]string(nil), proj.Platforms...)
+	result.Include = append([]string(nil), proj.Include...)
+	result.Exclude = append([]string(nil), proj.Exclude...)
+	result.RequiredEnv = append([]string(nil), proj.RequiredEnv...)
+	if proj.Engines != nil {
+		result.Engines = make(map[string]string, len(proj.Engines))
+		for k, v := range proj.Engines {
+			result.Engines[k] = v
+		}
+	}
+	if proj.AdditionalKeys != nil {
+		result.AdditionalKeys = deepCopyValue(proj.AdditionalKeys).(map[string]interface{})
 	}
 
-	var payload struct {
-		Name    string                 `json:"name"`
-		Options map[string]interface{} `json:"options"`
+	result.raw = append([]byte(nil), proj.raw...)
+	result.inlineStackDocuments = append([]byte(nil), proj.inlineStackDocuments...)
+	if proj.InlineStacks != nil {
+		result.InlineStacks = make(map[tokens.QName]config.Map, len(proj.InlineStacks))
+		for stack, cfg := range proj.InlineStacks {
+			copied := make(config.Map, len(cfg))
+			for k, v := range cfg {
+				copied[k] = v
+			}
+			result.InlineStacks[stack] = copied
+		}
 	}
+	result.extendsShadows = append([]extendsShadow(nil), proj.extendsShadows...)
+	result.extendsInherited = append([]inheritedAttribute(nil), proj.extendsInherited...)
+	result.extendsLoaded = proj.extendsLoaded
+	return &result
+}
 
-	if err := json.Unmarshal(data, &payload); err == nil {
-		info.name = payload.Name
-		info.options = payload.Options
+// clone returns a deep copy of the items type.
+func (items *ProjectConfigItemsType) clone() *ProjectConfigItemsType {
+	if items == nil {
 		return nil
 	}
-
-	return errors.New("runtime section must be a string or an object with name and options attributes")
+	return &ProjectConfigItemsType{Type: items.Type, Items: items.Items.clone()}
 }
 
-func (info *ProjectRuntimeInfo) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	if err := unmarshal(&info.name); err == nil {
+func cloneStringPtr(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	v := *s
+	return &v
+}
+
+// deepCopyValue returns a copy of a value decoded from YAML or JSON, copying its maps and slices.
+func deepCopyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			result[k] = deepCopyValue(item)
+		}
+		return result
+	case map[interface{}]interface{}:
+		result := make(map[interface{}]interface{}, len(v))
+		for k, item := range v {
+			result[k] = deepCopyValue(item)
+		}
+		return result
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, item := range v {
+			result[i] = deepCopyValue(item)
+		}
+		return result
+	case []string:
+		return append([]string(nil), v...)
+	default:
+		return v
+	}
+}
+
+// SupportsPlatform returns true if the project can run on the given operating system and architecture, using the
+// same names as runtime.GOOS and runtime.GOARCH. A project that doesn't list any platforms supports all of them.
+func (proj *Project) SupportsPlatform(goos, goarch string) bool {
+	if len(proj.Platforms) == 0 {
+		return true
+	}
+	for _, platform := range proj.Platforms {
+		platformOS, platformArch, err := parsePlatform(platform)
+		if err == nil && strings.EqualFold(platformOS, goos) && strings.EqualFold(platformArch, goarch) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckEnv checks that every environment variable listed in RequiredEnv is set, looking variables up with env, which
+// has the signature of os.LookupEnv. The returned error lists all of the missing variables, so that tools can fail
+// fast before running the program.
+func (proj *Project) CheckEnv(env func(string) (string, bool)) error {
+	var missing []string
+	for _, name := range proj.RequiredEnv {
+		if _, ok := env(name); !ok {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("project '%v' requires environment variables that are not set: %v",
+			proj.Name, strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// CheckEngines checks the versions of the tools in use, keyed by engine name, against the ranges declared by Engines,
+// and returns an error for each engine whose version is out of range, in engine name order. Engines without a
+// version in versions aren't checked.
+func (proj *Project) CheckEngines(versions map[string]string) []error {
+	var errs []error
+	for _, name := range sortedEngineNames(proj.Engines) {
+		version, has := versions[name]
+		if !has {
+			continue
+		}
+		r, err := semver.ParseRange(proj.Engines[name])
+		if err != nil {
+			errs = append(errs, fmt.Errorf("engine '%v' has an invalid version range '%v': %w", name, proj.Engines[name], err))
+			continue
+		}
+		v, err := semver.ParseTolerant(version)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("version '%v' of engine '%v' is invalid: %w", version, name, err))
+			continue
+		}
+		if !r(v) {
+			errs = append(errs, fmt.Errorf("project '%v' requires %v '%v', but version %v is in use",
+				proj.Name, name, proj.Engines[name], version))
+		}
+	}
+	return errs
+}
+
+// validateEngines checks that each of the project's engines has a valid semver range.
+func validateEngines(engines map[string]string) error {
+	for _, name := range sortedEngineNames(engines) {
+		if _, err := semver.ParseRange(engines[name]); err != nil {
+			return fmt.Errorf("engine '%v' has an invalid version range '%v': %w", name, engines[name], err)
+		}
+	}
+	return nil
+}
+
+func sortedEngineNames(engines map[string]string) []string {
+	names := make([]string, 0, len(engines))
+	for name := range engines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateForRegistry validates the project against the stricter requirements for publishing it to the template
+// registry: in addition to the checks made by Validate, the project must have a non-empty description and author.
+// Every unmet requirement is reported in the returned error.
+func (proj *Project) ValidateForRegistry() error {
+	var errs *multierror.Error
+	if err := proj.Validate(); err != nil {
+		errs = multierror.Append(errs, err)
+	}
+	if proj.Description == nil || strings.TrimSpace(*proj.Description) == "" {
+		errs = multierror.Append(errs, errors.New("project is missing a 'description', which the registry requires"))
+	}
+	if proj.Author == nil || strings.TrimSpace(*proj.Author) == "" {
+		errs = multierror.Append(errs, errors.New("project is missing an 'author', which the registry requires"))
+	}
+	return errs.ErrorOrNil()
+}
+
+func validateSourceGlobs(field string, patterns []string) error {
+	for _, pattern := range patterns {
+		if pattern == "" {
+			return fmt.Errorf("project '%v' patterns must not be empty", field)
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("project '%v' pattern '%v' is invalid: %w", field, pattern, err)
+		}
+	}
+	return nil
+}
+
+// MatchSource returns true if the file at relPath, relative to the project directory, is part of the program's
+// source according to the project's Include and Exclude patterns. A file is part of the source if it matches an
+// Include pattern (or there are none) and doesn't match any Exclude pattern; excludes always win.
+//
+// Patterns use the syntax of path.Match and are matched against the slash-separated relative path. A pattern also
+// matches everything below a directory it matches, and a pattern without a `/` is matched against each path
+// component, so `*.test.ts` matches `src/app.test.ts` and `testdata` matches `pkg/testdata/input.json`.
+func (proj *Project) MatchSource(relPath string) bool {
+	relPath = path.Clean(filepath.ToSlash(relPath))
+
+	for _, pattern := range proj.Exclude {
+		if matchSourceGlob(pattern, relPath) {
+			return false
+		}
+	}
+	if len(proj.Include) == 0 {
+		return true
+	}
+	for _, pattern := range proj.Include {
+		if matchSourceGlob(pattern, relPath) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchSourceGlob(pattern, relPath string) bool {
+	segments := strings.Split(relPath, "/")
+	matchComponents := !strings.Contains(pattern, "/")
+	for i, segment := range segments {
+		if ok, _ := path.Match(pattern, strings.Join(segments[:i+1], "/")); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, segment); ok && matchComponents {
+			return true
+		}
+	}
+	return false
+}
+
+// Title returns the name to display for the project: its DisplayName if it has one, and otherwise its Name.
+func (proj *Project) Title() string {
+	if proj.DisplayName != "" {
+		return proj.DisplayName
+	}
+	return proj.Name.String()
+}
+
+// WorkingDir returns the directory the program should be run from, given the path of the project file: the project
+// file's directory, joined with `main` when `main` is a directory or with the directory containing `main` when it is a
+// file. Whether `main` is a directory is decided by the filesystem, falling back to its spelling when it doesn't
+// exist. Unlike ResolvedMain, no expansion of `~` or environment variables is done.
+func (proj *Project) WorkingDir(projectFilePath string) string {
+	dir := filepath.Dir(projectFilePath)
+	if proj.Main == "" {
+		return dir
+	}
+
+	main := normalizePathSeparators(proj.Main)
+	if !filepath.IsAbs(main) {
+		main = filepath.Join(dir, main)
+	}
+	if mainRefersToDirectory(main, proj.Main) {
+		return filepath.Clean(main)
+	}
+	return filepath.Dir(main)
+}
+
+// mainRefersToDirectory returns true if main, which resolves to path, refers to a directory. This is decided by the
+// filesystem, falling back to the spelling of main when path doesn't exist.
+func mainRefersToDirectory(path, main string) bool {
+	if info, err := os.Stat(path); err == nil {
+		return info.IsDir()
+	}
+	return mainIsDirectory(main)
+}
+
+// ReferencedPathsOptions controls the behavior of Project.ReferencedPathsWithOptions.
+type ReferencedPathsOptions struct {
+	// IncludeMissing returns referenced paths that don't exist instead of failing, and ignores Include patterns that
+	// match nothing.
+	IncludeMissing bool
+}
+
+// ReferencedPaths returns every filesystem path the project references, relative to rootDir, the directory containing
+// the project file: its `main`, the paths of its plugins, the project files in its `extends` chain, and the files and
+// directories its Include patterns match. The result is sorted and free of duplicates. It is an error for a referenced
+// path not to exist, or for an Include pattern to match nothing.
+func (proj *Project) ReferencedPaths(rootDir string) ([]string, error) {
+	return proj.ReferencedPathsWithOptions(rootDir, ReferencedPathsOptions{})
+}
+
+// ReferencedPathsWithOptions is ReferencedPaths with options.
+func (proj *Project) ReferencedPathsWithOptions(rootDir string, opts ReferencedPathsOptions) ([]string, error) {
+	rootDir, err := filepath.Abs(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []string
+	if proj.Main != "" {
+		main, err := proj.ResolvedMain(rootDir)
+		if err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, main)
+	}
+	if proj.Plugins != nil {
+		for _, plugins := range [][]PluginOptions{proj.Plugins.Providers, proj.Plugins.Languages, proj.Plugins.Analyzers} {
+			for _, plugin := range plugins {
+				if plugin.Path != "" {
+					candidates = append(candidates, resolveReferencedPath(rootDir, plugin.Path))
+				}
+			}
+		}
+	}
+
+	// Each project file in the chain names its parent relative to itself.
+	extends, dir := proj.Extends, rootDir
+	for extends != "" {
+		parent := resolveReferencedPath(dir, extends)
+		candidates = append(candidates, parent)
+		extends, dir = readExtends(parent), filepath.Dir(parent)
+	}
+
+	seen := make(map[string]bool)
+	var paths, missing []string
+	add := func(p string) error {
+		rel, err := filepath.Rel(rootDir, p)
+		if err != nil {
+			return err
+		}
+		if !seen[rel] {
+			seen[rel] = true
+			paths = append(paths, rel)
+		}
+		return nil
+	}
+	for _, p := range candidates {
+		if _, err := os.Stat(p); err != nil {
+			if !os.IsNotExist(err) {
+				return nil, err
+			}
+			if !opts.IncludeMissing {
+				missing = append(missing, p)
+				continue
+			}
+		}
+		if err := add(p); err != nil {
+			return nil, err
+		}
+	}
+
+	included, unmatched, err := proj.includedPaths(rootDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range included {
+		if err := add(filepath.Join(rootDir, p)); err != nil {
+			return nil, err
+		}
+	}
+
+	if !opts.IncludeMissing && (len(missing) > 0 || len(unmatched) > 0) {
+		var errs *multierror.Error
+		for _, p := range missing {
+			errs = multierror.Append(errs, fmt.Errorf("referenced path '%v' does not exist", p))
+		}
+		for _, pattern := range unmatched {
+			errs = multierror.Append(errs, fmt.Errorf("include pattern '%v' does not match any files", pattern))
+		}
+		return nil, errs
+	}
+
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// resolveReferencedPath resolves p, which may use either path separator, relative to dir.
+func resolveReferencedPath(dir, p string) string {
+	p = normalizePathSeparators(p)
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(dir, p)
+	}
+	return filepath.Clean(p)
+}
+
+// readExtends returns the `extends` attribute of the project file at path, or "" if the file can't be read or doesn't
+// extend another project.
+func readExtends(path string) string {
+	marshaller, err := marshallerForPath(path)
+	if err != nil {
+		return ""
+	}
+	b, err := readFileStripUTF8BOM(path)
+	if err != nil {
+		return ""
+	}
+	var raw interface{}
+	if err = unmarshalProjectDocument(marshaller, b, &raw); err != nil {
+		return ""
+	}
+	projectDef, err := SimplifyMarshalledProject(raw)
+	if err != nil {
+		return ""
+	}
+	extends, _ := projectDef["extends"].(string)
+	return extends
+}
+
+// includedPaths walks rootDir and returns the topmost files and directories, relative to rootDir, that match one of
+// the project's Include patterns, along with the patterns that match nothing.
+func (proj *Project) includedPaths(rootDir string) ([]string, []string, error) {
+	if len(proj.Include) == 0 {
+		return nil, nil, nil
+	}
+
+	matched := make(map[string]bool)
+	var included []string
+	err := filepath.WalkDir(rootDir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(rootDir, p)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		found := false
+		for _, pattern := range proj.Include {
+			if matchSourceGlob(pattern, rel) {
+				matched[pattern], found = true, true
+			}
+		}
+		if !found {
+			return nil
+		}
+		included = append(included, filepath.FromSlash(rel))
+		if d.IsDir() {
+			// Everything below a matching directory is matched too.
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var unmatched []string
+	for _, pattern := range proj.Include {
+		if !matched[pattern] {
+			unmatched = append(unmatched, pattern)
+		}
+	}
+	return included, unmatched, nil
+}
+
+// validatePluginDuplicates returns an error if plugins, the plugins of one kind, lists the same plugin more than once
+// with different versions or paths. Identical entries are only reported by Lint.
+func validatePluginDuplicates(plugins []PluginOptions) error {
+	seen := make(map[string]PluginOptions, len(plugins))
+	for _, plugin := range plugins {
+		first, has := seen[plugin.Name]
+		if !has {
+			seen[plugin.Name] = plugin
+			continue
+		}
+		if first.Version != plugin.Version {
+			return fmt.Errorf("duplicate plugin '%v' with versions %v and %v",
+				plugin.Name, pluginVersionOrUnset(first.Version), pluginVersionOrUnset(plugin.Version))
+		}
+		if first.Path != plugin.Path {
+			return fmt.Errorf("duplicate plugin '%v' with paths %v and %v", plugin.Name, first.Path, plugin.Path)
+		}
+	}
+	return nil
+}
+
+func pluginVersionOrUnset(version string) string {
+	if version == "" {
+		return "(unset)"
+	}
+	return version
+}
+
+// ResolvePluginVersion returns the highest of the available versions of the plugin called name that satisfies the
+// version the project declares for it. The declared version may be an exact version or a semver range, such as
+// ">=4.2.0" or ">=4.2.0 <5.0.0"; a plugin declared without a version accepts any version. Providers are searched
+// first, then language plugins and analyzers. It is an error if the project doesn't declare the plugin, if its
+// version range is malformed, or if none of the available versions satisfy it.
+func (proj *Project) ResolvePluginVersion(name string, available []string) (string, error) {
+	var plugin *PluginOptions
+	if proj.Plugins != nil {
+		for _, plugins := range [][]PluginOptions{proj.Plugins.Providers, proj.Plugins.Languages, proj.Plugins.Analyzers} {
+			for i := range plugins {
+				if plugins[i].Name == name {
+					plugin = &plugins[i]
+					break
+				}
+			}
+			if plugin != nil {
+				break
+			}
+		}
+	}
+	if plugin == nil {
+		return "", fmt.Errorf("project does not declare a plugin named '%v'", name)
+	}
+
+	satisfies := func(semver.Version) bool { return true }
+	if plugin.Version != "" {
+		r, err := semver.ParseRange(plugin.Version)
+		if err != nil {
+			return "", fmt.Errorf("plugin '%v' has an invalid version range '%v': %w", name, plugin.Version, err)
+		}
+		satisfies = r
+	}
+
+	var best string
+	var bestVersion semver.Version
+	for _, v := range available {
+		version, err := semver.ParseTolerant(v)
+		if err != nil {
+			return "", fmt.Errorf("available version '%v' of plugin '%v' is invalid: %w", v, name, err)
+		}
+		if satisfies(version) && (best == "" || version.GT(bestVersion)) {
+			best, bestVersion = v, version
+		}
+	}
+	if len(available) == 0 {
+		return "", fmt.Errorf("no versions of plugin '%v' are available", name)
+	}
+	if best == "" {
+		return "", fmt.Errorf("no available version of plugin '%v' satisfies '%v'; available versions: %v",
+			name, plugin.Version, strings.Join(available, ", "))
+	}
+	return best, nil
+}
+
+// ResolvedMain returns the absolute location of the program's main entry-point, given the directory containing the
+// project file. A leading `~` in `main` is expanded to the user's home directory and `$VAR` or `${VAR}` references
+// are replaced by the values of the corresponding environment variables; referencing an undefined variable is an
+// error. Both `/` and `\` are accepted as path separators, so a project written on Windows resolves on other
+// platforms and vice versa. A relative `main` is resolved against projectDir, and an unset `main` resolves to
+// projectDir itself. The project's `main` field is left as written.
+func (proj *Project) ResolvedMain(projectDir string) (string, error) {
+	main, err := expandMainPath(normalizePathSeparators(proj.Main))
+	if err != nil {
+		return "", err
+	}
+	if main == "" {
+		return filepath.Abs(projectDir)
+	}
+	if !filepath.IsAbs(main) {
+		main = filepath.Join(projectDir, main)
+	}
+	return filepath.Abs(main)
+}
+
+// ValidateMainWithinProject checks that the program's main entry-point, as resolved by ResolvedMain, lies within
+// projectDir, so that a `main` such as `../../etc/passwd` can't escape the project. It is an opt-in check for
+// sandboxed environments such as multi-tenant build services, and is not part of Validate. The check is lexical:
+// symbolic links within the project directory are not followed.
+func (proj *Project) ValidateMainWithinProject(projectDir string) error {
+	root, err := filepath.Abs(projectDir)
+	if err != nil {
+		return err
+	}
+	main, err := proj.ResolvedMain(root)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(root, main)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+		return fmt.Errorf("main '%v' resolves to '%v', which is outside of the project directory '%v'",
+			proj.Main, main, root)
+	}
+	return nil
+}
+
+// ResolveMain returns the absolute location of the program's main entry-point, as resolved by ResolvedMain, provided
+// it lies within projectDir; a `main` that escapes the project, such as `../other`, is an error, as reported by
+// ValidateMainWithinProject. It suits callers such as language hosts that run the program from within the project.
+func (proj *Project) ResolveMain(projectDir string) (string, error) {
+	if err := proj.ValidateMainWithinProject(projectDir); err != nil {
+		return "", err
+	}
+	return proj.ResolvedMain(projectDir)
+}
+
+// ValidateEntrypoint checks that the program's main entry-point, as resolved by ResolvedMain against projectDir,
+// exists, and that the project's runtime can discover its conventional entry file from it: a `__main__.py` for a
+// python `main` directory, and the file named by package.json's `main`, or an index file, for a nodejs one. Runtimes
+// without a convention are only checked for the existence of `main`. It is an opt-in check for callers with access to
+// the project's files, and is not part of Validate.
+func (proj *Project) ValidateEntrypoint(projectDir string) error {
+	main, err := proj.ResolvedMain(projectDir)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(main)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("main '%v' resolves to '%v', which does not exist", proj.Main, main)
+	} else if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		// A file is run as the program itself.
+		return nil
+	}
+	if check, has := entrypointCheckers[proj.Runtime.Name()]; has {
+		return check(main)
+	}
+	return nil
+}
+
+// entrypointCheckers checks that the runtime's entry file can be found in dir, the directory that the project's
+// `main` resolves to, for each runtime that looks for one. Runtimes that are not listed here are not checked.
+var entrypointCheckers = map[string]func(dir string) error{
+	"nodejs": checkNodeJSEntrypoint,
+	"python": checkPythonEntrypoint,
+}
+
+// checkPythonEntrypoint checks that dir holds a `__main__.py`, which Python runs when it is given a directory.
+func checkPythonEntrypoint(dir string) error {
+	if fileExists(filepath.Join(dir, "__main__.py")) {
+		return nil
+	}
+	return fmt.Errorf("python runtime expects __main__.py or a main module in '%v'; add a __main__.py, "+
+		"or set main to the program's module", dir)
+}
+
+// checkNodeJSEntrypoint checks that dir holds the file named by the `main` of its package.json, or an index file
+// if there is no package.json or it doesn't set `main`. As with Node.js, the `.js` and `.ts` extensions may be
+// omitted, and a directory is resolved to its index file.
+func checkNodeJSEntrypoint(dir string) error {
+	packagePath := filepath.Join(dir, "package.json")
+	b, err := os.ReadFile(packagePath)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var pkg struct {
+			Main string `json:"main"`
+		}
+		if err := json.Unmarshal(b, &pkg); err != nil {
+			return fmt.Errorf("could not read '%v': %w", packagePath, err)
+		}
+		if pkg.Main != "" {
+			if nodeJSModuleExists(filepath.Join(dir, filepath.FromSlash(pkg.Main))) {
+				return nil
+			}
+			return fmt.Errorf("nodejs runtime expects the main file '%v' named by '%v' to exist",
+				pkg.Main, packagePath)
+		}
+	}
+	if nodeJSModuleExists(filepath.Join(dir, "index")) {
+		return nil
+	}
+	return fmt.Errorf("nodejs runtime expects an index.js or index.ts in '%v'; add one, "+
+		"or set main in package.json to the program's entry file", dir)
+}
+
+// nodeJSModuleExists reports whether path names a Node.js module: a file, possibly without its `.js` or `.ts`
+// extension, or a directory holding an index file.
+func nodeJSModuleExists(path string) bool {
+	for _, candidate := range []string{
+		path, path + ".js", path + ".ts", filepath.Join(path, "index.js"), filepath.Join(path, "index.ts"),
+	} {
+		if fileExists(candidate) {
+			return true
+		}
+	}
+	return false
+}
+
+// fileExists reports whether path names an existing file that isn't a directory.
+func fileExists(path string) bool {
+	info, err := os.Stat(path)
+	return err == nil && !info.IsDir()
+}
+
+// Redacted returns a deep copy of the project in which every secret runtime option, including secrets nested inside
+// option values, has been replaced by RedactedSecretValue. The result is safe to log or display; the receiver is not
+// modified.
+func (proj *Project) Redacted() *Project {
+	redacted := proj.Clone()
+	for key, value := range redacted.Runtime.options {
+		redacted.Runtime.options[key] = redactSecureObject(value)
+	}
+	return redacted
+}
+
+// ValidateNameMatchesDir checks that the project's name is the same as the name of the directory holding its project
+// file, at projectFilePath. It is an opt-in check for teams whose policy requires the two to match, and is not part of
+// Validate; callers may treat its error as a warning.
+func (proj *Project) ValidateNameMatchesDir(projectFilePath string) error {
+	path, err := filepath.Abs(projectFilePath)
+	if err != nil {
+		return err
+	}
+	dir := filepath.Base(filepath.Dir(path))
+	if string(proj.Name) != dir {
+		return fmt.Errorf("project name '%v' does not match the name of its directory '%v'", proj.Name, dir)
+	}
+	return nil
+}
+
+// normalizePathSeparators rewrites both forward and backward slashes in path to the separator used by the current
+// operating system.
+func normalizePathSeparators(path string) string {
+	return filepath.FromSlash(strings.ReplaceAll(path, "\\", "/"))
+}
+
+// expandMainPath expands a leading `~` and any environment variable references in main.
+func expandMainPath(main string) (string, error) {
+	var undefined []string
+	main = os.Expand(main, func(name string) string {
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			undefined = append(undefined, name)
+		}
+		return value
+	})
+	if len(undefined) > 0 {
+		return "", fmt.Errorf("main: undefined environment variable '%v'", undefined[0])
+	}
+
+	if main == "~" || strings.HasPrefix(main, "~/") || strings.HasPrefix(main, "~"+string(filepath.Separator)) {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("main: expanding '~': %w", err)
+		}
+		main = filepath.Join(home, main[1:])
+	}
+	return main, nil
+}
+
+// TrustResourceDependencies returns whether this project's runtime can be trusted to accurately report
+// dependencies. All languages supported by Pulumi today do this correctly. This option remains useful when bringing
+// up new Pulumi languages.
+func (proj *Project) TrustResourceDependencies() bool {
+	return true
+}
+
+// Save writes a project definition to a file. It is an error to save a project that fails Validate, e.g. one whose
+// runtime isn't registered.
+func (proj *Project) Save(path string) error {
+	contract.Requiref(path != "", "path", "must not be empty")
+	contract.Requiref(proj != nil, "proj", "must not be nil")
+	if err := proj.Validate(); err != nil {
+		return fmt.Errorf("can't save invalid project: %w", err)
+	}
+	return save(path, proj, false /*mkDirAll*/)
+}
+
+// ProjectSaveOptions controls how Project.SaveWithOptions writes a project file.
+type ProjectSaveOptions struct {
+	// ReplaceSymlink replaces a symbolic link at the destination path with a regular file, rather than writing
+	// through to the link's target.
+	ReplaceSymlink bool
+}
+
+// SaveWithOptions writes a project definition to a file, using the given options. As with Save, it is an error to save
+// a project that fails Validate.
+func (proj *Project) SaveWithOptions(path string, opts ProjectSaveOptions) error {
+	contract.Requiref(path != "", "path", "must not be empty")
+	contract.Requiref(proj != nil, "proj", "must not be nil")
+	if err := proj.Validate(); err != nil {
+		return fmt.Errorf("can't save invalid project: %w", err)
+	}
+	return saveTo(osFS{}, path, proj, false /*mkDirAll*/, opts.ReplaceSymlink)
+}
+
+// CreateProjectOptions controls the behavior of CreateProjectWithOptions.
+type CreateProjectOptions struct {
+	// Overwrite replaces the project file the directory already has, if any, rather than failing.
+	Overwrite bool
+}
+
+// CreateProject writes a new project file for proj into dir, creating dir if needed, along with the project's
+// bookkeeping directory, and returns the path of the project file. The project is validated first, and it is an error
+// for dir to already have a project file.
+func CreateProject(dir string, proj *Project) (string, error) {
+	return CreateProjectWithOptions(dir, proj, CreateProjectOptions{})
+}
+
+// CreateProjectWithOptions is CreateProject with options. The project file is written as Pulumi.yaml, unless an
+// existing project file is overwritten, in which case it keeps its name and format.
+func CreateProjectWithOptions(dir string, proj *Project, opts CreateProjectOptions) (string, error) {
+	contract.Requiref(dir != "", "dir", "must not be empty")
+	contract.Requiref(proj != nil, "proj", "must not be nil")
+
+	if err := ValidateProjectName(string(proj.Name)); err != nil {
+		return "", fmt.Errorf("invalid project name '%v': %w", proj.Name, err)
+	}
+	if err := proj.Validate(); err != nil {
+		return "", err
+	}
+
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, ProjectFile+".yaml")
+	existing, err := projectFileInDir(dir)
+	switch {
+	case errors.Is(err, ErrProjectNotFound):
+	case err != nil:
+		return "", err
+	case !opts.Overwrite:
+		return "", fmt.Errorf("%s already exists; overwrite it to replace the project", existing)
+	default:
+		path = existing
+	}
+
+	if err := os.MkdirAll(filepath.Join(dir, BookkeepingDir), 0o755); err != nil {
+		return "", err
+	}
+	if err := save(path, proj, false /*mkDirAll*/); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+type PolicyPackProject struct {
+	// Runtime is a required runtime that executes code.
+	Runtime ProjectRuntimeInfo `json:"runtime" yaml:"runtime"`
+	// Version specifies the version of the policy pack. If set, it will override the
+	// version specified in `package.json` for Node.js policy packs.
+	Version string `json:"version,omitempty" yaml:"version,omitempty"`
+
+	// Main is an optional override for the program's main entry-point location.
+	Main string `json:"main,omitempty" yaml:"main,omitempty"`
+
+	// Description is an optional informational description.
+	Description *string `json:"description,omitempty" yaml:"description,omitempty"`
+	// Author is an optional author that created this project.
+	Author *string `json:"author,omitempty" yaml:"author,omitempty"`
+	// Website is an optional website for additional info about this project.
+	Website *string `json:"website,omitempty" yaml:"website,omitempty"`
+	// License is the optional license governing this project's usage.
+	License *string `json:"license,omitempty" yaml:"license,omitempty"`
+
+	// The original byte representation of the file, used to attempt trivia-preserving edits
+	raw []byte
+}
+
+func (proj PolicyPackProject) RawValue() []byte {
+	return proj.raw
+}
+
+func (proj *PolicyPackProject) Validate() error {
+	if proj.Runtime.Name() == "" {
+		return errors.New("project is missing a 'runtime' attribute")
+	}
+
+	return nil
+}
+
+// Save writes a project definition to a file.
+func (proj *PolicyPackProject) Save(path string) error {
+	contract.Requiref(path != "", "path", "must not be empty")
+	contract.Requiref(proj != nil, "proj", "must not be nil")
+	contract.Requiref(proj.Validate() == nil, "proj", "Validate()")
+	return save(path, proj, false /*mkDirAll*/)
+}
+
+type PluginProject struct {
+	// Runtime is a required runtime that executes code.
+	Runtime ProjectRuntimeInfo `json:"runtime" yaml:"runtime"`
+}
+
+func (proj *PluginProject) Validate() error {
+	if proj.Runtime.Name() == "" {
+		return errors.New("project is missing a 'runtime' attribute")
+	}
+
+	return nil
+}
+
+// ProjectStack holds stack specific information about a project.
+type ProjectStack struct {
+	// SecretsProvider is this stack's secrets provider.
+	SecretsProvider string `json:"secretsprovider,omitempty" yaml:"secretsprovider,omitempty"`
+	// EncryptedKey is the KMS-encrypted ciphertext for the data key used for secrets encryption.
+	// Only used for cloud-based secrets providers.
+	EncryptedKey string `json:"encryptedkey,omitempty" yaml:"encryptedkey,omitempty"`
+	// EncryptionSalt is this stack's base64 encoded encryption salt.  Only used for
+	// passphrase-based secrets providers.
+	EncryptionSalt string `json:"encryptionsalt,omitempty" yaml:"encryptionsalt,omitempty"`
+	// Config is an optional config bag.
+	Config config.Map `json:"config,omitempty" yaml:"config,omitempty"`
+
+	// The original byte representation of the file, used to attempt trivia-preserving edits
+	raw []byte
+}
+
+func (ps ProjectStack) RawValue() []byte {
+	return ps.raw
+}
+
+// Save writes a project definition to a file.
+func (ps *ProjectStack) Save(path string) error {
+	contract.Requiref(path != "", "path", "must not be empty")
+	contract.Requiref(ps != nil, "ps", "must not be nil")
+	return save(path, ps, true /*mkDirAll*/)
+}
+
+// errRuntimeMissingName is returned when the object form of a runtime does not name the runtime.
+var errRuntimeMissingName = errors.New("runtime object is missing a 'name' field")
+
+type ProjectRuntimeInfo struct {
+	name    string
+	options map[string]interface{}
+
+	// defaulted holds the options that were filled in by Project.WithDefaults rather than set by the user. They are
+	// left out when the runtime is marshalled, so that defaults stay implicit in saved project files.
+	defaulted map[string]bool
+
+	// objectForm is set if the runtime is marshalled as an object even when it has no options, because it was read
+	// in that form or expanded by Project.ExpandRuntime.
+	objectForm bool
+}
+
+func NewProjectRuntimeInfo(name string, options map[string]interface{}) ProjectRuntimeInfo {
+	return ProjectRuntimeInfo{
+		name:    name,
+		options: options,
+	}
+}
+
+func (info *ProjectRuntimeInfo) Name() string {
+	return info.name
+}
+
+func (info *ProjectRuntimeInfo) Options() map[string]interface{} {
+	return info.options
+}
+
+// SetOption sets the value of an option. Options set this way are always saved, even if they were defaulted.
+func (info *ProjectRuntimeInfo) SetOption(key string, value interface{}) {
+	if info.options == nil {
+		info.options = make(map[string]interface{})
+	}
+	info.options[key] = value
+	delete(info.defaulted, key)
+}
+
+// OptionBool returns the value of a boolean option. ok is false if the option isn't set or isn't a boolean, e.g. if it
+// is written as the string "true".
+func (info *ProjectRuntimeInfo) OptionBool(key string) (value bool, ok bool) {
+	value, ok = info.options[key].(bool)
+	return value, ok
+}
+
+// OptionString returns the value of a string option. ok is false if the option isn't set or isn't a string.
+func (info *ProjectRuntimeInfo) OptionString(key string) (value string, ok bool) {
+	value, ok = info.options[key].(string)
+	return value, ok
+}
+
+// OptionStringSlice returns the value of an option that is a list of strings, whether it was decoded from YAML or JSON
+// as a []interface{} or set as a []string. The returned slice may be modified. ok is false if the option isn't set or
+// isn't a list of strings.
+func (info *ProjectRuntimeInfo) OptionStringSlice(key string) (value []string, ok bool) {
+	switch v := info.options[key].(type) {
+	case []string:
+		return append([]string(nil), v...), true
+	case []interface{}:
+		value = make([]string, len(v))
+		for i, item := range v {
+			s, isString := item.(string)
+			if !isString {
+				return nil, false
+			}
+			value[i] = s
+		}
+		return value, true
+	default:
+		return nil, false
+	}
+}
+
+// OptionMap returns the value of an option that is a nested object, such as `buildTarget: {os: linux, arch: amd64}`,
+// with its structure intact: nested objects and lists are returned as they were decoded. The returned map is a deep
+// copy and may be modified. ok is false if the option isn't set or isn't an object.
+func (info *ProjectRuntimeInfo) OptionMap(key string) (value map[string]interface{}, ok bool) {
+	switch v := info.options[key].(type) {
+	case map[string]interface{}:
+		return deepCopyValue(v).(map[string]interface{}), true
+	case map[interface{}]interface{}:
+		simplified, err := SimplifyMarshalledValue(deepCopyValue(v))
+		if err != nil {
+			return nil, false
+		}
+		return simplified.(map[string]interface{}), true
+	default:
+		return nil, false
+	}
+}
+
+// OptionIsSecret returns true if the option is a secret, held encrypted in the `secure: <ciphertext>` form of a secret
+// config value, so that it isn't written in plaintext to the project file.
+func (info *ProjectRuntimeInfo) OptionIsSecret(key string) bool {
+	_, ok := secureRuntimeOption(info.options[key])
+	return ok
+}
+
+// SecretOption returns the value of a secret option as a secure config value, which can be decrypted with the
+// decrypter of the stack's secrets manager. ok is false if the option isn't set or isn't a secret.
+func (info *ProjectRuntimeInfo) SecretOption(key string) (value config.Value, ok bool) {
+	ciphertext, ok := secureRuntimeOption(info.options[key])
+	if !ok {
+		return config.Value{}, false
+	}
+	return config.NewSecureValue(ciphertext), true
+}
+
+// SetSecretOption sets an option to a secret holding ciphertext, encrypted by a stack's secrets manager as for a secret
+// config value. Like SetOption, the option is always saved.
+func (info *ProjectRuntimeInfo) SetSecretOption(key, ciphertext string) {
+	info.SetOption(key, map[string]interface{}{"secure": ciphertext})
+}
+
+// secureRuntimeOption returns the ciphertext of an option value of the form `secure: <ciphertext>`, whether it was
+// decoded from YAML or JSON.
+func secureRuntimeOption(v interface{}) (string, bool) {
+	var ciphertext interface{}
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) != 1 {
+			return "", false
+		}
+		ciphertext = v["secure"]
+	case map[interface{}]interface{}:
+		if len(v) != 1 {
+			return "", false
+		}
+		ciphertext = v["secure"]
+	}
+	s, ok := ciphertext.(string)
+	return s, ok
+}
+
+// Toolchain returns the toolchain the runtime requires, as declared by the `toolchain` runtime option: an object with
+// the toolchain's `name`, such as "uv", "poetry" or "node", and optionally the lowest supported version as
+// `minVersion`. ok is false if the option isn't set or isn't well formed; Project.Validate rejects malformed ones.
+func (info *ProjectRuntimeInfo) Toolchain() (name, minVersion string, ok bool) {
+	toolchain, isMap := info.options["toolchain"].(map[string]interface{})
+	if !isMap {
+		return "", "", false
+	}
+	name, _ = toolchain["name"].(string)
+	minVersion, _ = toolchain["minVersion"].(string)
+	return name, minVersion, name != ""
+}
+
+// validateToolchain checks the `toolchain` runtime option, if it is set. See ProjectRuntimeInfo.Toolchain.
+func validateToolchain(options map[string]interface{}) error {
+	v, has := options["toolchain"]
+	if !has {
+		return nil
+	}
+	toolchain, ok := v.(map[string]interface{})
+	if !ok {
+		return errors.New("runtime option 'toolchain' must be an object with 'name' and 'minVersion' attributes")
+	}
+
+	keys := make([]string, 0, len(toolchain))
+	for key := range toolchain {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if key != "name" && key != "minVersion" {
+			return fmt.Errorf("runtime option 'toolchain' has an unknown attribute '%v'", key)
+		}
+	}
+
+	if name, ok := toolchain["name"].(string); !ok || name == "" {
+		return errors.New("runtime option 'toolchain' is missing a 'name'")
+	}
+	if v, has := toolchain["minVersion"]; has {
+		minVersion, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("runtime option 'toolchain' has a minVersion of %v that is not a string; quote it", v)
+		}
+		if _, err := semver.ParseTolerant(minVersion); err != nil {
+			return fmt.Errorf("runtime option 'toolchain' has an invalid minVersion '%v': %w", minVersion, err)
+		}
+	}
+	return nil
+}
+
+// OptionIsDefaulted returns true if the option was filled in by Project.WithDefaults rather than set explicitly.
+func (info *ProjectRuntimeInfo) OptionIsDefaulted(key string) bool {
+	return info.defaulted[key]
+}
+
+// explicitOptions returns the options that were set explicitly, leaving out those filled in by defaults.
+func (info ProjectRuntimeInfo) explicitOptions() map[string]interface{} {
+	if len(info.defaulted) == 0 {
+		return info.options
+	}
+
+	explicit := make(map[string]interface{}, len(info.options))
+	for k, v := range info.options {
+		if !info.defaulted[k] {
+			explicit[k] = v
+		}
+	}
+	return explicit
+}
+
+// marshalledForm returns the runtime as it is marshalled: the bare name if it has no options and isn't in the object
+// form, and an object with the name and any options otherwise.
+func (info ProjectRuntimeInfo) marshalledForm() interface{} {
+	options := info.explicitOptions()
+	if len(options) == 0 {
+		if !info.objectForm {
+			return info.name
+		}
+		return map[string]interface{}{"name": info.name}
+	}
+
+	return map[string]interface{}{
+		"name":    info.name,
+		"options": options,
+	}
+}
+
+func (info ProjectRuntimeInfo) MarshalYAML() (interface{}, error) {
+	return info.marshalledForm(), nil
+}
+
+func (info ProjectRuntimeInfo) MarshalJSON() ([]byte, error) {
+	return json.Marshal(info.marshalledForm())
+}
+
+func (info *ProjectRuntimeInfo) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &info.name); err == nil {
+		return nil
+	}
+
+	var payload struct {
+		Name    string                 `json:"name"`
+		Options map[string]interface{} `json:"options"`
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&payload); err == nil {
+		if payload.Name == "" {
+			return errRuntimeMissingName
+		}
+		info.name = payload.Name
+		info.options = normalizeJSONNumbers(payload.Options).(map[string]interface{})
+		info.objectForm = true
+		return nil
+	}
+
+	return errors.New("runtime section must be a string or an object with name and options attributes")
+}
+
+// normalizeJSONNumbers replaces the json.Numbers in a value decoded from JSON with the types YAML decodes numbers to:
+// an int for integers that fit in one, and a float64 otherwise. This keeps runtime options identical whichever format
+// they were read from, and keeps integers integral when they are written back out.
+func normalizeJSONNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := strconv.ParseInt(string(v), 10, 0); err == nil {
+			return int(i)
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v
+	case map[string]interface{}:
+		for key, value := range v {
+			v[key] = normalizeJSONNumbers(value)
+		}
+		return v
+	case []interface{}:
+		for i, value := range v {
+			v[i] = normalizeJSONNumbers(value)
+		}
+		return v
+	default:
+		return v
+	}
+}
+
+// UnmarshalYAML accepts the runtime as a bare name or as an object with name and options attributes. The runtime may
+// also be given by an alias of an anchored name or object, which the YAML decoder resolves before unmarshal is called.
+func (info *ProjectRuntimeInfo) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	if err := unmarshal(&info.name); err == nil {
 		return nil
 	}
 
@@ -680,8 +2203,12 @@ func (info *ProjectRuntimeInfo) UnmarshalYAML(unmarshal func(interface{}) error)
 	}
 
 	if err := unmarshal(&payload); err == nil {
+		if payload.Name == "" {
+			return errRuntimeMissingName
+		}
 		info.name = payload.Name
 		info.options = payload.Options
+		info.objectForm = true
 		return nil
 	}
 
@@ -699,6 +2226,13 @@ func marshallerForPath(path string) (encoding.Marshaler, error) {
 }
 
 func save(path string, value interface{}, mkDirAll bool) error {
+	return saveTo(osFS{}, path, value, mkDirAll, false /*replaceSymlink*/)
+}
+
+// saveTo is save using the given filesystem. If replaceSymlink is set, a symbolic link at path is replaced by the
+// written file, rather than written through; since the file is renamed over the link, the link is only replaced once
+// the file has been written in full.
+func saveTo(fs workspaceFS, path string, value interface{}, mkDirAll, replaceSymlink bool) error {
 	contract.Requiref(path != "", "path", "must not be empty")
 	contract.Requiref(value != nil, "value", "must not be nil")
 
@@ -707,17 +2241,36 @@ func save(path string, value interface{}, mkDirAll bool) error {
 		return err
 	}
 
-	b, err := m.Marshal(value)
+	var b []byte
+	if proj, ok := value.(*Project); ok && len(proj.extendsInherited) > 0 {
+		b, err = proj.marshalOwnAttributes(m)
+	} else {
+		b, err = m.Marshal(value)
+	}
 	if err != nil {
 		return err
 	}
+	if proj, ok := value.(*Project); ok && m == encoding.YAML {
+		b = withSchemaHint(b, proj.schemaHint)
+		b = append(b, proj.inlineStackDocuments...)
+	}
 
 	if mkDirAll {
-		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		if err := fs.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 			return err
 		}
 	}
 
-	//nolint:gosec
-	return os.WriteFile(path, b, 0o644)
+	// The file is replaced atomically, so that it isn't left half written if we're interrupted. Unless asked to replace
+	// them, write through symbolic links to their targets, and keep the permissions of an existing file.
+	perm := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		perm = info.Mode().Perm()
+	}
+	if !replaceSymlink {
+		if target, err := filepath.EvalSymlinks(path); err == nil {
+			path = target
+		}
+	}
+	return atomicWriteFile(context.Background(), fs, path, b, perm)
 }
@@ -1,14 +1,21 @@
 package workspace
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
 	"testing"
 
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/santhosh-tekuri/jsonschema/v5"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v2"
@@ -45,6 +52,95 @@ func TestProjectRuntimeInfoRoundtripYAML(t *testing.T) {
 	doTest(json.Marshal, json.Unmarshal)
 }
 
+func TestProjectTemplateRoundtrip(t *testing.T) {
+	t.Parallel()
+
+	template := &ProjectTemplate{
+		Description: "A template.",
+		Config: map[string]ProjectTemplateConfigValue{
+			"region":   {Description: "The region.", Default: "us-west-2"},
+			"password": {Description: "The password.", Default: "${env:PASSWORD}", Secret: true},
+		},
+	}
+	doTest := func(marshal func(interface{}) ([]byte, error), unmarshal func([]byte, interface{}) error) {
+		byts, err := marshal(template)
+		assert.NoError(t, err)
+
+		var roundtrip ProjectTemplate
+		err = unmarshal(byts, &roundtrip)
+		assert.NoError(t, err)
+		assert.Equal(t, template, &roundtrip)
+	}
+
+	doTest(yaml.Marshal, yaml.Unmarshal)
+	doTest(json.Marshal, json.Unmarshal)
+}
+
+func TestProjectTemplateScalarDefaults(t *testing.T) {
+	t.Parallel()
+
+	expected := map[string]ProjectTemplateConfigValue{
+		"count":   {Default: "3"},
+		"ratio":   {Default: "1.5"},
+		"enabled": {Default: "true"},
+		"name":    {Default: "web"},
+		"unset":   {Description: "No default."},
+	}
+	dir := writeProjectFiles(t, map[string]string{
+		"Pulumi.yaml": `name: proj
+runtime: nodejs
+template:
+  config:
+    count:
+      default: 3
+    ratio:
+      default: 1.5
+    enabled:
+      default: true
+    name:
+      default: web
+    unset:
+      description: No default.
+      default: null
+`,
+		"Pulumi.json": `{"name": "proj", "runtime": "nodejs", "template": {"config": {
+    "count": {"default": 3},
+    "ratio": {"default": 1.5},
+    "enabled": {"default": true},
+    "name": {"default": "web"},
+    "unset": {"description": "No default.", "default": null}
+}}}`,
+	})
+	for _, name := range []string{"Pulumi.yaml", "Pulumi.json"} {
+		proj, err := LoadProject(filepath.Join(dir, name))
+		require.NoError(t, err, name)
+		assert.Equal(t, expected, proj.Template.Config, name)
+	}
+
+	_, err := loadProjectFromText(t, `name: proj
+runtime: nodejs
+template:
+  config:
+    tags:
+      default: [a, b]
+`)
+	assert.ErrorContains(t, err, "template/config/tags/default")
+}
+
+func TestProjectRuntimeInfoEmptyObject(t *testing.T) {
+	t.Parallel()
+
+	var ri ProjectRuntimeInfo
+	err := yaml.Unmarshal([]byte("{}"), &ri)
+	assert.EqualError(t, err, "runtime object is missing a 'name' field")
+
+	err = json.Unmarshal([]byte("{}"), &ri)
+	assert.EqualError(t, err, "runtime object is missing a 'name' field")
+
+	_, err = loadProjectFromText(t, "name: project\nruntime: {}")
+	assert.ErrorContains(t, err, "runtime object is missing a 'name' field")
+}
+
 func TestProjectValidationForNameAndRuntime(t *testing.T) {
 	t.Parallel()
 	var err error
@@ -55,17 +151,49 @@ func TestProjectValidationForNameAndRuntime(t *testing.T) {
 	assert.Error(t, err)
 	assert.Equal(t, "project is missing a 'name' attribute", err.Error())
 	// Test lack of runtime
-	proj.Name = "a project"
+	proj.Name = "a-project"
 	err = proj.Validate()
 	assert.Error(t, err)
 	assert.Equal(t, "project is missing a 'runtime' attribute", err.Error())
 
 	// Test success
-	proj.Runtime = NewProjectRuntimeInfo("test", nil)
+	proj.Runtime = NewProjectRuntimeInfo("nodejs", nil)
 	err = proj.Validate()
 	assert.NoError(t, err)
 }
 
+func TestProjectValidationForNamePaths(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name     tokens.PackageName
+		expected string
+	}{
+		{
+			name:     "../../etc/passwd",
+			expected: "project names may only contain alphanumerics, hyphens, underscores, and periods",
+		},
+		{name: "a/b", expected: "project names may only contain alphanumerics, hyphens, underscores, and periods"},
+		{name: `a\b`, expected: "project names may only contain alphanumerics, hyphens, underscores, and periods"},
+		{name: "..", expected: "project names may not start with a period"},
+		{name: ".hidden", expected: "project names may not start with a period"},
+		{name: tokens.PackageName(strings.Repeat("a", 101)), expected: "project names are limited to 100 characters"},
+		{name: "my-project_v1.2"},
+	}
+	for _, tt := range tests {
+		proj := Project{Name: tt.name, Runtime: NewProjectRuntimeInfo("nodejs", nil)}
+		err := proj.Validate()
+		if tt.expected == "" {
+			assert.NoError(t, err, tt.name)
+			continue
+		}
+		assert.EqualError(t, err, fmt.Sprintf("invalid project name '%v': %v", tt.name, tt.expected))
+	}
+
+	_, err := loadProjectFromText(t, "name: ../../etc/passwd\nruntime: nodejs\n")
+	assert.ErrorContains(t, err, "invalid project name '../../etc/passwd'")
+}
+
 func TestProjectValidationFailsForIncorrectDefaultValueType(t *testing.T) {
 	t.Parallel()
 	project := Project{Name: "test", Runtime: NewProjectRuntimeInfo("dotnet", nil)}
@@ -183,32 +311,32 @@ func TestProjectLoadJSON(t *testing.T) {
 	// These can vary in order, so contains not equals check
 	expected := []string{
 		"3 errors occurred:",
-		"* #/runtime: oneOf failed",
-		"* #/runtime: expected string, but got number",
-		"* #/runtime: expected object, but got number",
+		"* line 1, column 32: #/runtime: oneOf failed",
+		"* line 1, column 32: #/runtime: expected string, but got number",
+		"* line 1, column 32: #/runtime: expected object, but got number",
 	}
 	for _, e := range expected {
 		assert.Contains(t, err.Error(), e)
 	}
 
-	_, err = writeAndLoad("{\"name\": \"project\", \"runtime\": \"test\", \"backend\": 4, \"main\": {}}")
+	_, err = writeAndLoad("{\"name\": \"project\", \"runtime\": \"nodejs\", \"backend\": 4, \"main\": {}}")
 	expected = []string{
 		"2 errors occurred:",
-		"* #/main: expected string or null, but got object",
-		"* #/backend: expected object or null, but got number",
+		"* line 1, column 64: #/main: expected string or null, but got object",
+		"* line 1, column 53: #/backend: expected object or null, but got number",
 	}
 	for _, e := range expected {
 		assert.Contains(t, err.Error(), e)
 	}
 
 	// Test success
-	proj, err := writeAndLoad("{\"name\": \"project\", \"runtime\": \"test\"}")
+	proj, err := writeAndLoad("{\"name\": \"project\", \"runtime\": \"nodejs\"}")
 	assert.NoError(t, err)
 	assert.Equal(t, tokens.PackageName("project"), proj.Name)
-	assert.Equal(t, "test", proj.Runtime.Name())
+	assert.Equal(t, "nodejs", proj.Runtime.Name())
 
 	// Test null optionals should work
-	proj, err = writeAndLoad("{\"name\": \"project\", \"runtime\": \"test\", " +
+	proj, err = writeAndLoad("{\"name\": \"project\", \"runtime\": \"nodejs\", " +
 		"\"description\": null, \"main\": null, \"backend\": null}")
 	assert.NoError(t, err)
 	assert.Nil(t, proj.Description)
@@ -568,6 +696,74 @@ config:
 		"project config 'instanceSize' cannot have both a 'default' and 'value' attribute")
 }
 
+func TestProjectConfigSecretsAreRejected(t *testing.T) {
+	t.Parallel()
+
+	_, err := loadProjectFromText(t, `
+name: test
+runtime: dotnet
+config:
+  dbPassword:
+    type: string
+    secret: true
+    default: hunter2`)
+	assert.ErrorContains(t, err, "project config 'dbPassword' is secret, so it must not have a plaintext 'default' "+
+		"in the project file; set it for each stack with `pulumi config set --secret` instead")
+
+	_, err = loadProjectFromText(t, `
+name: test
+runtime: dotnet
+config:
+  aws:secretKey:
+    secret: true
+    value: hunter2`)
+	assert.ErrorContains(t, err, "project config 'aws:secretKey' is secret, so it must not have a plaintext 'value'")
+
+	_, err = loadProjectFromText(t, `
+name: test
+runtime: dotnet
+config:
+  dbPassword:
+    secure: aGVsbG8=`)
+	assert.ErrorContains(t, err, "project config 'dbPassword' has a secure value, but secrets can't be stored in "+
+		"the project file; set it for each stack with `pulumi config set --secret` instead")
+}
+
+func TestProjectConfigDefaults(t *testing.T) {
+	t.Parallel()
+
+	proj, err := loadProjectFromText(t, `
+name: test
+runtime: dotnet
+config:
+  instanceSize: t3.micro
+  replicas:
+    type: integer
+    default: 3
+  zones:
+    type: array
+    items:
+      type: string
+    default: [a, b]
+  aws:region:
+    value: us-west-2
+  dbPassword:
+    type: string
+    secret: true
+  required:
+    type: string`)
+	require.NoError(t, err)
+
+	defaults, err := proj.ConfigDefaults()
+	require.NoError(t, err)
+	assert.Equal(t, config.Map{
+		config.MustMakeKey("test", "instanceSize"): config.NewValue("t3.micro"),
+		config.MustMakeKey("test", "replicas"):     config.NewValue("3"),
+		config.MustMakeKey("test", "zones"):        config.NewObjectValue(`["a","b"]`),
+		config.MustMakeKey("aws", "region"):        config.NewValue("us-west-2"),
+	}, defaults)
+}
+
 func TestProjectConfigCannotBeTypedArrayWithoutItems(t *testing.T) {
 	t.Parallel()
 	projectYaml := `
@@ -911,7 +1107,7 @@ func TestProjectLoadYAML(t *testing.T) {
 		assert.Contains(t, err.Error(), e)
 	}
 
-	_, err = loadProjectFromText(t, "name: project\nruntime: test\nbackend: 4\nmain: {}")
+	_, err = loadProjectFromText(t, "name: project\nruntime: nodejs\nbackend: 4\nmain: {}")
 	expected = []string{
 		"2 errors occurred:",
 		"* #/main: expected string or null, but got object",
@@ -922,18 +1118,35 @@ func TestProjectLoadYAML(t *testing.T) {
 	}
 
 	// Test success
-	proj, err := loadProjectFromText(t, "name: project\nruntime: test")
+	proj, err := loadProjectFromText(t, "name: project\nruntime: nodejs")
 	assert.NoError(t, err)
 	assert.Equal(t, tokens.PackageName("project"), proj.Name)
-	assert.Equal(t, "test", proj.Runtime.Name())
+	assert.Equal(t, "nodejs", proj.Runtime.Name())
 
 	// Test null optionals should work
-	proj, err = loadProjectFromText(t, "name: project\nruntime: test\ndescription:\nmain: null\nbackend:\n")
+	proj, err = loadProjectFromText(t, "name: project\nruntime: nodejs\ndescription:\nmain: null\nbackend:\n")
 	assert.NoError(t, err)
 	assert.Nil(t, proj.Description)
 	assert.Equal(t, "", proj.Main)
 }
 
+func TestProjectLoadYAMLDuplicateKeys(t *testing.T) {
+	t.Parallel()
+
+	_, err := loadProjectFromText(t, "name: project\nruntime: nodejs\nruntime: python\n")
+	assert.ErrorContains(t, err, "duplicate key 'runtime' at line 3; it is already defined at line 2")
+
+	_, err = loadProjectFromText(t, "name: project\nruntime: nodejs\nconfig:\n  project:size: small\n"+
+		"  project:region: us-west-2\n  project:size: large\n")
+	assert.ErrorContains(t, err, "duplicate key 'project:size' at line 6; it is already defined at line 4")
+
+	// The same key may appear in different mappings, and merge keys may repeat.
+	proj, err := loadProjectFromText(t, "name: project\nruntime:\n  name: nodejs\n  options:\n"+
+		"    name: typescript\nbase: &base\n  project:size: small\nconfig:\n  <<: *base\n  project:size: large\n")
+	require.NoError(t, err)
+	assert.Equal(t, "nodejs", proj.Runtime.Name())
+}
+
 func TestProjectSaveLoadRoundtrip(t *testing.T) {
 	t.Parallel()
 
@@ -1032,3 +1245,2307 @@ func TestProjectEditRoundtrip(t *testing.T) {
 		})
 	}
 }
+
+// writeSymlinkedProject writes a shared project file and a Pulumi.yaml that links to it, returning both paths.
+func writeSymlinkedProject(t *testing.T) (string, string) {
+	if runtime.GOOS == "windows" {
+		t.Skip("creating symbolic links requires elevated privileges on Windows")
+	}
+
+	dir := t.TempDir()
+	target := filepath.Join(dir, "shared.yaml")
+	err := os.WriteFile(target, []byte("name: shared\nruntime: nodejs\n"), 0o600)
+	require.NoError(t, err)
+
+	link := filepath.Join(dir, "Pulumi.yaml")
+	err = os.Symlink(target, link)
+	require.NoError(t, err)
+	return target, link
+}
+
+func TestProjectLoadThroughSymlink(t *testing.T) {
+	t.Parallel()
+
+	target, link := writeSymlinkedProject(t)
+
+	proj, err := LoadProject(link)
+	require.NoError(t, err)
+	assert.Equal(t, tokens.PackageName("shared"), proj.Name)
+	assert.True(t, proj.SourceIsSymlink())
+
+	proj, err = LoadProject(target)
+	require.NoError(t, err)
+	assert.False(t, proj.SourceIsSymlink())
+}
+
+func TestProjectSaveThroughSymlink(t *testing.T) {
+	t.Parallel()
+
+	target, link := writeSymlinkedProject(t)
+
+	proj, err := LoadProject(link)
+	require.NoError(t, err)
+	proj.Name = "renamed"
+	err = proj.SaveWithOptions(link, ProjectSaveOptions{})
+	require.NoError(t, err)
+
+	// The link is kept and the shared file is updated.
+	info, err := os.Lstat(link)
+	require.NoError(t, err)
+	assert.True(t, info.Mode()&os.ModeSymlink != 0)
+	shared, err := os.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, "name: renamed\nruntime: nodejs\n", string(shared))
+}
+
+func TestProjectSaveReplacingSymlink(t *testing.T) {
+	t.Parallel()
+
+	target, link := writeSymlinkedProject(t)
+
+	proj, err := LoadProject(link)
+	require.NoError(t, err)
+	proj.Name = "renamed"
+	err = proj.SaveWithOptions(link, ProjectSaveOptions{ReplaceSymlink: true})
+	require.NoError(t, err)
+
+	// The link is replaced by a regular file and the shared file is left alone.
+	info, err := os.Lstat(link)
+	require.NoError(t, err)
+	assert.True(t, info.Mode().IsRegular())
+	local, err := os.ReadFile(link)
+	require.NoError(t, err)
+	assert.Equal(t, "name: renamed\nruntime: nodejs\n", string(local))
+	shared, err := os.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, "name: shared\nruntime: nodejs\n", string(shared))
+}
+
+// failingWriteFS is a workspaceFS whose temporary files can't be created.
+type failingWriteFS struct {
+	osFS
+}
+
+func (failingWriteFS) CreateTemp(dir, pattern string) (workspaceFile, error) {
+	return nil, &os.PathError{Op: "open", Path: filepath.Join(dir, pattern), Err: os.ErrPermission}
+}
+
+func TestProjectSaveReplacingSymlinkKeepsLinkOnFailure(t *testing.T) {
+	t.Parallel()
+
+	target, link := writeSymlinkedProject(t)
+
+	proj, err := LoadProject(link)
+	require.NoError(t, err)
+	proj.Name = "renamed"
+	err = saveTo(failingWriteFS{}, link, proj, false /*mkDirAll*/, true /*replaceSymlink*/)
+	assert.ErrorIs(t, err, os.ErrPermission)
+
+	// The link is only replaced once the new file has been written, so it survives the failed save.
+	info, err := os.Lstat(link)
+	require.NoError(t, err)
+	assert.True(t, info.Mode()&os.ModeSymlink != 0)
+	shared, err := os.ReadFile(target)
+	require.NoError(t, err)
+	assert.Equal(t, "name: shared\nruntime: nodejs\n", string(shared))
+}
+
+// symlinkFS is a workspaceFS that reports every file as a symbolic link.
+type symlinkFS struct {
+	osFS
+}
+
+func (fs symlinkFS) Lstat(name string) (os.FileInfo, error) {
+	info, err := fs.osFS.Lstat(name)
+	if err != nil {
+		return nil, err
+	}
+	return symlinkInfo{info}, nil
+}
+
+type symlinkInfo struct {
+	os.FileInfo
+}
+
+func (symlinkInfo) Mode() os.FileMode { return os.ModeSymlink | 0o777 }
+
+func TestLoadProjectDetectsSymlinkThroughFS(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(writeProjectFiles(t, map[string]string{"Pulumi.yaml": "name: test\nruntime: nodejs\n"}),
+		"Pulumi.yaml")
+	proj, _, err := loadProject(symlinkFS{}, path, LoadOptions{}, false /*allowMissingRuntime*/)
+	require.NoError(t, err)
+	assert.True(t, proj.SourceIsSymlink())
+
+	proj, _, err = loadProject(osFS{}, path, LoadOptions{}, false /*allowMissingRuntime*/)
+	require.NoError(t, err)
+	assert.False(t, proj.SourceIsSymlink())
+}
+
+func TestProjectPlatforms(t *testing.T) {
+	t.Parallel()
+
+	proj, err := loadProjectFromText(t, "name: test\nruntime: nodejs\nplatforms:\n  - linux/amd64\n  - darwin/arm64\n")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"linux/amd64", "darwin/arm64"}, proj.Platforms)
+
+	assert.True(t, proj.SupportsPlatform("linux", "amd64"))
+	assert.True(t, proj.SupportsPlatform("darwin", "arm64"))
+	assert.False(t, proj.SupportsPlatform("darwin", "amd64"))
+	assert.False(t, proj.SupportsPlatform("windows", "amd64"))
+
+	// No platforms means all platforms.
+	proj.Platforms = nil
+	assert.True(t, proj.SupportsPlatform("windows", "amd64"))
+}
+
+func TestProjectPlatformsRoundtrip(t *testing.T) {
+	t.Parallel()
+
+	proj := &Project{
+		Name:      "test",
+		Runtime:   NewProjectRuntimeInfo("go", nil),
+		Platforms: []string{"linux/amd64", "windows/arm64"},
+	}
+
+	path := filepath.Join(t.TempDir(), "Pulumi.yaml")
+	require.NoError(t, proj.Save(path))
+	loaded, err := LoadProject(path)
+	require.NoError(t, err)
+	assert.Equal(t, proj.Platforms, loaded.Platforms)
+}
+
+func TestProjectPlatformsValidation(t *testing.T) {
+	t.Parallel()
+
+	for _, platform := range []string{"linux", "linux/", "/amd64", "linux/amd64/v8", "linux/ amd64"} {
+		proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo("go", nil), Platforms: []string{platform}}
+		err := proj.Validate()
+		assert.ErrorContains(t, err, fmt.Sprintf("invalid platform '%s': expected the form 'os/arch'", platform))
+	}
+
+	_, err := loadProjectFromText(t, "name: test\nruntime: nodejs\nplatforms: [linux]\n")
+	assert.ErrorContains(t, err, "#/platforms/0: does not match pattern")
+}
+
+func TestProjectPlatformsDuplicates(t *testing.T) {
+	t.Parallel()
+
+	proj := &Project{
+		Name:      "test",
+		Runtime:   NewProjectRuntimeInfo("go", nil),
+		Platforms: []string{"linux/amd64", "darwin/arm64", "linux/amd64"},
+	}
+	assert.EqualError(t, proj.Validate(), "platform 'linux/amd64' is listed more than once")
+
+	proj.Platforms = []string{"linux/amd64", "Linux/AMD64"}
+	assert.EqualError(t, proj.Validate(),
+		"platforms 'linux/amd64' and 'Linux/AMD64' are the same platform; platforms are not case-sensitive")
+
+	proj.Platforms = []string{"Linux/AMD64", "linux/arm64"}
+	assert.NoError(t, proj.Validate())
+}
+
+func TestProjectResolvedMain(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	tests := []struct {
+		main     string
+		expected string
+	}{
+		{main: "", expected: dir},
+		{main: "src", expected: filepath.Join(dir, "src")},
+		{main: "src/index.ts", expected: filepath.Join(dir, "src", "index.ts")},
+		{main: filepath.Join(dir, "elsewhere"), expected: filepath.Join(dir, "elsewhere")},
+	}
+	for _, tt := range tests {
+		proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo("nodejs", nil), Main: tt.main}
+		main, err := proj.ResolvedMain(dir)
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, main)
+	}
+}
+
+//nolint:paralleltest // mutates environment
+func TestProjectResolvedMainExpansion(t *testing.T) {
+	home, err := os.UserHomeDir()
+	require.NoError(t, err)
+	projects := t.TempDir()
+	t.Setenv("PULUMI_TEST_PROJECTS", projects)
+
+	tests := []struct {
+		main     string
+		expected string
+	}{
+		{main: "~", expected: home},
+		{main: "~/shared/program", expected: filepath.Join(home, "shared", "program")},
+		{main: "$PULUMI_TEST_PROJECTS/foo", expected: filepath.Join(projects, "foo")},
+		{main: "${PULUMI_TEST_PROJECTS}/foo/index.ts", expected: filepath.Join(projects, "foo", "index.ts")},
+	}
+	for _, tt := range tests {
+		proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo("nodejs", nil), Main: tt.main}
+		main, err := proj.ResolvedMain(t.TempDir())
+		require.NoError(t, err)
+		assert.Equal(t, tt.expected, main)
+		// The raw value is kept for saving.
+		assert.Equal(t, tt.main, proj.Main)
+	}
+
+	proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo("nodejs", nil), Main: "$PULUMI_TEST_UNDEFINED/foo"}
+	_, err = proj.ResolvedMain(t.TempDir())
+	assert.EqualError(t, err, "main: undefined environment variable 'PULUMI_TEST_UNDEFINED'")
+}
+
+func TestProjectResolvedMainNormalizesSeparators(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for _, main := range []string{`.\src\index.ts`, "./src/index.ts", `src/index.ts`, `src\index.ts`} {
+		proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo("nodejs", nil), Main: main}
+		resolved, err := proj.ResolvedMain(dir)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(dir, "src", "index.ts"), resolved)
+		// The project keeps the value as written.
+		assert.Equal(t, main, proj.Main)
+	}
+}
+
+// writeProjectFiles writes the given files, keyed by path relative to a new temporary directory, and returns the
+// directory.
+func writeProjectFiles(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	}
+	return dir
+}
+
+func TestProjectExtendsInheritsScalars(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"base/Pulumi.yaml": "name: base\nruntime: nodejs\ndescription: Shared description\nauthor: Platform\n",
+		"app/Pulumi.yaml":  "name: app\nextends: ../base/Pulumi.yaml\nauthor: Payments\n",
+	})
+
+	proj, err := LoadProject(filepath.Join(dir, "app", "Pulumi.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, tokens.PackageName("app"), proj.Name)
+	assert.Equal(t, "nodejs", proj.Runtime.Name())
+	require.NotNil(t, proj.Description)
+	assert.Equal(t, "Shared description", *proj.Description)
+	require.NotNil(t, proj.Author)
+	assert.Equal(t, "Payments", *proj.Author)
+	assert.Equal(t, "../base/Pulumi.yaml", proj.Extends)
+}
+
+func TestProjectExtendsMergesMaps(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"base.yaml": `name: base
+runtime:
+  name: nodejs
+  options:
+    typescript: true
+config:
+  aws:region: us-west-2
+  instanceSize: t3.micro
+platforms: [linux/amd64, darwin/arm64]
+`,
+		"Pulumi.yaml": `name: app
+extends: base.yaml
+runtime: python
+config:
+  instanceSize: t3.large
+  replicas: 3
+platforms: [linux/arm64]
+`,
+	})
+
+	proj, err := LoadProject(filepath.Join(dir, "Pulumi.yaml"))
+	require.NoError(t, err)
+
+	// The runtime is replaced as a whole, so no options are inherited.
+	assert.Equal(t, "python", proj.Runtime.Name())
+	assert.Nil(t, proj.Runtime.Options())
+
+	// Config is merged key-by-key.
+	assert.Equal(t, map[string]ProjectConfigType{
+		"aws:region":   {Value: "us-west-2"},
+		"instanceSize": {Default: "t3.large"},
+		"replicas":     {Default: 3},
+	}, proj.Config)
+
+	// Lists are replaced.
+	assert.Equal(t, []string{"linux/arm64"}, proj.Platforms)
+}
+
+func TestProjectExtendsChainAndCycle(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"root.yaml":   "name: root\nruntime: go\nlicense: Apache-2.0\n",
+		"middle.yaml": "name: middle\nextends: root.yaml\nauthor: Platform\n",
+		"Pulumi.yaml": "name: app\nextends: middle.yaml\n",
+		"a.yaml":      "name: a\nruntime: go\nextends: b.yaml\n",
+		"b.yaml":      "name: b\nruntime: go\nextends: a.yaml\n",
+	})
+
+	proj, err := LoadProject(filepath.Join(dir, "Pulumi.yaml"))
+	require.NoError(t, err)
+	assert.Equal(t, "go", proj.Runtime.Name())
+	assert.Equal(t, "Apache-2.0", *proj.License)
+	assert.Equal(t, "Platform", *proj.Author)
+
+	_, err = LoadProject(filepath.Join(dir, "a.yaml"))
+	assert.ErrorContains(t, err, "'extends' cycle detected")
+}
+
+func TestProjectExtendsSaveKeepsInheritedAttributesOut(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"base.yaml": "name: base\nruntime: nodejs\ndescription: Shared description\n" +
+			"config:\n  aws:region: us-west-2\n",
+		"Pulumi.yaml": "# The app project.\nname: child\nextends: base.yaml\nconfig:\n  replicas:\n    default: 3\n",
+		"Pulumi.json": `{"name": "child", "extends": "base.yaml", "author": "Payments"}`,
+	})
+
+	// Saving a project without changing it leaves its file as it was.
+	path := filepath.Join(dir, "Pulumi.yaml")
+	proj, err := LoadProject(path)
+	require.NoError(t, err)
+	require.NoError(t, proj.Save(path))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "# The app project.\nname: child\nextends: base.yaml\nconfig:\n  replicas:\n    default: 3\n",
+		string(b))
+
+	jsonPath := filepath.Join(dir, "Pulumi.json")
+	jsonProj, err := LoadProject(jsonPath)
+	require.NoError(t, err)
+	require.NoError(t, jsonProj.Save(jsonPath))
+	b, err = os.ReadFile(jsonPath)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(b),
+		"{\n    \"name\": \"child\",\n    \"extends\": \"base.yaml\",\n    \"author\": \"Payments\""), string(b))
+	assert.NotContains(t, string(b), "runtime")
+	assert.NotContains(t, string(b), "config")
+
+	// Inherited attributes that were changed are saved, and the rest keep following the parent.
+	description := "App description"
+	proj.Description = &description
+	require.NoError(t, proj.Save(path))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "base.yaml"),
+		[]byte("name: base\nruntime: python\nconfig:\n  aws:region: eu-west-1\n"), 0o600))
+
+	reloaded, err := LoadProject(path)
+	require.NoError(t, err)
+	assert.Equal(t, "python", reloaded.Runtime.Name())
+	require.NotNil(t, reloaded.Description)
+	assert.Equal(t, "App description", *reloaded.Description)
+	assert.Equal(t, "eu-west-1", reloaded.Config["aws:region"].Value)
+	assert.Equal(t, 3, reloaded.Config["replicas"].Default)
+
+	jsonReloaded, err := LoadProject(jsonPath)
+	require.NoError(t, err)
+	assert.Equal(t, "python", jsonReloaded.Runtime.Name())
+	assert.Nil(t, jsonReloaded.Description)
+}
+
+func TestProjectMatchSource(t *testing.T) {
+	t.Parallel()
+
+	proj, err := loadProjectFromText(t, `name: test
+runtime: nodejs
+include:
+  - src
+  - "*.json"
+exclude:
+  - "*.test.ts"
+  - src/generated
+`)
+	require.NoError(t, err)
+
+	tests := []struct {
+		path     string
+		expected bool
+	}{
+		{path: "src/index.ts", expected: true},
+		{path: "src/lib/util.ts", expected: true},
+		{path: "package.json", expected: true},
+		{path: "config/settings.json", expected: true},
+		{path: "README.md", expected: false},
+		// Excludes win over includes.
+		{path: "src/index.test.ts", expected: false},
+		{path: "src/generated/types.ts", expected: false},
+		{path: "./src/other.ts", expected: true},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.expected, proj.MatchSource(tt.path), tt.path)
+	}
+
+	// Without includes everything not excluded is part of the source.
+	proj.Include = nil
+	assert.True(t, proj.MatchSource("README.md"))
+	assert.False(t, proj.MatchSource("test/app.test.ts"))
+}
+
+func TestProjectIncludeExcludeRoundtrip(t *testing.T) {
+	t.Parallel()
+
+	proj := &Project{
+		Name:    "test",
+		Runtime: NewProjectRuntimeInfo("nodejs", nil),
+		Include: []string{"src", "*.json"},
+		Exclude: []string{"**/*.test.ts"},
+	}
+
+	path := filepath.Join(t.TempDir(), "Pulumi.yaml")
+	require.NoError(t, proj.Save(path))
+	loaded, err := LoadProject(path)
+	require.NoError(t, err)
+	assert.Equal(t, proj.Include, loaded.Include)
+	assert.Equal(t, proj.Exclude, loaded.Exclude)
+}
+
+func TestProjectIncludeExcludeValidation(t *testing.T) {
+	t.Parallel()
+
+	proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo("nodejs", nil), Include: []string{"src/["}}
+	assert.ErrorContains(t, proj.Validate(), "project 'include' pattern 'src/[' is invalid")
+
+	proj = &Project{Name: "test", Runtime: NewProjectRuntimeInfo("nodejs", nil), Exclude: []string{""}}
+	assert.ErrorContains(t, proj.Validate(), "project 'exclude' patterns must not be empty")
+
+	_, err := loadProjectFromText(t, "name: test\nruntime: nodejs\nexclude: [\"\"]\n")
+	assert.ErrorContains(t, err, "#/exclude/0: length must be >= 1")
+}
+
+func TestProjectExpandRuntime(t *testing.T) {
+	t.Parallel()
+
+	t.Run("string form", func(t *testing.T) {
+		t.Parallel()
+
+		proj, err := loadProjectFromText(t, "name: test\nruntime: nodejs\n")
+		require.NoError(t, err)
+		assert.Nil(t, proj.Runtime.Options())
+
+		proj.ExpandRuntime()
+		assert.Equal(t, "nodejs", proj.Runtime.Name())
+		assert.Equal(t, map[string]interface{}{}, proj.Runtime.Options())
+
+		// The runtime is saved in the object form even before any options are added.
+		path := filepath.Join(t.TempDir(), "Pulumi.yaml")
+		require.NoError(t, proj.Save(path))
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "name: test\nruntime:\n  name: nodejs\n", string(b))
+
+		proj.Runtime.Options()["typescript"] = false
+		require.NoError(t, proj.Save(path))
+		loaded, err := LoadProject(path)
+		require.NoError(t, err)
+		assert.Equal(t, map[string]interface{}{"typescript": false}, loaded.Runtime.Options())
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(writeProjectFiles(t, map[string]string{
+			"Pulumi.json": `{"name": "test", "runtime": "nodejs"}`,
+		}), "Pulumi.json")
+		proj, err := LoadProject(path)
+		require.NoError(t, err)
+
+		proj.ExpandRuntime()
+		require.NoError(t, proj.Save(path))
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		var saved map[string]interface{}
+		require.NoError(t, json.Unmarshal(b, &saved))
+		assert.Equal(t, map[string]interface{}{"name": "nodejs"}, saved["runtime"])
+	})
+
+	t.Run("object form without options", func(t *testing.T) {
+		t.Parallel()
+
+		path := filepath.Join(writeProjectFiles(t, map[string]string{
+			"Pulumi.yaml": "name: test\nruntime:\n  name: nodejs\n",
+		}), "Pulumi.yaml")
+		proj, err := LoadProject(path)
+		require.NoError(t, err)
+
+		// The object form is kept when the project is saved again.
+		require.NoError(t, proj.Save(path))
+		b, err := os.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "name: test\nruntime:\n  name: nodejs\n", string(b))
+	})
+
+	t.Run("object form", func(t *testing.T) {
+		t.Parallel()
+
+		proj, err := loadProjectFromText(t, "name: test\nruntime:\n  name: nodejs\n  options:\n    typescript: false\n")
+		require.NoError(t, err)
+
+		proj.ExpandRuntime()
+		assert.Equal(t, "nodejs", proj.Runtime.Name())
+		assert.Equal(t, map[string]interface{}{"typescript": false}, proj.Runtime.Options())
+	})
+}
+
+func TestProjectLoadJSONTrailingContent(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "Pulumi.json")
+
+	require.NoError(t, os.WriteFile(path, []byte("{\"name\": \"test\", \"runtime\": \"nodejs\"}\n\n"), 0o600))
+	proj, err := LoadProject(path)
+	require.NoError(t, err)
+	assert.Equal(t, tokens.PackageName("test"), proj.Name)
+
+	for _, trailing := range []string{"garbage", "{}", "}"} {
+		content := "{\"name\": \"test\", \"runtime\": \"nodejs\"}\n" + trailing
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err = LoadProject(path)
+		assert.ErrorContains(t, err, "unexpected trailing content in project file", trailing)
+	}
+}
+
+func TestProjectLoadJSONLeadingDocumentSeparator(t *testing.T) {
+	t.Parallel()
+
+	for _, content := range []string{
+		"---\n{\"name\": \"test\", \"runtime\": \"nodejs\"}\n",
+		"--- \r\n\n  {\"name\": \"test\", \"runtime\": \"nodejs\"}\n",
+	} {
+		path := filepath.Join(t.TempDir(), "Pulumi.json")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		proj, err := LoadProject(path)
+		require.NoError(t, err, content)
+		assert.Equal(t, tokens.PackageName("test"), proj.Name)
+	}
+
+	// Errors after the separator are still reported at their position in the file.
+	path := filepath.Join(t.TempDir(), "Pulumi.json")
+	require.NoError(t, os.WriteFile(path, []byte("---\n{\"name\": @}\n"), 0o600))
+	_, err := LoadProject(path)
+	var posErr *JSONPositionError
+	require.ErrorAs(t, err, &posErr)
+	assert.Equal(t, 2, posErr.Line)
+	assert.Equal(t, 10, posErr.Column)
+
+	for _, content := range []string{
+		"---\nname: test\nruntime: nodejs\n",
+		"--- {\"name\": \"test\", \"runtime\": \"nodejs\"}\n",
+		"---\n",
+	} {
+		require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err := LoadProject(path)
+		assert.ErrorIs(t, err, errMixedProjectFormat, content)
+	}
+}
+
+func TestProjectLoadJSONErrorPosition(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		content string
+		line    int
+		column  int
+		message string
+	}{
+		{
+			name:    "Syntax",
+			content: "{\n  \"name\": \"test\",\n  \"runtime\": @\n}\n",
+			line:    3,
+			column:  14,
+			message: "invalid character '@' looking for beginning of value",
+		},
+		{
+			name:    "TrailingContent",
+			content: "{\"name\": \"test\", \"runtime\": \"nodejs\"}\n\n  garbage",
+			line:    3,
+			column:  3,
+			message: "unexpected trailing content in project file",
+		},
+		{
+			name:    "NameType",
+			content: "{\n  \"name\": 42,\n  \"runtime\": \"nodejs\"\n}\n",
+			line:    2,
+			column:  12,
+			message: "project is missing a non-empty string 'name' attribute",
+		},
+		{
+			name:    "SchemaType",
+			content: "{\n  \"name\": \"test\",\n  \"runtime\": \"nodejs\",\n  \"description\": [\"test\"]\n}\n",
+			line:    4,
+			column:  18,
+			message: "#/description: expected string or null, but got array",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			path := filepath.Join(t.TempDir(), "Pulumi.json")
+			require.NoError(t, os.WriteFile(path, []byte(tt.content), 0o600))
+			_, err := LoadProject(path)
+
+			var posErr *JSONPositionError
+			require.ErrorAs(t, err, &posErr)
+			assert.Equal(t, tt.line, posErr.Line)
+			assert.Equal(t, tt.column, posErr.Column)
+			assert.ErrorContains(t, err, fmt.Sprintf("line %d, column %d: %s", tt.line, tt.column, tt.message))
+		})
+	}
+}
+
+func TestProjectLoadJSONRuntimeOptionErrorPosition(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "Pulumi.json")
+	content := "{\"name\": \"test\", \"runtime\": {\"name\": \"go\", \"options\": {\n  \"binary\": true}}}\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	_, err := LoadProjectWithRuntimeSpecs(path, nil)
+	assert.ErrorContains(t, err, "line 1, column 55: #/runtime/options: doesn't validate")
+	assert.ErrorContains(t, err, "line 2, column 16: #/runtime/options/binary: expected string, but got boolean")
+}
+
+func TestJSONTypeErrorPosition(t *testing.T) {
+	t.Parallel()
+
+	var v struct {
+		Name string `json:"name"`
+	}
+	err := unmarshalProjectDocument(encoding.JSON, []byte("{\n  \"name\": 42\n}"), &v)
+
+	var posErr *JSONPositionError
+	require.ErrorAs(t, err, &posErr)
+	// Type errors are reported at the last byte of the offending value.
+	assert.Equal(t, 2, posErr.Line)
+	assert.Equal(t, 12, posErr.Column)
+	var typeErr *json.UnmarshalTypeError
+	assert.ErrorAs(t, err, &typeErr)
+}
+
+func TestProjectRuntimeOptionsDepth(t *testing.T) {
+	t.Parallel()
+
+	nested := func(depth int) string {
+		var sb strings.Builder
+		sb.WriteString("name: test\nruntime:\n  name: nodejs\n  options:\n")
+		indent := "    "
+		for i := 1; i < depth; i++ {
+			fmt.Fprintf(&sb, "%slevel%d:\n", indent, i)
+			indent += "  "
+		}
+		fmt.Fprintf(&sb, "%sleaf: true\n", indent)
+		return sb.String()
+	}
+
+	_, err := loadProjectFromText(t, nested(MaxRuntimeOptionsDepth))
+	assert.NoError(t, err)
+
+	_, err = loadProjectFromText(t, nested(MaxRuntimeOptionsDepth+1))
+	assert.ErrorContains(t, err, "runtime options are nested more than 32 levels deep")
+
+	_, err = loadProjectFromText(t, nested(1000))
+	assert.ErrorContains(t, err, "runtime options are nested more than 32 levels deep")
+}
+
+func TestValidateUniqueNames(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"services/api/Pulumi.yaml":    "name: api\nruntime: nodejs\n",
+		"services/worker/Pulumi.yaml": "name: api\nruntime: go\n",
+		"services/web/Pulumi.yaml":    "name: web\nruntime: nodejs\n",
+	})
+	api := filepath.Join(dir, "services", "api", "Pulumi.yaml")
+	worker := filepath.Join(dir, "services", "worker", "Pulumi.yaml")
+	web := filepath.Join(dir, "services", "web", "Pulumi.yaml")
+
+	assert.NoError(t, ValidateUniqueNames([]string{api, web}))
+
+	err := ValidateUniqueNames([]string{api, worker, web})
+	assert.ErrorContains(t, err,
+		fmt.Sprintf("project name 'api' is used by multiple projects: %v, %v", api, worker))
+	assert.NotContains(t, err.Error(), "'web'")
+
+	err = ValidateUniqueNames([]string{api, filepath.Join(dir, "missing", "Pulumi.yaml")})
+	assert.ErrorContains(t, err, "could not read")
+}
+
+func TestLoadProjectForScaffold(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"no-runtime/Pulumi.yaml":   "name: scaffold\ndescription: A new project\n",
+		"with-runtime/Pulumi.yaml": "name: scaffold\nruntime: python\n",
+		"no-name/Pulumi.yaml":      "description: A new project\n",
+		"bad-config/Pulumi.yaml":   "name: scaffold\nconfig:\n  scaffold:size:\n    type: integer\n    default: big\n",
+		"placeholder/Pulumi.yaml":  "name: scaffold\nruntime: scaffold\n",
+	})
+
+	proj, needsRuntime, err := LoadProjectForScaffold(filepath.Join(dir, "no-runtime", "Pulumi.yaml"))
+	require.NoError(t, err)
+	assert.True(t, needsRuntime)
+	assert.Equal(t, tokens.PackageName("scaffold"), proj.Name)
+	assert.Equal(t, "A new project", *proj.Description)
+	assert.Equal(t, "", proj.Runtime.Name())
+	assert.Nil(t, proj.Runtime.Options())
+
+	proj, needsRuntime, err = LoadProjectForScaffold(filepath.Join(dir, "with-runtime", "Pulumi.yaml"))
+	require.NoError(t, err)
+	assert.False(t, needsRuntime)
+	assert.Equal(t, "python", proj.Runtime.Name())
+
+	// Other problems are still reported.
+	_, _, err = LoadProjectForScaffold(filepath.Join(dir, "no-name", "Pulumi.yaml"))
+	assert.ErrorContains(t, err, "project is missing a 'name' attribute")
+	_, _, err = LoadProjectForScaffold(filepath.Join(dir, "bad-config", "Pulumi.yaml"))
+	assert.ErrorContains(t, err, "is not of the expected type")
+
+	// The regular loader still requires a runtime.
+	_, err = LoadProject(filepath.Join(dir, "no-runtime", "Pulumi.yaml"))
+	assert.ErrorContains(t, err, "project is missing a 'runtime' attribute")
+
+	// The placeholder that stands in for the missing runtime isn't a runtime users can write.
+	_, _, err = LoadProjectForScaffold(filepath.Join(dir, "placeholder", "Pulumi.yaml"))
+	assert.ErrorContains(t, err, "unknown runtime 'scaffold'")
+	_, err = LoadProject(filepath.Join(dir, "placeholder", "Pulumi.yaml"))
+	assert.ErrorContains(t, err, "unknown runtime 'scaffold'")
+	assert.ErrorContains(t, (&Project{Name: "scaffold", Runtime: NewProjectRuntimeInfo("scaffold", nil)}).Validate(),
+		"unknown runtime 'scaffold'")
+}
+
+func TestLoadProjectBytes(t *testing.T) {
+	t.Parallel()
+
+	yamlProj, err := LoadProjectBytes([]byte("\ufeffname: bytes\nruntime: go\nmain: src/\n"), ProjectFormatYAML)
+	require.NoError(t, err)
+	assert.Equal(t, tokens.PackageName("bytes"), yamlProj.Name)
+	assert.Equal(t, "go", yamlProj.Runtime.Name())
+	assert.Equal(t, "src/", yamlProj.Main)
+
+	jsonProj, err := LoadProjectBytes(
+		[]byte(`{"name": "bytes", "runtime": {"name": "nodejs", "options": {"typescript": false}}}`), ProjectFormatJSON)
+	require.NoError(t, err)
+	assert.Equal(t, tokens.PackageName("bytes"), jsonProj.Name)
+	assert.Equal(t, "nodejs", jsonProj.Runtime.Name())
+	assert.Equal(t, false, jsonProj.Runtime.Options()["typescript"])
+
+	// The project is validated as if it were loaded from a file.
+	_, err = LoadProjectBytes([]byte("name: bytes\n"), ProjectFormatYAML)
+	assert.ErrorContains(t, err, "could not validate project: ")
+	assert.ErrorContains(t, err, "project is missing a 'runtime' attribute")
+	_, err = LoadProjectBytes([]byte(`{"name": "bytes"`), ProjectFormatJSON)
+	assert.ErrorContains(t, err, "could not unmarshal project: ")
+
+	// There is no file to resolve `extends` against.
+	_, err = LoadProjectBytes([]byte("name: bytes\nruntime: go\nextends: ../Pulumi.yaml\n"), ProjectFormatYAML)
+	assert.ErrorContains(t, err, "'extends' is not supported for a project that isn't loaded from a file")
+
+	_, err = LoadProjectBytes([]byte("name: bytes\nruntime: go\n"), ProjectFormat("toml"))
+	assert.EqualError(t, err, "unknown project format 'toml'")
+}
+
+func TestProjectValidateForRegistry(t *testing.T) {
+	t.Parallel()
+
+	proj, err := loadProjectFromText(t, "name: test\nruntime: nodejs\ndescription: \"  \"\n")
+	require.NoError(t, err)
+	err = proj.ValidateForRegistry()
+	assert.ErrorContains(t, err, "project is missing a 'description', which the registry requires")
+	assert.ErrorContains(t, err, "project is missing an 'author', which the registry requires")
+
+	// Ordinary validation failures are reported alongside the registry requirements.
+	proj.Runtime = ProjectRuntimeInfo{}
+	err = proj.ValidateForRegistry()
+	assert.ErrorContains(t, err, "project is missing a 'runtime' attribute")
+	assert.ErrorContains(t, err, "project is missing an 'author', which the registry requires")
+
+	proj, err = loadProjectFromText(t, "name: test\nruntime: nodejs\ndescription: A test\nauthor: Pulumi\n")
+	require.NoError(t, err)
+	assert.NoError(t, proj.ValidateForRegistry())
+}
+
+func TestProjectTemplateConfigReferences(t *testing.T) {
+	t.Parallel()
+
+	template := func(config string) string {
+		return "name: test\nruntime: nodejs\ntemplate:\n  config:\n" + config
+	}
+
+	proj, err := loadProjectFromText(t, template(`    aws:region:
+      default: us-west-2
+    bucketName:
+      default: ${aws:region}-${prefix}-bucket
+    prefix:
+      default: demo
+`))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"aws:region", "prefix"}, proj.Template.Config["bucketName"].TemplateConfigReferences())
+
+	_, err = loadProjectFromText(t, template(`    bucketName:
+      default: ${prefix}-bucket
+`))
+	assert.ErrorContains(t, err, "template config 'bucketName' default references unknown config 'prefix'")
+
+	_, err = loadProjectFromText(t, template(`    a:
+      default: ${b}
+    b:
+      default: ${c}
+    c:
+      default: ${a}
+    d:
+      default: ${a}
+`))
+	assert.ErrorContains(t, err, "template config defaults form a cycle: a -> b -> c -> a")
+
+	_, err = loadProjectFromText(t, template(`    a:
+      default: x${a}
+`))
+	assert.ErrorContains(t, err, "template config defaults form a cycle: a -> a")
+}
+
+func TestProjectTemplateSecretDefaults(t *testing.T) {
+	t.Parallel()
+
+	template := func(config string) string {
+		return "name: test\nruntime: nodejs\ntemplate:\n  config:\n" + config
+	}
+
+	proj, err := loadProjectFromText(t, template(`    apiToken:
+      secret: true
+      default: ${env:API_TOKEN}
+    password:
+      secret: true
+`))
+	require.NoError(t, err)
+	assert.True(t, proj.Template.Config["apiToken"].IsSecretSourceReference())
+	assert.Empty(t, proj.Template.Config["apiToken"].TemplateConfigReferences())
+	assert.Empty(t, proj.Lint(), "Validate checks secret defaults, so Lint doesn't repeat the check")
+
+	for _, def := range []string{"hunter2", "${env:API_TOKEN}-suffix", "${password}"} {
+		_, err = loadProjectFromText(t, template(`    password:
+      secret: true
+    apiToken:
+      secret: true
+      default: "`+def+`"
+`))
+		assert.ErrorContains(t, err, "template config 'apiToken' is secret, so its default must reference a secret "+
+			"source, such as `${env:NAME}`, rather than hold a literal value", def)
+	}
+}
+
+//nolint:paralleltest // mutates SecretTemplateDefaultPatterns
+func TestProjectTemplateSecretDefaultPatterns(t *testing.T) {
+	original := SecretTemplateDefaultPatterns
+	t.Cleanup(func() { SecretTemplateDefaultPatterns = original })
+	SecretTemplateDefaultPatterns = append(SecretTemplateDefaultPatterns, regexp.MustCompile(`^\$\{vault:[a-z/]+\}$`))
+
+	proj := &Project{
+		Name:    "test",
+		Runtime: NewProjectRuntimeInfo("nodejs", nil),
+		Template: &ProjectTemplate{Config: map[string]ProjectTemplateConfigValue{
+			"apiToken": {Secret: true, Default: "${vault:secret/api}"},
+		}},
+	}
+	assert.NoError(t, proj.Validate())
+
+	SecretTemplateDefaultPatterns = nil
+	assert.ErrorContains(t, proj.Validate(), "template config 'apiToken' is secret")
+}
+
+func TestProjectWithDefaultsOmitsDefaultedOptions(t *testing.T) {
+	t.Parallel()
+
+	proj, err := loadProjectFromText(t, "name: test\nruntime: nodejs\n")
+	require.NoError(t, err)
+
+	withDefaults := proj.WithDefaults()
+	assert.Equal(t, true, withDefaults.Runtime.Options()["typescript"])
+	assert.True(t, withDefaults.Runtime.OptionIsDefaulted("typescript"))
+	assert.Nil(t, proj.Runtime.Options(), "the original project should be unchanged")
+
+	// The defaulted option isn't written out.
+	path := filepath.Join(t.TempDir(), "Pulumi.yaml")
+	require.NoError(t, withDefaults.Save(path))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "name: test\nruntime: nodejs\n", string(b))
+
+	// Setting the option explicitly, even to its default value, means it is written out.
+	withDefaults.Runtime.SetOption("typescript", true)
+	assert.False(t, withDefaults.Runtime.OptionIsDefaulted("typescript"))
+	require.NoError(t, withDefaults.Save(path))
+	loaded, err := LoadProject(path)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"typescript": true}, loaded.Runtime.Options())
+}
+
+func TestProjectWithDefaultsKeepsExplicitOptions(t *testing.T) {
+	t.Parallel()
+
+	proj, err := loadProjectFromText(t, "name: test\nruntime:\n  name: nodejs\n  options:\n    typescript: false\n")
+	require.NoError(t, err)
+
+	withDefaults := proj.WithDefaults()
+	assert.Equal(t, false, withDefaults.Runtime.Options()["typescript"])
+	assert.False(t, withDefaults.Runtime.OptionIsDefaulted("typescript"))
+
+	b, err := json.Marshal(withDefaults.Runtime)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"name": "nodejs", "options": {"typescript": false}}`, string(b))
+}
+
+// permissionDeniedFS is a workspaceFS whose files can't be read.
+type permissionDeniedFS struct {
+	osFS
+}
+
+func (permissionDeniedFS) ReadFile(name string) ([]byte, error) {
+	return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrPermission}
+}
+
+func TestLoadProjectPermissionDenied(t *testing.T) {
+	t.Parallel()
+
+	path := filepath.Join(t.TempDir(), "Pulumi.yaml")
+	_, _, err := loadProject(permissionDeniedFS{}, path, LoadOptions{}, false /*allowMissingRuntime*/)
+	assert.ErrorContains(t, err,
+		fmt.Sprintf("cannot read project file at %s: permission denied; check file permissions", path))
+	assert.ErrorIs(t, err, os.ErrPermission)
+
+	var pathErr *os.PathError
+	assert.ErrorAs(t, err, &pathErr)
+}
+
+func TestProjectValidateMainWithinProject(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	for _, main := range []string{"", ".", "src", "src/../index.ts", "..foo/index.ts", filepath.Join(dir, "src")} {
+		proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo("nodejs", nil), Main: main}
+		assert.NoError(t, proj.ValidateMainWithinProject(dir), main)
+	}
+
+	for _, main := range []string{"..", "../other", "src/../../other", `..\..\etc\passwd`, filepath.Dir(dir)} {
+		proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo("nodejs", nil), Main: main}
+		err := proj.ValidateMainWithinProject(dir)
+		assert.ErrorContains(t, err, fmt.Sprintf("main '%v' resolves to", main))
+		assert.ErrorContains(t, err, fmt.Sprintf("which is outside of the project directory '%v'", dir))
+	}
+}
+
+func TestProjectResolveMain(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo("nodejs", nil)}
+	main, err := proj.ResolveMain(dir)
+	require.NoError(t, err)
+	assert.Equal(t, dir, main)
+
+	proj.Main = "src/app"
+	main, err = proj.ResolveMain(dir)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "src", "app"), main)
+
+	proj.Main = "src/../../other"
+	_, err = proj.ResolveMain(dir)
+	assert.EqualError(t, err, fmt.Sprintf("main 'src/../../other' resolves to '%v', which is outside of the "+
+		"project directory '%v'", filepath.Join(filepath.Dir(dir), "other"), dir))
+}
+
+func TestProjectValidateEntrypointPython(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"app/__main__.py": "import pulumi\n",
+		"lib/helpers.py":  "",
+		"program.py":      "import pulumi\n",
+	})
+	proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo("python", nil)}
+
+	for _, main := range []string{"app", "program.py"} {
+		proj.Main = main
+		assert.NoError(t, proj.ValidateEntrypoint(dir), main)
+	}
+
+	proj.Main = "lib"
+	err := proj.ValidateEntrypoint(dir)
+	assert.EqualError(t, err, fmt.Sprintf("python runtime expects __main__.py or a main module in '%v'; "+
+		"add a __main__.py, or set main to the program's module", filepath.Join(dir, "lib")))
+
+	proj.Main = "missing.py"
+	err = proj.ValidateEntrypoint(dir)
+	assert.EqualError(t, err, fmt.Sprintf("main 'missing.py' resolves to '%v', which does not exist",
+		filepath.Join(dir, "missing.py")))
+}
+
+func TestProjectValidateEntrypointNodeJS(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"index/index.ts":           "",
+		"pkg-main/package.json":    `{"main": "bin/app"}`,
+		"pkg-main/bin/app.js":      "",
+		"pkg-dir/package.json":     `{"main": "./dist"}`,
+		"pkg-dir/dist/index.js":    "",
+		"pkg-index/package.json":   `{"name": "app"}`,
+		"pkg-index/index.js":       "",
+		"bad-main/package.json":    `{"main": "bin/app.js"}`,
+		"bad-main/index.js":        "",
+		"no-index/package.json":    `{"name": "app"}`,
+		"bad-package/package.json": `{"main": `,
+		"empty/.keep":              "",
+	})
+	proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo("nodejs", nil)}
+
+	for _, main := range []string{"index", "pkg-main", "pkg-dir", "pkg-index", "pkg-main/bin/app.js"} {
+		proj.Main = main
+		assert.NoError(t, proj.ValidateEntrypoint(dir), main)
+	}
+
+	proj.Main = "bad-main"
+	err := proj.ValidateEntrypoint(dir)
+	assert.EqualError(t, err, fmt.Sprintf("nodejs runtime expects the main file 'bin/app.js' named by '%v' to exist",
+		filepath.Join(dir, "bad-main", "package.json")))
+
+	for _, main := range []string{"no-index", "empty"} {
+		proj.Main = main
+		err = proj.ValidateEntrypoint(dir)
+		assert.EqualError(t, err, fmt.Sprintf("nodejs runtime expects an index.js or index.ts in '%v'; add one, "+
+			"or set main in package.json to the program's entry file", filepath.Join(dir, main)))
+	}
+
+	proj.Main = "bad-package"
+	err = proj.ValidateEntrypoint(dir)
+	assert.ErrorContains(t, err, "could not read '"+filepath.Join(dir, "bad-package", "package.json")+"'")
+}
+
+func TestProjectValidateEntrypointOtherRuntimes(t *testing.T) {
+	t.Parallel()
+
+	// Runtimes without an entry file convention only need main to exist.
+	dir := writeProjectFiles(t, map[string]string{"src/.keep": ""})
+	proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo("go", nil)}
+	assert.NoError(t, proj.ValidateEntrypoint(dir))
+	proj.Main = "src"
+	assert.NoError(t, proj.ValidateEntrypoint(dir))
+	proj.Main = "cmd"
+	assert.ErrorContains(t, proj.ValidateEntrypoint(dir), "which does not exist")
+}
+
+func TestProjectValidateNameMatchesDir(t *testing.T) {
+	t.Parallel()
+
+	proj := &Project{Name: "my-app", Runtime: NewProjectRuntimeInfo("nodejs", nil)}
+	root := t.TempDir()
+	assert.NoError(t, proj.ValidateNameMatchesDir(filepath.Join(root, "my-app", "Pulumi.yaml")))
+	assert.NoError(t, proj.ValidateNameMatchesDir(filepath.Join(root, "other", "..", "my-app", "Pulumi.json")))
+
+	err := proj.ValidateNameMatchesDir(filepath.Join(root, "My-App", "Pulumi.yaml"))
+	assert.EqualError(t, err, "project name 'my-app' does not match the name of its directory 'My-App'")
+	err = proj.ValidateNameMatchesDir(filepath.Join(root, "services", "web", "Pulumi.yaml"))
+	assert.EqualError(t, err, "project name 'my-app' does not match the name of its directory 'web'")
+}
+
+func TestProjectValidateStackConfigTypes(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"Pulumi.yaml": `name: proj
+runtime: nodejs
+config:
+  count:
+    type: integer
+  enabled:
+    type: boolean
+  tags:
+    type: array
+    items:
+      type: string
+  token:
+    type: string
+  untyped: hello
+`,
+		"Pulumi.dev.yaml": `config:
+  proj:count: 3
+  proj:enabled: true
+  proj:tags: [a, b]
+  proj:token:
+    secure: c2VjcmV0
+  proj:untyped: world
+  aws:region: us-west-2
+`,
+		"Pulumi.prod.yaml": `config:
+  proj:count: three
+  proj:enabled: yes
+  proj:tags: [a, 1]
+  proj:extra: value
+  aws:region: us-east-1
+`,
+	})
+	proj, err := LoadProject(filepath.Join(dir, "Pulumi.yaml"))
+	require.NoError(t, err)
+
+	assert.Empty(t, proj.ValidateStackConfigTypes(dir, "dev"))
+	// A stack without a config file has nothing to check.
+	assert.Empty(t, proj.ValidateStackConfigTypes(dir, "staging"))
+
+	errs := proj.ValidateStackConfigTypes(dir, "prod")
+	messages := make([]string, len(errs))
+	for i, err := range errs {
+		messages[i] = err.Error()
+	}
+	assert.Equal(t, []string{
+		"stack 'prod' config key 'proj:count': value 'three' does not coerce to type 'integer'",
+		"stack 'prod' config key 'proj:enabled': value 'yes' does not coerce to type 'boolean'",
+		"stack 'prod' config key 'proj:extra': config not declared by the project",
+		`stack 'prod' config key 'proj:tags': value '["a",1]' does not coerce to type 'array<string>'`,
+	}, messages)
+	assert.NotErrorIs(t, errs[0], ErrUndeclaredStackConfig)
+	assert.ErrorIs(t, errs[2], ErrUndeclaredStackConfig)
+}
+
+func TestProjectCheckEnv(t *testing.T) {
+	t.Parallel()
+
+	proj, err := loadProjectFromText(t,
+		"name: test\nruntime: nodejs\nrequiredEnv:\n  - AWS_REGION\n  - API_TOKEN\n  - DEBUG\n")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"AWS_REGION", "API_TOKEN", "DEBUG"}, proj.RequiredEnv)
+
+	env := func(vars map[string]string) func(string) (string, bool) {
+		return func(name string) (string, bool) {
+			v, ok := vars[name]
+			return v, ok
+		}
+	}
+
+	// Variables that are set to the empty string count as set.
+	assert.NoError(t, proj.CheckEnv(env(map[string]string{"AWS_REGION": "us-west-2", "API_TOKEN": "x", "DEBUG": ""})))
+
+	err = proj.CheckEnv(env(map[string]string{"API_TOKEN": "x"}))
+	assert.EqualError(t, err,
+		"project 'test' requires environment variables that are not set: AWS_REGION, DEBUG")
+
+	// No required variables means nothing to check.
+	proj.RequiredEnv = nil
+	assert.NoError(t, proj.CheckEnv(env(nil)))
+}
+
+func TestProjectRequiredEnvRoundtrip(t *testing.T) {
+	t.Parallel()
+
+	proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo("nodejs", nil), RequiredEnv: []string{"AWS_REGION"}}
+	path := filepath.Join(t.TempDir(), "Pulumi.yaml")
+	require.NoError(t, proj.Save(path))
+	loaded, err := LoadProject(path)
+	require.NoError(t, err)
+	assert.Equal(t, proj.RequiredEnv, loaded.RequiredEnv)
+
+	proj.RequiredEnv = []string{"A=B"}
+	assert.EqualError(t, proj.Validate(), "invalid required environment variable name 'A=B'")
+}
+
+func TestProjectNumericOptionFidelity(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"yaml/Pulumi.yaml": "name: test\nruntime:\n  name: go\n  options:\n" +
+			"    memory: 512\n    big: 9007199254740993\n    ratio: 1.5\n    sizes: [1, 2.5]\n",
+		"json/Pulumi.json": `{"name": "test", "runtime": {"name": "go", "options": ` +
+			`{"memory": 512, "big": 9007199254740993, "ratio": 1.5, "sizes": [1, 2.5]}}}`,
+	})
+
+	expected := map[string]interface{}{
+		"memory": 512,
+		"big":    9007199254740993,
+		"ratio":  1.5,
+		"sizes":  []interface{}{1, 2.5},
+	}
+
+	var outputs []string
+	for _, path := range []string{
+		filepath.Join(dir, "yaml", "Pulumi.yaml"),
+		filepath.Join(dir, "json", "Pulumi.json"),
+	} {
+		proj, err := LoadProject(path)
+		require.NoError(t, err)
+		assert.Equal(t, expected, proj.Runtime.Options(), path)
+		// Drop the original text so that saving doesn't attempt a trivia-preserving edit of it.
+		proj.raw = nil
+
+		// Round-trip through both formats.
+		for _, ext := range []string{".yaml", ".json"} {
+			out := filepath.Join(t.TempDir(), "Pulumi"+ext)
+			require.NoError(t, proj.Save(out))
+			b, err := os.ReadFile(out)
+			require.NoError(t, err)
+			outputs = append(outputs, string(b))
+
+			reloaded, err := LoadProject(out)
+			require.NoError(t, err)
+			assert.Equal(t, expected, reloaded.Runtime.Options(), out)
+		}
+	}
+
+	assert.Contains(t, outputs[0], "    memory: 512\n")
+	assert.Contains(t, outputs[0], "    big: 9007199254740993\n")
+	assert.Equal(t, outputs[0], outputs[2], "YAML output should not depend on the source format")
+	assert.Equal(t, outputs[1], outputs[3], "JSON output should not depend on the source format")
+}
+
+func TestProjectReferencedPaths(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"root.yaml":                         "name: root\nruntime: nodejs\n",
+		"base/Pulumi.yaml":                  "name: base\nextends: ../root.yaml\n",
+		"app/Pulumi.yaml":                   "name: app\nextends: ../base/Pulumi.yaml\n",
+		"app/src/index.ts":                  "",
+		"app/assets/logo.png":               "",
+		"app/plugins/aws/PulumiPlugin.yaml": "runtime: go\n",
+	})
+	appDir := filepath.Join(dir, "app")
+
+	proj, err := LoadProject(filepath.Join(appDir, "Pulumi.yaml"))
+	require.NoError(t, err)
+	proj.Main = "src"
+	proj.Include = []string{"*.ts", "assets"}
+	proj.Plugins = &Plugins{Providers: []PluginOptions{{Name: "aws", Path: "./plugins/aws"}}}
+
+	paths, err := proj.ReferencedPaths(appDir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		filepath.Join("..", "base", "Pulumi.yaml"),
+		filepath.Join("..", "root.yaml"),
+		"assets",
+		filepath.Join("plugins", "aws"),
+		"src",
+		filepath.Join("src", "index.ts"),
+	}, paths)
+
+	proj.Main = "dist/index.js"
+	proj.Include = append(proj.Include, "*.py")
+	_, err = proj.ReferencedPaths(appDir)
+	assert.ErrorContains(t, err, "referenced path '"+filepath.Join(appDir, "dist", "index.js")+"' does not exist")
+	assert.ErrorContains(t, err, "include pattern '*.py' does not match any files")
+
+	paths, err = proj.ReferencedPathsWithOptions(appDir, ReferencedPathsOptions{IncludeMissing: true})
+	require.NoError(t, err)
+	assert.Contains(t, paths, filepath.Join("dist", "index.js"))
+}
+
+func TestProjectResolvePluginVersion(t *testing.T) {
+	t.Parallel()
+
+	proj := &Project{
+		Name:    "test",
+		Runtime: NewProjectRuntimeInfo("nodejs", nil),
+		Plugins: &Plugins{
+			Providers: []PluginOptions{
+				{Name: "aws", Version: ">=5.1.0 <6.0.0", Path: "plugins/aws"},
+				{Name: "gcp", Version: "6.2.0", Path: "plugins/gcp"},
+				{Name: "azure", Path: "plugins/azure"},
+				{Name: "random", Version: ">=4.x.y", Path: "plugins/random"},
+			},
+		},
+	}
+	available := []string{"4.9.0", "5.0.0", "5.1.0", "5.10.2", "6.0.0", "6.2.0"}
+
+	tests := []struct {
+		name     string
+		plugin   string
+		expected string
+		err      string
+	}{
+		{name: "Range", plugin: "aws", expected: "5.10.2"},
+		{name: "Exact", plugin: "gcp", expected: "6.2.0"},
+		{name: "Unversioned", plugin: "azure", expected: "6.2.0"},
+		{
+			name:   "Malformed",
+			plugin: "random",
+			err:    "plugin 'random' has an invalid version range '>=4.x.y'",
+		},
+		{name: "Undeclared", plugin: "kubernetes", err: "project does not declare a plugin named 'kubernetes'"},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			version, err := proj.ResolvePluginVersion(tt.plugin, available)
+			if tt.err != "" {
+				assert.ErrorContains(t, err, tt.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, version)
+		})
+	}
+
+	t.Run("Unsatisfiable", func(t *testing.T) {
+		t.Parallel()
+
+		_, err := proj.ResolvePluginVersion("aws", []string{"4.9.0", "6.0.0"})
+		assert.EqualError(t, err,
+			"no available version of plugin 'aws' satisfies '>=5.1.0 <6.0.0'; available versions: 4.9.0, 6.0.0")
+	})
+}
+
+func TestProjectDuplicatePlugins(t *testing.T) {
+	t.Parallel()
+
+	_, err := loadProjectFromText(t, `name: test
+runtime: nodejs
+plugins:
+  providers:
+    - name: aws
+      version: 5.0.0
+      path: plugins/aws
+    - name: aws
+      version: 6.0.0
+      path: plugins/aws
+`)
+	assert.ErrorContains(t, err, "duplicate plugin 'aws' with versions 5.0.0 and 6.0.0")
+
+	_, err = loadProjectFromText(t, `name: test
+runtime: nodejs
+plugins:
+  analyzers:
+    - name: policy
+      path: policy/v1
+    - name: policy
+      path: policy/v2
+`)
+	assert.ErrorContains(t, err, "duplicate plugin 'policy' with paths policy/v1 and policy/v2")
+
+	// The same name may be used by plugins of different kinds.
+	proj, err := loadProjectFromText(t, `name: test
+runtime: nodejs
+plugins:
+  providers:
+    - name: aws
+      version: 5.0.0
+      path: plugins/aws
+  languages:
+    - name: aws
+      path: plugins/aws-language
+`)
+	require.NoError(t, err)
+	assert.Empty(t, proj.Lint())
+}
+
+func TestProjectWorkingDir(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"Pulumi.yaml":        "name: test\nruntime: nodejs\n",
+		"src/index.ts":       "",
+		"program/bin/run.js": "",
+	})
+	projectFile := filepath.Join(dir, "Pulumi.yaml")
+
+	tests := []struct {
+		name     string
+		main     string
+		expected string
+	}{
+		{name: "Unset", expected: dir},
+		{name: "File", main: "src/index.ts", expected: filepath.Join(dir, "src")},
+		{name: "FileInProjectDir", main: "index.ts", expected: dir},
+		{name: "Directory", main: "program", expected: filepath.Join(dir, "program")},
+		{name: "DirectoryWithSlash", main: "program/bin/", expected: filepath.Join(dir, "program", "bin")},
+		{name: "WindowsSeparators", main: `src\index.ts`, expected: filepath.Join(dir, "src")},
+		{name: "MissingDirectory", main: "dist/", expected: filepath.Join(dir, "dist")},
+		{name: "MissingFile", main: "dist/index.js", expected: filepath.Join(dir, "dist")},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo("nodejs", nil), Main: tt.main}
+			assert.Equal(t, tt.expected, proj.WorkingDir(projectFile))
+		})
+	}
+}
+
+func TestSaveProjectTo(t *testing.T) {
+	t.Parallel()
+
+	for _, ext := range []string{".yaml", ".json"} {
+		ext := ext
+		t.Run(ext, func(t *testing.T) {
+			t.Parallel()
+
+			dir := t.TempDir()
+			path := filepath.Join(dir, "Pulumi"+ext)
+			proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo("nodejs", nil)}
+			require.NoError(t, SaveProjectTo(proj, path))
+
+			proj, err := LoadProject(path)
+			require.NoError(t, err)
+			proj.Name = "renamed"
+			proj.Runtime.SetOption("typescript", false)
+			require.NoError(t, SaveProjectTo(proj, path))
+
+			saved, err := LoadProject(path)
+			require.NoError(t, err)
+			assert.Equal(t, tokens.PackageName("renamed"), saved.Name)
+			assert.Equal(t, map[string]interface{}{"typescript": false}, saved.Runtime.Options())
+
+			// An invalid project is reported and leaves the file untouched.
+			before, err := os.ReadFile(path)
+			require.NoError(t, err)
+			saved.Name = ""
+			assert.EqualError(t, SaveProjectTo(saved, path),
+				fmt.Sprintf("could not save project to '%s': project is missing a 'name' attribute", path))
+			after, err := os.ReadFile(path)
+			require.NoError(t, err)
+			assert.Equal(t, before, after)
+
+			// No temporary files are left behind.
+			entries, err := os.ReadDir(dir)
+			require.NoError(t, err)
+			assert.Len(t, entries, 1)
+		})
+	}
+}
+
+func TestProjectRuntimeAnchorAlias(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name    string
+		content string
+		options map[string]interface{}
+	}{
+		{
+			name: "Object",
+			content: `name: test
+x-runtime: &rtAnchor
+  name: nodejs
+  options:
+    typescript: false
+runtime: *rtAnchor
+`,
+			options: map[string]interface{}{"typescript": false},
+		},
+		{
+			name: "Name",
+			content: `name: test
+x-runtime: &rtAnchor nodejs
+runtime: *rtAnchor
+`,
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			proj, err := loadProjectFromText(t, tt.content)
+			require.NoError(t, err)
+			assert.Equal(t, "nodejs", proj.Runtime.Name())
+			assert.Equal(t, tt.options, proj.Runtime.Options())
+
+			// Decoding straight into a Project resolves the alias the same way.
+			var decoded Project
+			require.NoError(t, yaml.Unmarshal([]byte(tt.content), &decoded))
+			assert.Equal(t, "nodejs", decoded.Runtime.Name())
+			assert.Equal(t, tt.options, decoded.Runtime.Options())
+		})
+	}
+}
+
+func TestProjectDisplayName(t *testing.T) {
+	t.Parallel()
+
+	proj, err := loadProjectFromText(t, "name: billing-api\ndisplayName: \"Billing API (v2)\"\nruntime: nodejs\n")
+	require.NoError(t, err)
+	assert.Equal(t, "Billing API (v2)", proj.DisplayName)
+	assert.Equal(t, "Billing API (v2)", proj.Title())
+
+	for _, ext := range []string{".yaml", ".json"} {
+		path := filepath.Join(t.TempDir(), "Pulumi"+ext)
+		proj.raw = nil
+		require.NoError(t, proj.Save(path))
+		saved, err := LoadProject(path)
+		require.NoError(t, err)
+		assert.Equal(t, "Billing API (v2)", saved.DisplayName, ext)
+	}
+
+	proj, err = loadProjectFromText(t, "name: billing-api\nruntime: nodejs\n")
+	require.NoError(t, err)
+	assert.Equal(t, "", proj.DisplayName)
+	assert.Equal(t, "billing-api", proj.Title())
+
+	_, err = loadProjectFromText(t, "name: billing-api\ndisplayName: \"\"\nruntime: nodejs\n")
+	assert.ErrorContains(t, err, "#/displayName: length must be >= 1")
+
+	_, err = loadProjectFromText(t, "name: billing-api\ndisplayName: \"  \"\nruntime: nodejs\n")
+	assert.ErrorContains(t, err, "project 'displayName' must not be blank")
+}
+
+func TestProjectRuntimeToolchain(t *testing.T) {
+	t.Parallel()
+
+	proj, err := loadProjectFromText(t, `name: test
+runtime:
+  name: python
+  options:
+    toolchain:
+      name: uv
+      minVersion: 0.4.0
+`)
+	require.NoError(t, err)
+	name, minVersion, ok := proj.Runtime.Toolchain()
+	assert.True(t, ok)
+	assert.Equal(t, "uv", name)
+	assert.Equal(t, "0.4.0", minVersion)
+
+	for _, ext := range []string{".yaml", ".json"} {
+		path := filepath.Join(t.TempDir(), "Pulumi"+ext)
+		proj.raw = nil
+		require.NoError(t, proj.Save(path))
+		saved, err := LoadProject(path)
+		require.NoError(t, err)
+		name, minVersion, ok := saved.Runtime.Toolchain()
+		assert.True(t, ok, ext)
+		assert.Equal(t, "uv", name, ext)
+		assert.Equal(t, "0.4.0", minVersion, ext)
+	}
+
+	proj, err = loadProjectFromText(t,
+		"name: test\nruntime:\n  name: nodejs\n  options:\n    toolchain:\n      name: node\n")
+	require.NoError(t, err)
+	name, minVersion, ok = proj.Runtime.Toolchain()
+	assert.True(t, ok)
+	assert.Equal(t, "node", name)
+	assert.Equal(t, "", minVersion)
+
+	proj, err = loadProjectFromText(t, "name: test\nruntime: nodejs\n")
+	require.NoError(t, err)
+	_, _, ok = proj.Runtime.Toolchain()
+	assert.False(t, ok)
+}
+
+func TestProjectRuntimeToolchainValidation(t *testing.T) {
+	t.Parallel()
+
+	tests := []struct {
+		name      string
+		toolchain string
+		err       string
+	}{
+		{
+			name:      "NotAnObject",
+			toolchain: "uv",
+			err:       "runtime option 'toolchain' must be an object with 'name' and 'minVersion' attributes",
+		},
+		{name: "MissingName", toolchain: "{minVersion: 1.0.0}", err: "runtime option 'toolchain' is missing a 'name'"},
+		{
+			name:      "MalformedVersion",
+			toolchain: "{name: poetry, minVersion: one.two}",
+			err:       "runtime option 'toolchain' has an invalid minVersion 'one.two'",
+		},
+		{
+			name:      "NumericVersion",
+			toolchain: "{name: node, minVersion: 18}",
+			err:       "runtime option 'toolchain' has a minVersion of 18 that is not a string; quote it",
+		},
+		{
+			name:      "UnknownAttribute",
+			toolchain: "{name: node, maxVersion: '20'}",
+			err:       "runtime option 'toolchain' has an unknown attribute 'maxVersion'",
+		},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := loadProjectFromText(t,
+				"name: test\nruntime:\n  name: python\n  options:\n    toolchain: "+tt.toolchain+"\n")
+			assert.ErrorContains(t, err, tt.err)
+		})
+	}
+}
+
+//nolint:paralleltest // mutates environment
+func TestLoadProjectExpandEnv(t *testing.T) {
+	t.Setenv("TEST_EXPAND_BUCKET", "my-state")
+	t.Setenv("TEST_EXPAND_EMPTY", "")
+
+	dir := writeProjectFiles(t, map[string]string{
+		"Pulumi.yaml": `name: test
+runtime:
+  name: nodejs
+  options:
+    nodeargs: ${TEST_EXPAND_EMPTY:---inspect}
+main: ${TEST_EXPAND_MAIN:-src}/index.ts
+description: costs $$5 and $5
+backend:
+  url: s3://${TEST_EXPAND_BUCKET}
+`,
+	})
+	path := filepath.Join(dir, "Pulumi.yaml")
+
+	proj, err := LoadProjectWithOptions(path, LoadOptions{ExpandEnv: true})
+	require.NoError(t, err)
+	assert.Equal(t, "s3://my-state", proj.Backend.URL)
+	assert.Equal(t, "src/index.ts", proj.Main)
+	assert.Equal(t, "costs $5 and $5", *proj.Description)
+	assert.Equal(t, "--inspect", proj.Runtime.Options()["nodeargs"])
+
+	// Without the option the references are left as they are.
+	proj, err = LoadProject(path)
+	require.NoError(t, err)
+	assert.Equal(t, "s3://${TEST_EXPAND_BUCKET}", proj.Backend.URL)
+}
+
+//nolint:paralleltest // mutates environment
+func TestLoadProjectExpandEnvLeavesTemplateAlone(t *testing.T) {
+	t.Setenv("TEST_EXPAND_BUCKET", "my-state")
+
+	// Template config defaults use `${...}` for their own references, which aren't environment variables.
+	dir := writeProjectFiles(t, map[string]string{
+		"Pulumi.yaml": `name: test
+runtime: nodejs
+backend:
+  url: s3://${TEST_EXPAND_BUCKET}
+template:
+  config:
+    dbPassword:
+      secret: true
+      default: ${env:DB_PASS}
+    prefix:
+      default: demo
+    bucketName:
+      default: ${prefix}-bucket
+`,
+	})
+
+	proj, err := LoadProjectWithOptions(filepath.Join(dir, "Pulumi.yaml"), LoadOptions{ExpandEnv: true})
+	require.NoError(t, err)
+	assert.Equal(t, "s3://my-state", proj.Backend.URL)
+	assert.Equal(t, "${env:DB_PASS}", proj.Template.Config["dbPassword"].Default)
+	assert.Equal(t, "${prefix}-bucket", proj.Template.Config["bucketName"].Default)
+}
+
+//nolint:paralleltest // mutates environment
+func TestLoadProjectExpandEnvErrors(t *testing.T) {
+	t.Setenv("TEST_EXPAND_UNSET", "")
+	os.Unsetenv("TEST_EXPAND_UNSET")
+
+	tests := []struct {
+		name     string
+		text     string
+		expected string
+	}{
+		{
+			name: "Unset",
+			text: "name: test\nruntime: nodejs\nbackend:\n  url: s3://${TEST_EXPAND_UNSET}\n",
+			expected: "project attribute 'backend.url' references environment variable 'TEST_EXPAND_UNSET', " +
+				"which is not set",
+		},
+		{
+			name: "UnsetInList",
+			text: "name: test\nruntime: nodejs\nplugins:\n  providers:\n    - name: aws\n      path: ${TEST_EXPAND_UNSET}\n",
+			expected: "project attribute 'plugins.providers[0].path' references environment variable " +
+				"'TEST_EXPAND_UNSET', which is not set",
+		},
+		{
+			name:     "Unterminated",
+			text:     "name: test\nruntime: nodejs\nmain: ${TEST_EXPAND_UNSET\n",
+			expected: "project attribute 'main' has an unterminated '${' reference",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := writeProjectFiles(t, map[string]string{"Pulumi.yaml": tt.text})
+			path := filepath.Join(dir, "Pulumi.yaml")
+
+			_, err := LoadProjectWithOptions(path, LoadOptions{ExpandEnv: true})
+			assert.EqualError(t, err, fmt.Sprintf("could not load '%s': %s", path, tt.expected))
+		})
+	}
+}
+
+//nolint:paralleltest // mutates environment
+func TestProjectValidateRuntimeName(t *testing.T) {
+	proj := &Project{Name: "test", Runtime: NewProjectRuntimeInfo("noodejs", nil)}
+	assert.EqualError(t, proj.Validate(), "unknown runtime 'noodejs'; supported runtimes are "+
+		"client, dotnet, go, java, nodejs, python, yaml (set PULUMI_SKIP_RUNTIME_CHECK=true to skip this check)")
+
+	// Saving reports the error rather than panicking.
+	path := filepath.Join(t.TempDir(), "Pulumi.yaml")
+	assert.ErrorContains(t, proj.Save(path), "can't save invalid project: unknown runtime 'noodejs'")
+	assert.ErrorContains(t, proj.SaveWithOptions(path, ProjectSaveOptions{}), "unknown runtime 'noodejs'")
+	assert.NoFileExists(t, path)
+
+	t.Setenv(PulumiSkipRuntimeCheckEnvVar, "true")
+	assert.NoError(t, proj.Validate())
+	assert.NoError(t, proj.Save(path))
+
+	t.Setenv(PulumiSkipRuntimeCheckEnvVar, "")
+	RegisterRuntime("noodejs")
+	assert.Contains(t, KnownRuntimes(), "noodejs")
+	assert.NoError(t, proj.Validate())
+}
+
+func TestProjectRuntimeInfoOptionMap(t *testing.T) {
+	t.Parallel()
+
+	expected := map[string]interface{}{
+		"os":   "linux",
+		"arch": "amd64",
+		"env":  map[string]interface{}{"CGO_ENABLED": "0"},
+		"tags": []interface{}{"netgo", "osusergo"},
+	}
+	for name, content := range map[string]string{
+		"Pulumi.yaml": `name: test
+runtime:
+  name: go
+  options:
+    buildTarget:
+      os: linux
+      arch: amd64
+      env:
+        CGO_ENABLED: "0"
+      tags: [netgo, osusergo]
+    binary: bin/app
+`,
+		"Pulumi.json": `{"name": "test", "runtime": {"name": "go", "options": {"buildTarget": ` +
+			`{"os": "linux", "arch": "amd64", "env": {"CGO_ENABLED": "0"}, "tags": ["netgo", "osusergo"]}, ` +
+			`"binary": "bin/app"}}}`,
+	} {
+		path := filepath.Join(writeProjectFiles(t, map[string]string{name: content}), name)
+		// The nested object is also accepted when the options are checked against the go runtime's spec.
+		proj, err := LoadProjectWithRuntimeSpecs(path, nil)
+		require.NoError(t, err, name)
+
+		target, ok := proj.Runtime.OptionMap("buildTarget")
+		require.True(t, ok, name)
+		assert.Equal(t, expected, target, name)
+		_, ok = proj.Runtime.OptionMap("binary")
+		assert.False(t, ok, name)
+		_, ok = proj.Runtime.OptionMap("missing")
+		assert.False(t, ok, name)
+
+		// The returned map is a copy.
+		target["env"].(map[string]interface{})["CGO_ENABLED"] = "1"
+		target, _ = proj.Runtime.OptionMap("buildTarget")
+		assert.Equal(t, expected, target, name)
+
+		// The nested object survives saving and loading the project unchanged.
+		require.NoError(t, proj.Save(path), name)
+		saved, err := LoadProject(path)
+		require.NoError(t, err, name)
+		target, ok = saved.Runtime.OptionMap("buildTarget")
+		assert.True(t, ok, name)
+		assert.Equal(t, expected, target, name)
+	}
+
+	var info ProjectRuntimeInfo
+	info.SetOption("legacy", map[interface{}]interface{}{"os": "linux", "nested": map[interface{}]interface{}{"a": 1}})
+	legacy, ok := info.OptionMap("legacy")
+	assert.True(t, ok)
+	assert.Equal(t, map[string]interface{}{"os": "linux", "nested": map[string]interface{}{"a": 1}}, legacy)
+}
+
+func TestProjectRuntimeSecretOption(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"Pulumi.yaml": `name: proj
+runtime:
+  name: nodejs
+  options:
+    registryToken:
+      secure: c2VjcmV0
+    registry:
+      url: https://registry.example.com
+      password:
+        secure: cGFzc3dvcmQ=
+`,
+	})
+	path := filepath.Join(dir, "Pulumi.yaml")
+	proj, err := LoadProject(path)
+	require.NoError(t, err)
+
+	assert.True(t, proj.Runtime.OptionIsSecret("registryToken"))
+	assert.False(t, proj.Runtime.OptionIsSecret("registry"))
+	value, ok := proj.Runtime.SecretOption("registryToken")
+	assert.True(t, ok)
+	assert.Equal(t, config.NewSecureValue("c2VjcmV0"), value)
+	_, ok = proj.Runtime.SecretOption("registry")
+	assert.False(t, ok)
+
+	// Secret options are saved still encrypted.
+	require.NoError(t, proj.Save(path))
+	saved, err := LoadProject(path)
+	require.NoError(t, err)
+	value, ok = saved.Runtime.SecretOption("registryToken")
+	assert.True(t, ok)
+	assert.Equal(t, config.NewSecureValue("c2VjcmV0"), value)
+
+	proj.Runtime.SetSecretOption("npmToken", "bnBt")
+	b, err := json.Marshal(proj)
+	require.NoError(t, err)
+	var roundtrip Project
+	require.NoError(t, json.Unmarshal(b, &roundtrip))
+	value, ok = roundtrip.Runtime.SecretOption("npmToken")
+	assert.True(t, ok)
+	assert.Equal(t, config.NewSecureValue("bnBt"), value)
+
+	redacted := proj.Redacted()
+	assert.Equal(t, RedactedSecretValue, redacted.Runtime.Options()["registryToken"])
+	assert.Equal(t, RedactedSecretValue, redacted.Runtime.Options()["npmToken"])
+	registry, ok := redacted.Runtime.OptionMap("registry")
+	assert.True(t, ok)
+	assert.Equal(t, map[string]interface{}{
+		"url":      "https://registry.example.com",
+		"password": RedactedSecretValue,
+	}, registry)
+	// The project itself is left alone.
+	assert.True(t, proj.Runtime.OptionIsSecret("registryToken"))
+	registry, ok = proj.Runtime.OptionMap("registry")
+	assert.True(t, ok)
+	assert.Equal(t, map[string]interface{}{"secure": "cGFzc3dvcmQ="}, registry["password"])
+}
+
+func TestProjectRuntimeInfoTypedOptions(t *testing.T) {
+	t.Parallel()
+
+	proj, err := loadProjectFromText(t, `name: test
+runtime:
+  name: nodejs
+  options:
+    typescript: false
+    nodeargs: --inspect
+    quoted: "true"
+    list: [a, b]
+    mixed: [a, 1]
+`)
+	require.NoError(t, err)
+	info := &proj.Runtime
+
+	b, ok := info.OptionBool("typescript")
+	assert.True(t, ok)
+	assert.False(t, b)
+	_, ok = info.OptionBool("quoted")
+	assert.False(t, ok, "a quoted boolean is a string")
+	_, ok = info.OptionBool("missing")
+	assert.False(t, ok)
+
+	s, ok := info.OptionString("nodeargs")
+	assert.True(t, ok)
+	assert.Equal(t, "--inspect", s)
+	_, ok = info.OptionString("typescript")
+	assert.False(t, ok)
+	_, ok = info.OptionString("missing")
+	assert.False(t, ok)
+
+	list, ok := info.OptionStringSlice("list")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"a", "b"}, list)
+	_, ok = info.OptionStringSlice("mixed")
+	assert.False(t, ok)
+	_, ok = info.OptionStringSlice("nodeargs")
+	assert.False(t, ok)
+	_, ok = info.OptionStringSlice("missing")
+	assert.False(t, ok)
+
+	info.SetOption("set", []string{"x"})
+	list, ok = info.OptionStringSlice("set")
+	assert.True(t, ok)
+	assert.Equal(t, []string{"x"}, list)
+	list[0] = "y"
+	list, _ = info.OptionStringSlice("set")
+	assert.Equal(t, []string{"x"}, list)
+
+	var empty ProjectRuntimeInfo
+	_, ok = empty.OptionBool("typescript")
+	assert.False(t, ok)
+}
+
+func TestProjectEngines(t *testing.T) {
+	t.Parallel()
+
+	proj, err := loadProjectFromText(t, `name: test
+runtime: nodejs
+engines:
+  pulumi: ">=3.100.0 <4.0.0"
+  nodejs: ">=18.0.0"
+`)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"pulumi": ">=3.100.0 <4.0.0", "nodejs": ">=18.0.0"}, proj.Engines)
+
+	// Satisfied engines, and engines the project doesn't constrain, report nothing.
+	assert.Empty(t, proj.CheckEngines(map[string]string{"pulumi": "3.120.0", "nodejs": "v20.1.0", "aws": "1.0.0"}))
+	// Engines without a known version aren't checked.
+	assert.Empty(t, proj.CheckEngines(map[string]string{"pulumi": "3.120.0"}))
+	assert.Empty(t, (&Project{Name: "test"}).CheckEngines(map[string]string{"pulumi": "3.120.0"}))
+
+	errs := proj.CheckEngines(map[string]string{"pulumi": "4.1.0", "nodejs": "16.20.0"})
+	require.Len(t, errs, 2)
+	assert.EqualError(t, errs[0], "project 'test' requires nodejs '>=18.0.0', but version 16.20.0 is in use")
+	assert.EqualError(t, errs[1], "project 'test' requires pulumi '>=3.100.0 <4.0.0', but version 4.1.0 is in use")
+
+	errs = proj.CheckEngines(map[string]string{"pulumi": "latest"})
+	require.Len(t, errs, 1)
+	assert.ErrorContains(t, errs[0], "version 'latest' of engine 'pulumi' is invalid")
+
+	_, err = loadProjectFromText(t, `name: test
+runtime: nodejs
+engines:
+  pulumi: "not a range"
+`)
+	assert.ErrorContains(t, err, "engine 'pulumi' has an invalid version range 'not a range'")
+}
+
+func TestProjectInlineStacks(t *testing.T) {
+	t.Parallel()
+
+	content := `# The project.
+---
+name: proj
+runtime: nodejs
+description: |
+  Not a marker:
+  ---
+---
+stack: dev
+config:
+  region: eu-west-1
+  aws:profile: dev
+  password:
+    secure: c2VjcmV0
+--- # Production.
+stack: prod
+---
+`
+	dir := writeProjectFiles(t, map[string]string{"Pulumi.yaml": content})
+	path := filepath.Join(dir, "Pulumi.yaml")
+	proj, err := LoadProject(path)
+	require.NoError(t, err)
+	assert.Equal(t, "Not a marker:\n---\n", *proj.Description)
+	assert.Equal(t, map[tokens.QName]config.Map{
+		"dev": {
+			config.MustMakeKey("proj", "region"):   config.NewValue("eu-west-1"),
+			config.MustMakeKey("aws", "profile"):   config.NewValue("dev"),
+			config.MustMakeKey("proj", "password"): config.NewSecureValue("c2VjcmV0"),
+		},
+		"prod": {},
+	}, proj.InlineStacks)
+
+	// Saving the project keeps the inline stack documents.
+	proj.Description = nil
+	require.NoError(t, proj.Save(path))
+	saved, err := LoadProject(path)
+	require.NoError(t, err)
+	assert.Nil(t, saved.Description)
+	assert.Equal(t, proj.InlineStacks, saved.InlineStacks)
+
+	single, err := loadProjectFromText(t, "---\nname: proj\nruntime: nodejs\n")
+	require.NoError(t, err)
+	assert.Nil(t, single.InlineStacks)
+
+	tests := []struct {
+		name     string
+		stacks   string
+		expected string
+	}{
+		{
+			name:     "MissingStack",
+			stacks:   "---\nconfig:\n  region: eu-west-1\n",
+			expected: "inline stack document 1 must declare the stack it configures with a 'stack' attribute",
+		},
+		{
+			name:     "DuplicateStack",
+			stacks:   "---\nstack: dev\n---\nstack: prod\n---\nstack: dev\n",
+			expected: "stack 'dev' is configured by more than one inline stack document",
+		},
+		{
+			name:     "UnknownAttribute",
+			stacks:   "---\nstack: dev\nsecretsprovider: passphrase\n",
+			expected: "inline stack document 1 has unknown attribute 'secretsprovider'",
+		},
+		{
+			name:     "InvalidStackName",
+			stacks:   "---\nstack: my stack\n",
+			expected: "inline stack document 1: 'my stack' is not a valid stack name",
+		},
+		{
+			name:     "NotAnObject",
+			stacks:   "---\n- dev\n",
+			expected: "inline stack document 1 must be an object with 'stack' and 'config' attributes",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+
+			_, err := loadProjectFromText(t, "name: proj\nruntime: nodejs\n"+tt.stacks)
+			assert.ErrorContains(t, err, tt.expected)
+		})
+	}
+}
+
+func TestProjectSchema(t *testing.T) {
+	t.Parallel()
+
+	const schemaURL = "https://example.com/pulumi-project.json"
+	dir := writeProjectFiles(t, map[string]string{
+		"Pulumi.yaml": "$schema: " + schemaURL + "\nname: proj\nruntime: nodejs\n",
+		"Pulumi.json": `{"$schema": "` + schemaURL + `", "name": "proj", "runtime": "nodejs"}`,
+	})
+	for _, name := range []string{"Pulumi.yaml", "Pulumi.json"} {
+		path := filepath.Join(dir, name)
+		proj, err := LoadProject(path)
+		require.NoError(t, err, name)
+		assert.Equal(t, schemaURL, proj.Schema, name)
+		assert.Empty(t, proj.AdditionalKeys, name)
+
+		require.NoError(t, proj.Save(path), name)
+		saved, err := LoadProject(path)
+		require.NoError(t, err, name)
+		assert.Equal(t, schemaURL, saved.Schema, name)
+	}
+}
+
+func TestProjectSchemaJSON(t *testing.T) {
+	t.Parallel()
+
+	compiler := jsonschema.NewCompiler()
+	require.NoError(t, compiler.AddResource("project.json", bytes.NewReader(ProjectSchemaJSON())))
+	schema, err := compiler.Compile("project.json")
+	require.NoError(t, err)
+
+	b, err := json.Marshal(&Project{Name: "proj", Runtime: NewProjectRuntimeInfo("nodejs", nil)})
+	require.NoError(t, err)
+	var project interface{}
+	require.NoError(t, json.Unmarshal(b, &project))
+	assert.NoError(t, schema.Validate(project))
+	assert.NoError(t, ProjectSchema.Validate(project))
+
+	// The document is the one project files are validated against, so both schemas reject the same projects.
+	invalid := map[string]interface{}{"name": "proj", "runtime": 1}
+	assert.Error(t, schema.Validate(invalid))
+	assert.Error(t, ProjectSchema.Validate(invalid))
+
+	// Callers get their own copy of the document.
+	ProjectSchemaJSON()[0] = 'x'
+	assert.Equal(t, projectSchema, string(ProjectSchemaJSON()))
+}
+
+func TestProjectSetSchemaHint(t *testing.T) {
+	t.Parallel()
+
+	const schemaURL = "https://example.com/pulumi-project.json"
+	dir := writeProjectFiles(t, map[string]string{
+		"Pulumi.yaml": "name: proj\nruntime: nodejs\n",
+		"Pulumi.json": `{"name": "proj", "runtime": "nodejs"}`,
+	})
+
+	path := filepath.Join(dir, "Pulumi.yaml")
+	proj, err := LoadProject(path)
+	require.NoError(t, err)
+	proj.SetSchemaHint(schemaURL)
+	require.NoError(t, proj.Save(path))
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "# yaml-language-server: $schema="+schemaURL+"\nname: proj\nruntime: nodejs\n", string(b))
+
+	// A project loaded from a file with the directive keeps it when saved.
+	proj, err = LoadProject(path)
+	require.NoError(t, err)
+	description := "A project."
+	proj.Description = &description
+	require.NoError(t, proj.Save(path))
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(string(b), "# yaml-language-server: $schema="+schemaURL+"\n"), string(b))
+	assert.Equal(t, 1, strings.Count(string(b), "yaml-language-server"), string(b))
+
+	proj.SetSchemaHint("")
+	require.NoError(t, proj.Save(path))
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "yaml-language-server")
+
+	// JSON can't hold comments, so the directive isn't written.
+	path = filepath.Join(dir, "Pulumi.json")
+	proj, err = LoadProject(path)
+	require.NoError(t, err)
+	proj.SetSchemaHint(schemaURL)
+	require.NoError(t, proj.Save(path))
+	b, err = os.ReadFile(path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "yaml-language-server")
+}
+
+func TestCreateProject(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "app")
+	desc := "A new project"
+	proj := &Project{Name: "app", Runtime: NewProjectRuntimeInfo("nodejs", nil), Description: &desc}
+
+	path, err := CreateProject(dir, proj)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "Pulumi.yaml"), path)
+	assert.DirExists(t, filepath.Join(dir, BookkeepingDir))
+	loaded, err := LoadProject(path)
+	require.NoError(t, err)
+	assert.Equal(t, tokens.PackageName("app"), loaded.Name)
+	assert.Equal(t, "nodejs", loaded.Runtime.Name())
+	assert.Equal(t, desc, *loaded.Description)
+
+	_, err = CreateProject(dir, proj)
+	assert.EqualError(t, err, path+" already exists; overwrite it to replace the project")
+
+	proj.Runtime = NewProjectRuntimeInfo("python", nil)
+	path, err = CreateProjectWithOptions(dir, proj, CreateProjectOptions{Overwrite: true})
+	require.NoError(t, err)
+	loaded, err = LoadProject(path)
+	require.NoError(t, err)
+	assert.Equal(t, "python", loaded.Runtime.Name())
+
+	// An existing project file is overwritten in place, keeping its format.
+	jsonDir := writeProjectFiles(t, map[string]string{"Pulumi.json": `{"name": "app", "runtime": "go"}`})
+	path, err = CreateProjectWithOptions(jsonDir, proj, CreateProjectOptions{Overwrite: true})
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(jsonDir, "Pulumi.json"), path)
+	loaded, err = LoadProject(path)
+	require.NoError(t, err)
+	assert.Equal(t, "python", loaded.Runtime.Name())
+}
+
+func TestCreateProjectInvalid(t *testing.T) {
+	t.Parallel()
+
+	dir := filepath.Join(t.TempDir(), "app")
+	_, err := CreateProject(dir, &Project{Name: "my app", Runtime: NewProjectRuntimeInfo("nodejs", nil)})
+	assert.ErrorContains(t, err, "invalid project name 'my app'")
+	_, err = CreateProject(dir, &Project{Name: "app"})
+	assert.EqualError(t, err, "project is missing a 'runtime' attribute")
+	assert.NoDirExists(t, dir)
+}
+
+func TestProjectClone(t *testing.T) {
+	t.Parallel()
+
+	proj, err := loadProjectFromText(t, `name: test
+runtime:
+  name: nodejs
+  options:
+    typescript: false
+    nodeargs: [--inspect]
+description: The project
+platforms: [linux/amd64]
+engines:
+  pulumi: ">=3.0.0"
+config:
+  region:
+    type: string
+    default: us-west-2
+  tags:
+    type: array
+    items:
+      type: string
+    default: [a]
+plugins:
+  providers:
+    - name: aws
+      path: plugins/aws
+`)
+	require.NoError(t, err)
+	original, err := loadProjectFromText(t, string(proj.RawValue()))
+	require.NoError(t, err)
+
+	clone := proj.Clone()
+	assert.Equal(t, proj, clone)
+
+	clone.Runtime.Options()["typescript"] = true
+	clone.Runtime.Options()["nodeargs"].([]interface{})[0] = "--trace"
+	clone.Runtime.SetOption("added", "value")
+	*clone.Description = "Changed"
+	clone.Platforms[0] = "darwin/arm64"
+	clone.Engines["pulumi"] = ">=4.0.0"
+	clone.Config["region"] = ProjectConfigType{Default: "eu-west-1"}
+	clone.Config["tags"].Default.([]interface{})[0] = "b"
+	clone.Plugins.Providers[0].Name = "gcp"
+
+	assert.Equal(t, original, proj)
+}
+
+func TestLoadProjectWithRuntimeSpecs(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"Pulumi.yaml": `name: test
+runtime:
+  name: nodejs
+  options:
+    typescript: false
+    nodeargs: --inspect
+    toolchain:
+      name: node
+      minVersion: "18"
+`,
+		"python/Pulumi.yaml": "name: test\nruntime:\n  name: python\n  options:\n    virtualenv: [venv]\n",
+	})
+	path := filepath.Join(dir, "Pulumi.yaml")
+
+	// The built-in specs accept the options.
+	proj, err := LoadProjectWithRuntimeSpecs(path, nil)
+	require.NoError(t, err)
+	assert.Equal(t, false, proj.Runtime.Options()["typescript"])
+
+	// A custom spec replaces the built-in one for its runtime.
+	specs := map[string]RuntimeOptionSpec{
+		"nodejs": {Schema: []byte(`{"type": "object", "properties": {"nodeargs": false}}`)},
+	}
+	_, err = LoadProjectWithRuntimeSpecs(path, specs)
+	assert.ErrorContains(t, err, fmt.Sprintf("could not validate '%s'", path))
+	assert.ErrorContains(t, err, "#/runtime/options/nodeargs: not allowed")
+
+	// Runtimes without a custom spec still use the built-in one.
+	pythonPath := filepath.Join(dir, "python", "Pulumi.yaml")
+	_, err = LoadProjectWithRuntimeSpecs(pythonPath, specs)
+	assert.ErrorContains(t, err, "#/runtime/options/virtualenv: expected string, but got array")
+
+	specs["nodejs"] = RuntimeOptionSpec{Schema: []byte(`{"type": `)}
+	_, err = LoadProjectWithRuntimeSpecs(path, specs)
+	assert.ErrorContains(t, err, "invalid options spec for the nodejs runtime")
+
+	// Without specs, the options aren't checked.
+	_, err = LoadProject(pythonPath)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,221 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workspace
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+// runtimeOptionsSchemas holds the JSON schema for the runtime options of each well-known runtime, keyed by runtime
+// name.
+//
+//go:embed runtimes.json
+var runtimeOptionsSchemas []byte
+
+// runtimeOptionsSchema returns the JSON schema for the given runtime's options, and whether the runtime is known. For
+// runtimes that aren't listed in runtimes.json, the schema accepts any options. The returned schema may be modified.
+func runtimeOptionsSchema(runtime string) (map[string]interface{}, bool) {
+	var schemas map[string]map[string]interface{}
+	err := json.Unmarshal(runtimeOptionsSchemas, &schemas)
+	contract.AssertNoErrorf(err, "runtimes.json is not valid JSON")
+
+	schema, ok := schemas[runtime]
+	if !ok {
+		return map[string]interface{}{"type": "object", "additionalProperties": true}, false
+	}
+	return schema, true
+}
+
+// runtimeOptionDefaults returns the default value of each option of the given runtime that declares one in
+// runtimes.json.
+func runtimeOptionDefaults(runtime string) map[string]interface{} {
+	schema, _ := runtimeOptionsSchema(runtime)
+	properties, _ := schema["properties"].(map[string]interface{})
+
+	defaults := make(map[string]interface{})
+	for name, property := range properties {
+		if property, ok := property.(map[string]interface{}); ok {
+			if def, has := property["default"]; has {
+				defaults[name] = def
+			}
+		}
+	}
+	return defaults
+}
+
+// KnownRuntimeOptions lists the canonical names of the runtime options understood by each runtime, keyed by runtime
+// name. Project.Lint uses it to flag option names that differ from a canonical name only in case. It is initialized
+// from the options described in runtimes.json, and may be extended with the options of other runtimes.
+var KnownRuntimeOptions = runtimeOptionNames()
+
+// runtimeOptionNames returns the sorted names of the options of each runtime in runtimes.json.
+func runtimeOptionNames() map[string][]string {
+	var schemas map[string]map[string]interface{}
+	err := json.Unmarshal(runtimeOptionsSchemas, &schemas)
+	contract.AssertNoErrorf(err, "runtimes.json is not valid JSON")
+
+	names := make(map[string][]string, len(schemas))
+	for runtime, schema := range schemas {
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name := range properties {
+			names[runtime] = append(names[runtime], name)
+		}
+		sort.Strings(names[runtime])
+	}
+	return names
+}
+
+// PulumiSkipRuntimeCheckEnvVar turns off the check that a project's runtime is known when it is set to a true value,
+// e.g. for plugin authors who are developing a new runtime.
+const PulumiSkipRuntimeCheckEnvVar = "PULUMI_SKIP_RUNTIME_CHECK"
+
+var (
+	knownRuntimesLock sync.RWMutex
+	// knownRuntimes holds the names of the runtimes that Project.Validate accepts. The `client` runtime is the one
+	// that the CLI uses to run programs hosted by another process, such as the Automation API's inline programs.
+	knownRuntimes = map[string]bool{
+		"client": true,
+		"dotnet": true,
+		"go":     true,
+		"java":   true,
+		"nodejs": true,
+		"python": true,
+		"yaml":   true,
+	}
+)
+
+// RegisterRuntime adds the runtime with the given name to the runtimes that Project.Validate accepts, for runtimes
+// that are developed outside of this repository.
+func RegisterRuntime(name string) {
+	contract.Requiref(name != "", "name", "must not be empty")
+
+	knownRuntimesLock.Lock()
+	defer knownRuntimesLock.Unlock()
+	knownRuntimes[name] = true
+}
+
+// KnownRuntimes returns the sorted names of the runtimes that Project.Validate accepts.
+func KnownRuntimes() []string {
+	knownRuntimesLock.RLock()
+	defer knownRuntimesLock.RUnlock()
+
+	names := make([]string, 0, len(knownRuntimes))
+	for name := range knownRuntimes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateRuntimeName returns an error if the runtime isn't one of KnownRuntimes, unless the check is turned off by
+// PulumiSkipRuntimeCheckEnvVar.
+func validateRuntimeName(name string) error {
+	if cmdutil.IsTruthy(os.Getenv(PulumiSkipRuntimeCheckEnvVar)) {
+		return nil
+	}
+
+	knownRuntimesLock.RLock()
+	known := knownRuntimes[name]
+	knownRuntimesLock.RUnlock()
+	if known {
+		return nil
+	}
+	return fmt.Errorf("unknown runtime '%v'; supported runtimes are %v (set %v=true to skip this check)",
+		name, strings.Join(KnownRuntimes(), ", "), PulumiSkipRuntimeCheckEnvVar)
+}
+
+// RuntimeOptionSpec describes the options that a runtime accepts, for checking them with LoadOptions.RuntimeSpecs.
+type RuntimeOptionSpec struct {
+	// Schema is a JSON schema for the runtime's `options` object, such as the entries of runtimes.json.
+	Schema []byte
+}
+
+// validateRuntimeOptions checks the options of the given runtime against the runtime's spec in specs, or its built-in
+// spec from runtimes.json if specs doesn't have one. The options of runtimes without either spec aren't checked.
+func validateRuntimeOptions(runtime string, options map[string]interface{}, specs map[string]RuntimeOptionSpec) error {
+	spec, ok := specs[runtime]
+	if !ok {
+		schema, known := runtimeOptionsSchema(runtime)
+		if !known {
+			return nil
+		}
+		b, err := json.Marshal(schema)
+		contract.AssertNoErrorf(err, "marshaling runtime schema")
+		spec = RuntimeOptionSpec{Schema: b}
+	}
+
+	schema, err := jsonschema.CompileString(fmt.Sprintf("blob://runtimes/%s.json", runtime), string(spec.Schema))
+	if err != nil {
+		return fmt.Errorf("invalid options spec for the %v runtime: %w", runtime, err)
+	}
+
+	// Round-trip the options through JSON, so that they hold only the types that the schema validator understands.
+	if options == nil {
+		options = map[string]interface{}{}
+	}
+	b, err := json.Marshal(options)
+	if err != nil {
+		return err
+	}
+	var value interface{}
+	if err = json.Unmarshal(b, &value); err != nil {
+		return err
+	}
+	return schemaValidationErrorsAt("/runtime/options", schema.Validate(value))
+}
+
+// RuntimeJSONSchema returns a JSON schema for the `runtime` attribute of a project using the given runtime, for use
+// by editors and other tooling. The schema accepts either the bare runtime name or the object form, and describes the
+// options understood by well-known runtimes. For unknown runtimes the schema accepts any runtime name and options.
+func RuntimeJSONSchema(runtime string) []byte {
+	optionsSchema, known := runtimeOptionsSchema(runtime)
+
+	nameSchema := map[string]interface{}{"type": "string", "minLength": 1}
+	if known {
+		nameSchema = map[string]interface{}{"type": "string", "const": runtime}
+	}
+
+	optionsSchema["title"] = "Options"
+	fragment := map[string]interface{}{
+		"$schema": "https://json-schema.org/draft/2020-12/schema",
+		"title":   "ProjectRuntimeInfo",
+		"oneOf": []interface{}{
+			nameSchema,
+			map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"name":    nameSchema,
+					"options": optionsSchema,
+				},
+				"required":             []string{"name"},
+				"additionalProperties": false,
+			},
+		},
+	}
+
+	b, err := json.MarshalIndent(fragment, "", "    ")
+	contract.AssertNoErrorf(err, "marshaling runtime schema")
+	return b
+}
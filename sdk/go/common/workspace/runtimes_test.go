@@ -0,0 +1,62 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workspace
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func compileRuntimeSchema(t *testing.T, runtime string) *jsonschema.Schema {
+	compiler := jsonschema.NewCompiler()
+	err := compiler.AddResource("runtime.json", bytes.NewReader(RuntimeJSONSchema(runtime)))
+	require.NoError(t, err)
+	schema, err := compiler.Compile("runtime.json")
+	require.NoError(t, err)
+	return schema
+}
+
+func decodeJSON(t *testing.T, text string) interface{} {
+	var v interface{}
+	require.NoError(t, json.Unmarshal([]byte(text), &v))
+	return v
+}
+
+func TestRuntimeJSONSchema(t *testing.T) {
+	t.Parallel()
+
+	schema := compileRuntimeSchema(t, "nodejs")
+	assert.NoError(t, schema.Validate(decodeJSON(t, `"nodejs"`)))
+	assert.NoError(t, schema.Validate(decodeJSON(t,
+		`{"name": "nodejs", "options": {"typescript": false, "nodeargs": "--inspect", "custom": 1}}`)))
+
+	assert.Error(t, schema.Validate(decodeJSON(t, `"python"`)))
+	assert.Error(t, schema.Validate(decodeJSON(t, `{"name": "nodejs", "options": {"typescript": "yes"}}`)))
+	assert.Error(t, schema.Validate(decodeJSON(t, `{"options": {}}`)))
+}
+
+func TestRuntimeJSONSchemaUnknownRuntime(t *testing.T) {
+	t.Parallel()
+
+	schema := compileRuntimeSchema(t, "cobol")
+	assert.NoError(t, schema.Validate(decodeJSON(t, `"anything"`)))
+	assert.NoError(t, schema.Validate(decodeJSON(t, `{"name": "cobol", "options": {"dialect": "85"}}`)))
+	assert.Error(t, schema.Validate(decodeJSON(t, `""`)))
+}
@@ -14,14 +14,364 @@
 
 package workspace
 
+import (
+	"bytes"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+//go:embed settings.json
+var settingsSchemaJSON string
+
+var settingsSchema *jsonschema.Schema
+
+func init() {
+	compiler := jsonschema.NewCompiler()
+	compiler.LoadURL = func(u string) (io.ReadCloser, error) {
+		if u == "blob://settings.json" {
+			return io.NopCloser(strings.NewReader(settingsSchemaJSON)), nil
+		}
+		return jsonschema.LoadURL(u)
+	}
+	settingsSchema = compiler.MustCompile("blob://settings.json")
+}
+
+// ValidateSettings checks the serialized workspace settings in b against the settings schema, and that every stack
+// they name is a valid qualified name. It reports every violation it finds.
+func ValidateSettings(b []byte) error {
+	var raw interface{}
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	if err := schemaValidationErrors(settingsSchema.Validate(raw)); err != nil {
+		return err
+	}
+
+	var errs *multierror.Error
+	settings, _ := raw.(map[string]interface{})
+	for _, attr := range []string{"stackConfig", "config", "stackTags"} {
+		stacks, _ := settings[attr].(map[string]interface{})
+		names := make([]string, 0, len(stacks))
+		for name := range stacks {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if !tokens.IsQName(name) {
+				errs = multierror.Append(errs, fmt.Errorf("#/%s: '%s' is not a valid stack name", attr, name))
+			}
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
 // Settings defines workspace settings shared amongst many related projects.
 type Settings struct {
 	// Stack is an optional default stack to use.
-	Stack string `json:"stack,omitempty" yaml:"env,omitempty"`
+	Stack string `json:"stack,omitempty" yaml:"stack,omitempty"`
+	// StackConfig is optional workspace local configuration (overrides values in a project), keyed by stack.
+	StackConfig map[tokens.QName]config.Map `json:"stackConfig,omitempty" yaml:"stackConfig,omitempty"`
+	// ConfigDeprecated is the workspace local configuration as saved by older versions of Pulumi.
+	//
+	// Deprecated: use StackConfig. Reading settings moves this configuration into StackConfig. While older versions
+	// are still in use, saving settings writes StackConfig under this field's key as well, so they can read it.
+	ConfigDeprecated map[tokens.QName]config.Map `json:"config,omitempty" yaml:"config,omitempty"`
+	// StackTags is an optional set of user-defined tags for each stack.
+	StackTags map[tokens.QName]map[string]string `json:"stackTags,omitempty" yaml:"stackTags,omitempty"`
+
+	// ProjectPath is the slash-separated path of the project file the settings belong to. It is recorded when the
+	// settings are saved, so that settings for projects that no longer exist can be found, and doesn't count towards
+	// IsEmpty.
+	ProjectPath string `json:"projectPath,omitempty" yaml:"projectPath,omitempty"`
+	// ProjectName is the name of the project the settings belong to. Like ProjectPath, it is recorded when the settings
+	// are saved and doesn't count towards IsEmpty.
+	ProjectName tokens.PackageName `json:"projectName,omitempty" yaml:"projectName,omitempty"`
+
+	// Format is the format the settings are saved in; the zero value means SettingsFormatJSON. Reading the settings
+	// sets it to the format of the settings file, so saving them keeps that format. It isn't itself saved and doesn't
+	// count towards IsEmpty.
+	Format SettingsFormat `json:"-" yaml:"-"`
 }
 
-// IsEmpty returns true when the settings object is logically empty (no selected stack and nothing in the deprecated
-// configuration bag).
+// SettingsFormat is a format that workspace settings can be saved in.
+type SettingsFormat string
+
+const (
+	// SettingsFormatJSON saves settings as indented JSON. It is the default, and the only format that versions of
+	// Pulumi before YAML settings were supported can read.
+	SettingsFormatJSON SettingsFormat = "json"
+	// SettingsFormatYAML saves settings as YAML, like Pulumi's project and stack files.
+	SettingsFormatYAML SettingsFormat = "yaml"
+)
+
+// detectSettingsFormat returns the format of the serialized settings b: JSON if they hold a JSON object, and YAML
+// otherwise.
+func detectSettingsFormat(b []byte) SettingsFormat {
+	if bytes.HasPrefix(bytes.TrimLeft(b, " \t\r\n"), []byte("{")) {
+		return SettingsFormatJSON
+	}
+	return SettingsFormatYAML
+}
+
+// settingsAsJSON returns the serialized settings b as JSON, converting them if they are YAML, along with the format
+// they were in.
+func settingsAsJSON(b []byte) ([]byte, SettingsFormat, error) {
+	format := detectSettingsFormat(b)
+	if format == SettingsFormatJSON {
+		return b, format, nil
+	}
+
+	var raw interface{}
+	if err := encoding.YAML.Unmarshal(b, &raw); err != nil {
+		return nil, format, err
+	}
+	simplified, err := SimplifyMarshalledValue(raw)
+	if err != nil {
+		return nil, format, err
+	}
+	converted, err := json.Marshal(simplified)
+	if err != nil {
+		return nil, format, err
+	}
+	return converted, format, nil
+}
+
+// IsEmpty returns true when the settings object is logically empty (no selected stack, no stack configuration and no
+// stack tags). The recorded project path and name and the format are not considered. Saving
+// empty settings deletes the settings file, so once DeleteStack has removed every stack and no stack is selected, the
+// next save cleans the workspace up.
 func (s *Settings) IsEmpty() bool {
-	return s.Stack == ""
+	return s.Stack == "" && len(s.StackConfig) == 0 && len(s.ConfigDeprecated) == 0 && len(s.StackTags) == 0
+}
+
+// migrateConfig moves the configuration in ConfigDeprecated into StackConfig, unless StackConfig already holds
+// configuration, in which case ConfigDeprecated is just the copy saved for older versions and is dropped. It returns
+// true if any configuration was moved.
+func (s *Settings) migrateConfig() bool {
+	legacy := s.ConfigDeprecated
+	s.ConfigDeprecated = nil
+	if len(legacy) == 0 || len(s.StackConfig) != 0 {
+		return false
+	}
+	s.StackConfig = legacy
+	return true
+}
+
+// DeleteStack removes everything the settings hold for the named stack: its config, its tags and, if it is the
+// selected stack, the selection.
+func (s *Settings) DeleteStack(name tokens.QName) {
+	delete(s.StackConfig, name)
+	if len(s.StackConfig) == 0 {
+		s.StackConfig = nil
+	}
+	delete(s.StackTags, name)
+	if len(s.StackTags) == 0 {
+		s.StackTags = nil
+	}
+	if s.Stack == string(name) {
+		s.Stack = ""
+	}
+}
+
+// Merge overlays other onto the settings, for layering overrides such as a user's local settings onto shared ones.
+// The config and tags of each stack are merged key by key, with other's values replacing those already present, and
+// other's selected stack, if it has one, replaces the selected stack. The recorded project path and name and the format
+// describe where the settings are saved, so they are left alone. Merging into or from nil settings does nothing.
+func (s *Settings) Merge(other *Settings) {
+	if s == nil || other == nil {
+		return
+	}
+
+	if other.Stack != "" {
+		s.Stack = other.Stack
+	}
+
+	s.migrateConfig()
+	otherConfig := other.StackConfig
+	if len(otherConfig) == 0 {
+		otherConfig = other.ConfigDeprecated
+	}
+	for stack, cfg := range otherConfig {
+		if s.StackConfig == nil {
+			s.StackConfig = make(map[tokens.QName]config.Map)
+		}
+		merged, ok := s.StackConfig[stack]
+		if !ok || merged == nil {
+			merged = make(config.Map, len(cfg))
+			s.StackConfig[stack] = merged
+		}
+		for k, v := range cfg {
+			merged[k] = v
+		}
+	}
+
+	for stack, tags := range other.StackTags {
+		if s.StackTags == nil {
+			s.StackTags = make(map[tokens.QName]map[string]string)
+		}
+		merged, ok := s.StackTags[stack]
+		if !ok || merged == nil {
+			merged = make(map[string]string, len(tags))
+			s.StackTags[stack] = merged
+		}
+		for k, v := range tags {
+			merged[k] = v
+		}
+	}
+}
+
+// ReservedConfigNamespaces is the default list of config namespaces reserved for Pulumi's internal settings, in which
+// users should not store their own config.
+var ReservedConfigNamespaces = []string{"pulumi"}
+
+// ValidateConfigNamespaces returns an error describing every stack config key in the settings whose namespace is one
+// of the given reserved namespaces, typically ReservedConfigNamespaces.
+func (s *Settings) ValidateConfigNamespaces(reserved []string) error {
+	stacks := make([]string, 0, len(s.StackConfig))
+	for stack := range s.StackConfig {
+		stacks = append(stacks, string(stack))
+	}
+	sort.Strings(stacks)
+
+	var errs *multierror.Error
+	for _, stack := range stacks {
+		for _, key := range sortedConfigKeys(s.StackConfig[tokens.QName(stack)]) {
+			if isReservedConfigNamespace(key.Namespace(), reserved) {
+				errs = multierror.Append(errs, fmt.Errorf(
+					"config key '%v' for stack '%v' uses the reserved namespace '%v'", key, stack, key.Namespace()))
+			}
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+func isReservedConfigNamespace(namespace string, reserved []string) bool {
+	for _, r := range reserved {
+		if namespace == r {
+			return true
+		}
+	}
+	return false
+}
+
+// sortedConfigKeys returns the keys of m in sorted order.
+func sortedConfigKeys(m config.Map) []config.Key {
+	keys := make([]config.Key, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Sort(config.KeyArray(keys))
+	return keys
+}
+
+// RedactedSecretValue is the placeholder that Settings.Redacted substitutes for secret config values.
+const RedactedSecretValue = "[secret]"
+
+// Redacted returns a deep copy of the settings in which every secret config value, including secrets nested inside
+// object values, has been replaced by RedactedSecretValue. The result is safe to log or display; the receiver is not
+// modified.
+func (s *Settings) Redacted() *Settings {
+	return s.copyWith(redactConfigValue)
+}
+
+// copyWith returns a deep copy of the settings, passing each config value through mapValue.
+func (s *Settings) copyWith(mapValue func(config.Value) config.Value) *Settings {
+	copied := &Settings{Stack: s.Stack, ProjectPath: s.ProjectPath, ProjectName: s.ProjectName, Format: s.Format}
+
+	copied.StackConfig = copyStackConfig(s.StackConfig, mapValue)
+	copied.ConfigDeprecated = copyStackConfig(s.ConfigDeprecated, mapValue)
+
+	if s.StackTags != nil {
+		copied.StackTags = make(map[tokens.QName]map[string]string, len(s.StackTags))
+		for stack, tags := range s.StackTags {
+			copiedTags := make(map[string]string, len(tags))
+			for k, v := range tags {
+				copiedTags[k] = v
+			}
+			copied.StackTags[stack] = copiedTags
+		}
+	}
+
+	return copied
+}
+
+// copyStackConfig returns a deep copy of the configuration of each stack, passing each config value through mapValue.
+func copyStackConfig(
+	stacks map[tokens.QName]config.Map,
+	mapValue func(config.Value) config.Value,
+) map[tokens.QName]config.Map {
+	if stacks == nil {
+		return nil
+	}
+	copied := make(map[tokens.QName]config.Map, len(stacks))
+	for stack, stackConfig := range stacks {
+		var copiedConfig config.Map
+		if stackConfig != nil {
+			copiedConfig = make(config.Map, len(stackConfig))
+			for k, v := range stackConfig {
+				copiedConfig[k] = mapValue(v)
+			}
+		}
+		copied[stack] = copiedConfig
+	}
+	return copied
+}
+
+// redactConfigValue replaces a secret value, or the secret parts of an object value, with RedactedSecretValue. If
+// an object value can't be decoded the whole value is redacted.
+func redactConfigValue(v config.Value) config.Value {
+	if !v.Secure() {
+		return v
+	}
+	if v.Object() {
+		if obj, err := v.ToObject(); err == nil {
+			if b, err := json.Marshal(redactSecureObject(obj)); err == nil {
+				return config.NewObjectValue(string(b))
+			}
+		}
+	}
+	return config.NewValue(RedactedSecretValue)
+}
+
+// redactSecureObject walks an object value, replacing each `{"secure": "<ciphertext>"}` map with RedactedSecretValue.
+// Maps decoded from YAML, with interface{} keys, are walked too.
+func redactSecureObject(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if _, ok := v["secure"].(string); ok && len(v) == 1 {
+			return RedactedSecretValue
+		}
+		m := make(map[string]interface{}, len(v))
+		for k, e := range v {
+			m[k] = redactSecureObject(e)
+		}
+		return m
+	case map[interface{}]interface{}:
+		if _, ok := v["secure"].(string); ok && len(v) == 1 {
+			return RedactedSecretValue
+		}
+		m := make(map[interface{}]interface{}, len(v))
+		for k, e := range v {
+			m[k] = redactSecureObject(e)
+		}
+		return m
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for i, e := range v {
+			a[i] = redactSecureObject(e)
+		}
+		return a
+	default:
+		return v
+	}
 }
@@ -0,0 +1,239 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workspace
+
+import (
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSettingsRedacted(t *testing.T) {
+	t.Parallel()
+
+	region := config.MustMakeKey("aws", "region")
+	token := config.MustMakeKey("proj", "token")
+	db := config.MustMakeKey("proj", "db")
+	settings := &Settings{
+		Stack: "dev",
+		StackConfig: map[tokens.QName]config.Map{
+			"dev": {
+				region: config.NewValue("us-west-2"),
+				token:  config.NewSecureValue("c2VjcmV0"),
+				db:     config.NewSecureObjectValue(`{"user":"admin","password":{"secure":"cGFzc3dvcmQ="}}`),
+			},
+			"empty": nil,
+		},
+	}
+
+	redacted := settings.Redacted()
+	assert.Equal(t, "dev", redacted.Stack)
+
+	dev := redacted.StackConfig["dev"]
+	assert.Equal(t, config.NewValue("us-west-2"), dev[region])
+	assert.Equal(t, config.NewValue(RedactedSecretValue), dev[token])
+	assert.False(t, dev[db].Secure())
+	obj, err := dev[db].ToObject()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"user": "admin", "password": RedactedSecretValue}, obj)
+	assert.Contains(t, redacted.StackConfig, tokens.QName("empty"))
+
+	// The original settings are untouched.
+	assert.Equal(t, config.NewSecureValue("c2VjcmV0"), settings.StackConfig["dev"][token])
+	assert.True(t, settings.StackConfig["dev"][db].Secure())
+	dev[region] = config.NewValue("mutated")
+	assert.Equal(t, config.NewValue("us-west-2"), settings.StackConfig["dev"][region])
+}
+
+func TestSettingsValidateConfigNamespaces(t *testing.T) {
+	t.Parallel()
+
+	settings := &Settings{
+		StackConfig: map[tokens.QName]config.Map{
+			"dev": {
+				config.MustMakeKey("proj", "region"):           config.NewValue("us-west-2"),
+				config.MustMakeKey("pulumi", "template"):       config.NewValue("aws-go"),
+				config.MustMakeKey("aws", "region"):            config.NewValue("us-west-2"),
+				config.MustMakeKey("internal", "featureFlags"): config.NewValue("on"),
+			},
+		},
+	}
+
+	err := settings.ValidateConfigNamespaces(ReservedConfigNamespaces)
+	assert.ErrorContains(t, err, "config key 'pulumi:template' for stack 'dev' uses the reserved namespace 'pulumi'")
+	assert.NotContains(t, err.Error(), "proj:region")
+	assert.NotContains(t, err.Error(), "internal:featureFlags")
+
+	// The list of reserved namespaces is configurable.
+	err = settings.ValidateConfigNamespaces([]string{"internal"})
+	assert.ErrorContains(t, err, "config key 'internal:featureFlags' for stack 'dev' uses the reserved namespace")
+	assert.NotContains(t, err.Error(), "pulumi:template")
+
+	assert.NoError(t, settings.ValidateConfigNamespaces(nil))
+	assert.NoError(t, (&Settings{}).ValidateConfigNamespaces(ReservedConfigNamespaces))
+}
+
+func TestSettingsMerge(t *testing.T) {
+	t.Parallel()
+
+	region := config.MustMakeKey("proj", "region")
+	token := config.MustMakeKey("proj", "token")
+	profile := config.MustMakeKey("aws", "profile")
+
+	t.Run("DisjointStacks", func(t *testing.T) {
+		t.Parallel()
+
+		settings := &Settings{
+			Stack:       "dev",
+			StackConfig: map[tokens.QName]config.Map{"dev": {region: config.NewValue("us-west-2")}},
+			ProjectPath: "/projects/proj/Pulumi.yaml",
+		}
+		settings.Merge(&Settings{
+			StackConfig: map[tokens.QName]config.Map{"prod": {region: config.NewValue("us-east-1")}},
+			StackTags:   map[tokens.QName]map[string]string{"prod": {"team": "payments"}},
+			ProjectPath: "/elsewhere/Pulumi.yaml",
+		})
+		assert.Equal(t, &Settings{
+			Stack: "dev",
+			StackConfig: map[tokens.QName]config.Map{
+				"dev":  {region: config.NewValue("us-west-2")},
+				"prod": {region: config.NewValue("us-east-1")},
+			},
+			StackTags:   map[tokens.QName]map[string]string{"prod": {"team": "payments"}},
+			ProjectPath: "/projects/proj/Pulumi.yaml",
+		}, settings)
+	})
+
+	t.Run("OverlappingKeys", func(t *testing.T) {
+		t.Parallel()
+
+		settings := &Settings{
+			Stack: "dev",
+			StackConfig: map[tokens.QName]config.Map{
+				"dev": {region: config.NewValue("us-west-2"), token: config.NewSecureValue("b2xk")},
+			},
+			StackTags: map[tokens.QName]map[string]string{"dev": {"team": "payments", "env": "dev"}},
+		}
+		local := &Settings{
+			Stack: "prod",
+			StackConfig: map[tokens.QName]config.Map{
+				"dev": {token: config.NewSecureValue("bmV3"), profile: config.NewValue("dev")},
+			},
+			StackTags: map[tokens.QName]map[string]string{"dev": {"team": "platform"}},
+		}
+		settings.Merge(local)
+		assert.Equal(t, &Settings{
+			Stack: "prod",
+			StackConfig: map[tokens.QName]config.Map{
+				"dev": {
+					region:  config.NewValue("us-west-2"),
+					token:   config.NewSecureValue("bmV3"),
+					profile: config.NewValue("dev"),
+				},
+			},
+			StackTags: map[tokens.QName]map[string]string{"dev": {"team": "platform", "env": "dev"}},
+		}, settings)
+
+		// The merged settings don't share maps with other.
+		local.StackConfig["dev"][region] = config.NewValue("eu-west-1")
+		local.StackTags["dev"]["env"] = "changed"
+		assert.Equal(t, config.NewValue("us-west-2"), settings.StackConfig["dev"][region])
+		assert.Equal(t, "dev", settings.StackTags["dev"]["env"])
+	})
+
+	t.Run("LegacyConfig", func(t *testing.T) {
+		t.Parallel()
+
+		settings := &Settings{ConfigDeprecated: map[tokens.QName]config.Map{"dev": {region: config.NewValue("a")}}}
+		settings.Merge(&Settings{ConfigDeprecated: map[tokens.QName]config.Map{"dev": {token: config.NewValue("b")}}})
+		assert.Equal(t, &Settings{
+			StackConfig: map[tokens.QName]config.Map{"dev": {region: config.NewValue("a"), token: config.NewValue("b")}},
+		}, settings)
+	})
+
+	t.Run("Nil", func(t *testing.T) {
+		t.Parallel()
+
+		var nilSettings *Settings
+		assert.NotPanics(t, func() { nilSettings.Merge(&Settings{Stack: "dev"}) })
+		assert.Nil(t, nilSettings)
+
+		empty := &Settings{}
+		empty.Merge(nil)
+		assert.Equal(t, &Settings{}, empty)
+		empty.Merge(&Settings{})
+		assert.Equal(t, &Settings{}, empty)
+
+		// Stacks whose maps are nil on either side are merged too.
+		settings := &Settings{StackConfig: map[tokens.QName]config.Map{"dev": nil}}
+		settings.Merge(&Settings{
+			StackConfig: map[tokens.QName]config.Map{"dev": {region: config.NewValue("a")}, "prod": nil},
+			StackTags:   map[tokens.QName]map[string]string{"dev": nil},
+		})
+		assert.Equal(t, &Settings{
+			StackConfig: map[tokens.QName]config.Map{"dev": {region: config.NewValue("a")}, "prod": {}},
+			StackTags:   map[tokens.QName]map[string]string{"dev": {}},
+		}, settings)
+	})
+}
+
+func TestValidateSettings(t *testing.T) {
+	t.Parallel()
+
+	valid := `{
+    "stack": "dev",
+    "config": {"dev": {"proj:region": "us-west-2", "proj:password": {"secure": "c2VjcmV0"}}},
+    "stackTags": {"dev": {"team": "payments"}}
+}`
+	assert.NoError(t, ValidateSettings([]byte(valid)))
+
+	tests := []struct {
+		name     string
+		settings string
+		expected string
+	}{
+		{name: "StackNotString", settings: `{"stack": 1}`, expected: "#/stack: expected string, but got number"},
+		{name: "ConfigNotObject", settings: `{"config": []}`, expected: "#/config: expected object or null"},
+		{
+			name:     "BadConfigKey",
+			settings: `{"config": {"dev": {"region": "us-west-2"}}}`,
+			expected: "#/config/dev/region: does not match pattern",
+		},
+		{
+			name:     "BadStackName",
+			settings: `{"config": {"not a stack": {}}}`,
+			expected: "#/config: 'not a stack' is not a valid stack name",
+		},
+		{
+			name:     "BadStackConfigStackName",
+			settings: `{"stackConfig": {"not a stack": {}}}`,
+			expected: "#/stackConfig: 'not a stack' is not a valid stack name",
+		},
+		{
+			name:     "TagNotString",
+			settings: `{"stackTags": {"dev": {"team": 1}}}`,
+			expected: "#/stackTags/dev/team: expected string, but got number",
+		},
+	}
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			t.Parallel()
+			assert.ErrorContains(t, ValidateSettings([]byte(tt.settings)), tt.expected)
+		})
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workspace
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+)
+
+// SettingsStore is a key-value store that holds serialized workspace settings, for embedders that keep workspace
+// state somewhere other than files, such as etcd or Consul. The key of a workspace's settings is the path derived for
+// its settings file, as by DefaultSettingsPath.
+type SettingsStore interface {
+	// Load returns the data stored under key, and false if there is none.
+	Load(key string) ([]byte, bool, error)
+	// Save stores data under key, replacing any data already stored there.
+	Save(key string, data []byte) error
+	// Delete removes the data stored under key. Deleting a key that holds no data is not an error.
+	Delete(key string) error
+}
+
+// fileSettingsStore is the default SettingsStore, which stores the settings in the file named by their key. Saves
+// replace the file atomically and are abandoned if ctx is canceled first.
+type fileSettingsStore struct {
+	ctx context.Context
+	fs  workspaceFS
+}
+
+func (s fileSettingsStore) Load(key string) ([]byte, bool, error) {
+	b, err := s.fs.ReadFile(key)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	return b, true, nil
+}
+
+func (s fileSettingsStore) Save(key string, data []byte) error {
+	if err := s.fs.MkdirAll(filepath.Dir(key), 0o700); err != nil {
+		return err
+	}
+	return atomicWriteFile(s.ctx, s.fs, key, data, 0o600)
+}
+
+func (s fileSettingsStore) Delete(key string) error {
+	if err := s.fs.Remove(key); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -15,52 +15,349 @@
 package workspace
 
 import (
+	"bytes"
+	"context"
 	//nolint:gosec
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/pulumi/pulumi/sdk/v3/go/common/encoding"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
 	"github.com/pulumi/pulumi/sdk/v3/go/common/util/contract"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/fsutil"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/logging"
 )
 
 // W offers functionality for interacting with Pulumi workspaces.
+//
+// The methods that read or edit the config or tags of a single stack may be called concurrently: edits to different
+// stacks proceed in parallel, while edits to the same stack are serialized. Save, Snapshot and Restore wait for all
+// of them. Changes made directly through the pointer returned by Settings are not synchronized.
 type W interface {
 	Settings() *Settings // returns a mutable pointer to the optional workspace settings info.
 	Save() error         // saves any modifications to the workspace.
+
+	// SaveWithResult is like Save, but also reports whether the settings file was written, deleted because the
+	// settings are empty, or left unchanged because it already held the settings.
+	SaveWithResult() (SaveResult, error)
+
+	// SetConfigFromEnv imports every environment variable whose name starts with prefix into the given stack's
+	// config, returning the keys that were set. See ConfigKeyFromEnv for how names map onto keys. Variables whose
+	// names end in "_SECRET" are encrypted with the given encrypter and stored as secrets. The encrypter may be nil
+	// if no such variable is expected; importing a secret without one is an error.
+	SetConfigFromEnv(
+		ctx context.Context, stack tokens.QName, prefix string, encrypter config.Encrypter,
+	) ([]config.Key, error)
+
+	ConfigKeys(stack tokens.QName) []config.Key              // returns the sorted keys of the stack's config.
+	StackTags(stack tokens.QName) map[string]string          // returns a copy of the tags stored for the stack.
+	SetStackTags(stack tokens.QName, tags map[string]string) // replaces the stack's tags; empty tags remove them.
+
+	// EffectiveConfig returns the stack's config overlaid on the project-wide values declared by the project's
+	// `config` block. A value set for the stack always takes precedence over the project's `value` or `default` for
+	// the same key. It is an error for the stack to lack a value that the project requires but doesn't provide.
+	EffectiveConfig(stack tokens.QName) (config.Map, error)
+	// ConfigTypeReport checks the stack's config against the types the project's `config` block declares, and reports
+	// for each key that has a declared type whether its stored value coerces cleanly to that type: the report maps
+	// the key to "" if it does, and to a description of the problem if it doesn't. Keys without a declared type and
+	// secure values, which can't be read without decrypting them, aren't reported. The report is nil if the project
+	// can't be loaded.
+	ConfigTypeReport(stack tokens.QName) map[config.Key]string
+	// MoveConfig moves the config stored for stack from to stack to, as when a stack is renamed. Secure values are moved
+	// as they are, still encrypted. It is an error for to to already have config, unless overwrite is true, in which
+	// case its config is replaced.
+	MoveConfig(from, to tokens.QName, overwrite bool) error
+	// ClearAllConfig removes the config of every stack, leaving the other settings as they are. If nothing else is
+	// set, the next Save deletes the settings file.
+	ClearAllConfig()
+
+	// ExportConfigDotenv renders the stack's plaintext config in the dotenv format, one `NAME=value` line per key
+	// named as described by ConfigKeyToEnv. Secret values are skipped with a warning.
+	ExportConfigDotenv(stack tokens.QName) ([]byte, error)
+	// ImportConfigDotenv reads dotenv data, as written by ExportConfigDotenv, into the stack's config as plaintext
+	// values. Names map onto keys as described by ConfigKeyFromEnv; names marking secrets are rejected.
+	ImportConfigDotenv(stack tokens.QName, data []byte) error
+
+	// LoadStackConfigFile reads the config of the given stack from its `Pulumi.<stack>.yaml` file next to the project
+	// file in projectDir, honoring the project's `stackConfigDir`. Secure values are returned still encrypted, and a
+	// missing file yields an empty map.
+	LoadStackConfigFile(stack tokens.QName, projectDir string) (config.Map, error)
+	// SaveStackConfigFile writes cfg as the config of the given stack to the file read by LoadStackConfigFile,
+	// preserving the file's other attributes such as its secrets provider.
+	SaveStackConfigFile(stack tokens.QName, projectDir string, cfg config.Map) error
+	// ListLocalStacks returns the names of the stacks that have a `Pulumi.<stack>.yaml` config file for the project in
+	// projectDir, honoring the project's `stackConfigDir`, in sorted order. Files whose names don't hold a valid stack
+	// name are skipped with a warning.
+	ListLocalStacks(projectDir string) ([]tokens.QName, error)
+
+	// Snapshot returns a deep copy of the current settings, which can later be passed to Restore to undo a sequence of
+	// changes.
+	Snapshot() *Settings
+	// Restore replaces the in-memory settings with a copy of s, typically a value returned by Snapshot. Callers must
+	// Save to persist the restored settings.
+	Restore(s *Settings)
+
+	// Events returns a channel on which the workspace reports its mutations. The channel is shared by every caller
+	// and holds up to WorkspaceEventBufferSize undelivered events; when it is full, the oldest undelivered event is
+	// discarded to make room for the new one, so producers such as Save never block. Events are delivered in the
+	// order they occurred, but a slow consumer may miss events. The channel is never closed.
+	Events() <-chan WorkspaceEvent
+
+	// WithContext returns a view of the workspace whose disk operations, such as Save, honor ctx. A save that is
+	// canceled part way through leaves the previously saved settings intact.
+	WithContext(ctx context.Context) W
+
+	// Export bundles the project file in projectDir, typically ProjectRoot, along with its stack config files and the
+	// workspace settings, into a .tar.gz archive that Import can restore on another machine. Secure values are
+	// exported still encrypted. projectDir must hold the workspace's own project. Projects that use `extends`, or keep
+	// their stack config files outside of projectDir, can't be exported, since the bundle only holds files within the
+	// project directory.
+	Export(projectDir string) ([]byte, error)
+	// Import extracts a bundle written by Export into destDir, which must not already hold a project file or any of
+	// the bundled files, and saves the bundled settings as the workspace settings of the extracted project. The
+	// bundled project and settings are validated before any file is written, and if the import fails part way
+	// through, the files and directories it created are removed again.
+	Import(data []byte, destDir string) error
+
+	// WorkspaceSettingsFile returns the path of the file the settings are saved to, or "" for in-memory workspaces.
+	WorkspaceSettingsFile() string
+
+	// ProjectPath returns the absolute path of the workspace's project file, or "" for in-memory workspaces.
+	ProjectPath() string
+	// ProjectRoot returns the absolute path of the directory containing the workspace's project file, against which
+	// paths in the project such as `main` are resolved, or "" for in-memory workspaces.
+	ProjectRoot() string
+}
+
+// SaveResult reports what W.SaveWithResult did with the settings file.
+type SaveResult int
+
+const (
+	// SaveUnchanged means that the settings file already held the settings, or that the settings are empty and there
+	// was no file to delete, so nothing was written.
+	SaveUnchanged SaveResult = iota
+	// SaveWritten means that the settings were written to the settings file.
+	SaveWritten
+	// SaveDeleted means that the settings are empty, so the settings file was deleted.
+	SaveDeleted
+)
+
+func (r SaveResult) String() string {
+	switch r {
+	case SaveUnchanged:
+		return "Unchanged"
+	case SaveWritten:
+		return "Written"
+	case SaveDeleted:
+		return "Deleted"
+	default:
+		return fmt.Sprintf("SaveResult(%d)", int(r))
+	}
+}
+
+// WorkspaceEventKind identifies the kind of change a WorkspaceEvent reports.
+type WorkspaceEventKind int
+
+const (
+	// SettingsSaved is reported after the workspace settings have been written to (or removed from) disk.
+	SettingsSaved WorkspaceEventKind = iota
+	// ConfigChanged is reported after the config for a stack has been changed in memory.
+	ConfigChanged
+	// ProjectReloaded is reported to a workspace cached by NewFrom when a later call to NewFrom finds that its project
+	// file has changed. The workspace has been replaced in the cache by one reflecting the changed file.
+	ProjectReloaded
+)
+
+func (k WorkspaceEventKind) String() string {
+	switch k {
+	case SettingsSaved:
+		return "SettingsSaved"
+	case ConfigChanged:
+		return "ConfigChanged"
+	case ProjectReloaded:
+		return "ProjectReloaded"
+	default:
+		return fmt.Sprintf("WorkspaceEventKind(%d)", int(k))
+	}
 }
 
+// WorkspaceEvent describes a change made to a workspace.
+type WorkspaceEvent struct {
+	Kind  WorkspaceEventKind // the kind of change.
+	Stack tokens.QName       // the affected stack, for ConfigChanged events.
+}
+
+// WorkspaceEventBufferSize is the number of undelivered events a workspace's event channel holds.
+const WorkspaceEventBufferSize = 64
+
 type projectWorkspace struct {
 	name     tokens.PackageName // the package this workspace is associated with.
 	project  string             // the path to the Pulumi.[yaml|json] file for this project.
 	settings *Settings          // settings for this workspace.
+
+	settingsPathFunc SettingsPathFunc // derives the settings file path; nil means DefaultSettingsPath.
+	fs               workspaceFS      // the filesystem settings are stored in; nil means the real filesystem.
+	store            SettingsStore    // the store settings are kept in; nil means files in fs.
+
+	dirty    bool     // true if the settings were migrated when read, so the next save must write them.
+	inMemory bool     // true if the settings are never written to disk.
+	saved    []byte   // for in-memory workspaces, the serialized settings as of the last save.
+	proj     *Project // for in-memory workspaces, the project; others read it from the project file when needed.
+
+	eventsOnce sync.Once           // guards the creation of events.
+	events     chan WorkspaceEvent // buffered channel of workspace events.
+
+	stackLocks stackLocks // serializes the edits to each stack's settings.
+	mapsMutex  sync.Mutex // guards the stack-keyed maps of settings against concurrent edits of different stacks.
+}
+
+// stackLocks holds a mutex per stack. Methods that edit or read the settings of a single stack hold its mutex, so
+// that edits to different stacks proceed concurrently while edits to the same stack are serialized. A method holding
+// a stack's mutex takes projectWorkspace.mapsMutex only while it looks up or inserts the stack in the settings' maps.
+type stackLocks struct {
+	mutex sync.Mutex                   // guards locks; only lockAllStacks waits for a stack's mutex while holding it.
+	locks map[tokens.QName]*sync.Mutex // the mutex of each stack.
+}
+
+// get returns the mutex of the given stack, creating it if necessary. The caller must hold sl.mutex.
+func (sl *stackLocks) get(stack tokens.QName) *sync.Mutex {
+	if sl.locks == nil {
+		sl.locks = make(map[tokens.QName]*sync.Mutex)
+	}
+	mu, ok := sl.locks[stack]
+	if !ok {
+		mu = &sync.Mutex{}
+		sl.locks[stack] = mu
+	}
+	return mu
+}
+
+// lockStack locks the settings of the given stack, returning a function that unlocks them.
+func (pw *projectWorkspace) lockStack(stack tokens.QName) func() {
+	return pw.lockStacks(stack)
+}
+
+// lockStacks locks the settings of the given stacks in sorted order, returning a function that unlocks them.
+func (pw *projectWorkspace) lockStacks(stacks ...tokens.QName) func() {
+	sorted := make([]string, len(stacks))
+	for i, stack := range stacks {
+		sorted[i] = string(stack)
+	}
+	sort.Strings(sorted)
+
+	// Look up every mutex before waiting for any of them, so that we never wait for stackLocks.mutex while holding a
+	// stack's mutex, which could deadlock with lockAllStacks.
+	pw.stackLocks.mutex.Lock()
+	mutexes := make([]*sync.Mutex, len(sorted))
+	for i, stack := range sorted {
+		mutexes[i] = pw.stackLocks.get(tokens.QName(stack))
+	}
+	pw.stackLocks.mutex.Unlock()
+
+	for _, mu := range mutexes {
+		mu.Lock()
+	}
+	return func() {
+		for _, mu := range mutexes {
+			mu.Unlock()
+		}
+	}
+}
+
+// lockAllStacks locks the settings of every stack, returning a function that unlocks them. The stacks are locked in
+// sorted order, and no stack can be added until they are unlocked, so concurrent calls can't deadlock. Only stacks
+// with a mutex are locked: every edit to a stack's settings holds the stack's mutex, so the settings of a stack
+// without one aren't being edited, and the settings' maps aren't read here, since edits insert into them.
+func (pw *projectWorkspace) lockAllStacks() func() {
+	pw.stackLocks.mutex.Lock()
+	stacks := make([]string, 0, len(pw.stackLocks.locks))
+	for stack := range pw.stackLocks.locks {
+		stacks = append(stacks, string(stack))
+	}
+	sort.Strings(stacks)
+
+	locked := make([]*sync.Mutex, 0, len(stacks))
+	for _, stack := range stacks {
+		mu := pw.stackLocks.locks[tokens.QName(stack)]
+		mu.Lock()
+		locked = append(locked, mu)
+	}
+	return func() {
+		for _, mu := range locked {
+			mu.Unlock()
+		}
+		pw.stackLocks.mutex.Unlock()
+	}
+}
+
+// cacheEntry is a workspace cached by NewFrom, along with the state of its project file when it was loaded.
+type cacheEntry struct {
+	w       *projectWorkspace
+	modTime time.Time // the modification time of the project file.
+	size    int64     // the size of the project file.
 }
 
 var (
-	cache      = make(map[string]W)
+	cache      = make(map[string]cacheEntry)
 	cacheMutex sync.RWMutex
 )
 
-func loadFromCache(key string) (W, bool) {
+func loadFromCache(key string) (cacheEntry, bool) {
 	cacheMutex.RLock()
 	defer cacheMutex.RUnlock()
 
-	w, ok := cache[key]
-	return w, ok
+	entry, ok := cache[key]
+	return entry, ok
 }
 
-func upsertIntoCache(key string, w W) {
-	contract.Requiref(w != nil, "w", "cannot be nil")
+func upsertIntoCache(key string, entry cacheEntry) {
+	contract.Requiref(entry.w != nil, "entry.w", "cannot be nil")
 
 	cacheMutex.Lock()
 	defer cacheMutex.Unlock()
 
-	cache[key] = w
+	cache[key] = entry
+}
+
+// ClearCache discards every workspace cached by NewFrom, so that later calls load fresh workspaces from disk. It is
+// safe to call concurrently with NewFrom and EvictFromCache; a NewFrom that is already running may still cache its
+// workspace after the cache was cleared. Workspaces that were already returned are unaffected and remain usable.
+func ClearCache() {
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	cache = make(map[string]cacheEntry)
+}
+
+// EvictFromCache discards the workspace cached by NewFrom for dir, if any, so that the next NewFrom(dir) loads a
+// fresh workspace from disk. It offers the same guarantees as ClearCache.
+func EvictFromCache(dir string) {
+	// NewFrom caches workspaces by absolute directory, and fails itself if dir can't be made absolute.
+	if absDir, err := filepath.Abs(dir); err == nil {
+		dir = absDir
+	}
+
+	cacheMutex.Lock()
+	defer cacheMutex.Unlock()
+
+	delete(cache, dir)
+}
+
+// isFresh returns true if the project file of the cached workspace hasn't changed since it was loaded.
+func (entry cacheEntry) isFresh() bool {
+	info, err := os.Stat(entry.w.project)
+	return err == nil && info.ModTime().Equal(entry.modTime) && info.Size() == entry.size
 }
 
 // New creates a new workspace using the current working directory.
@@ -75,14 +372,66 @@ func New() (W, error) {
 // NewFrom creates a new Pulumi workspace in the given directory. Requires a Pulumi.yaml file be present in the
 // folder hierarchy between dir and the .pulumi folder.
 func NewFrom(dir string) (W, error) {
+	return newFrom(dir, nil, nil)
+}
+
+// SettingsPathFunc derives the path of the workspace settings file for the project with the given name whose project
+// file is at projectPath.
+type SettingsPathFunc func(name tokens.PackageName, projectPath string) string
+
+// DefaultSettingsPath is the SettingsPathFunc used by New and NewFrom. It places the settings under the workspaces
+// directory of the Pulumi home, in a file named after the project and a hash of its project file path. The Pulumi home
+// is the directory named by the PULUMI_HOME environment variable if it is set, and ~/.pulumi otherwise.
+func DefaultSettingsPath(name tokens.PackageName, projectPath string) string {
+	root, err := GetPulumiHomeDir()
+	contract.AssertNoErrorf(err, "could not get workspace path")
+	return SettingsPathUnder(root)(name, projectPath)
+}
+
+// SettingsPathUnder returns a SettingsPathFunc, for use with NewFromWithSettingsPath, that lays out the settings as
+// DefaultSettingsPath does but under root rather than the Pulumi home. It suits environments, such as CI containers,
+// whose home directory is read-only or missing, when setting PULUMI_HOME is not an option.
+func SettingsPathUnder(root string) SettingsPathFunc {
+	return func(name tokens.PackageName, projectPath string) string {
+		uniqueFileName := string(name) + "-" + sha1HexString(projectPath) + "-" + WorkspaceFile
+		return filepath.Join(root, WorkspaceDir, uniqueFileName)
+	}
+}
+
+// NewFromWithSettingsPath is like NewFrom, but reads and saves the workspace settings at the path derived by
+// settingsPath rather than DefaultSettingsPath. Such workspaces aren't cached, so each call returns an independent
+// workspace.
+func NewFromWithSettingsPath(dir string, settingsPath SettingsPathFunc) (W, error) {
+	contract.Requiref(settingsPath != nil, "settingsPath", "must not be nil")
+	return newFrom(dir, settingsPath, nil)
+}
+
+// NewFromWithSettingsStore is like NewFrom, but reads and saves the workspace settings in store, under the key
+// DefaultSettingsPath derives for the project, rather than in a file. Such workspaces aren't cached, so each call
+// returns an independent workspace.
+func NewFromWithSettingsStore(dir string, store SettingsStore) (W, error) {
+	contract.Requiref(store != nil, "store", "must not be nil")
+	return newFrom(dir, nil, store)
+}
+
+func newFrom(dir string, settingsPath SettingsPathFunc, store SettingsStore) (W, error) {
 	absDir, err := filepath.Abs(dir)
 	if err != nil {
 		return nil, err
 	}
 	dir = absDir
 
-	if w, ok := loadFromCache(dir); ok {
-		return w, nil
+	// Only workspaces using the default settings path and store are shared through the cache. A cached workspace is
+	// reloaded if its project file has changed since, and the stale workspace is sent a ProjectReloaded event.
+	cached := settingsPath == nil && store == nil
+	var stale *projectWorkspace
+	if cached {
+		if entry, ok := loadFromCache(dir); ok {
+			if entry.isFresh() {
+				return entry.w, nil
+			}
+			stale = entry.w
+		}
 	}
 
 	path, err := DetectProjectPathFrom(dir)
@@ -93,14 +442,21 @@ func NewFrom(dir string) (W, error) {
 			"created a project yet, use `pulumi new` to do so", dir)
 	}
 
+	// Stat the project file before reading it, so that a change made while it is read is noticed by the next call.
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
 	proj, err := LoadProject(path)
 	if err != nil {
 		return nil, err
 	}
 
 	w := &projectWorkspace{
-		name:    proj.Name,
-		project: path,
+		name:             proj.Name,
+		project:          path,
+		settingsPathFunc: settingsPath,
+		store:            store,
 	}
 
 	err = w.readSettings()
@@ -108,91 +464,956 @@ func NewFrom(dir string) (W, error) {
 		return nil, fmt.Errorf("unable to read workspace settings: %w", err)
 	}
 
-	upsertIntoCache(dir, w)
+	if cached {
+		upsertIntoCache(dir, cacheEntry{w: w, modTime: info.ModTime(), size: info.Size()})
+	}
+	if stale != nil {
+		stale.emit(WorkspaceEvent{Kind: ProjectReloaded})
+	}
 	return w, nil
 }
 
+// NewInMemory creates a workspace for the given project that never touches the disk: Save records the settings in
+// memory only, and the workspace starts with empty settings. In-memory workspaces aren't cached, so each call returns
+// an independent workspace. They are intended for tests and sandboxed execution.
+func NewInMemory(proj *Project) W {
+	contract.Requiref(proj != nil, "proj", "must not be nil")
+
+	return &projectWorkspace{
+		name:     proj.Name,
+		settings: &Settings{},
+		inMemory: true,
+		proj:     proj,
+	}
+}
+
+// OpenSettings reads the workspace settings for the project with the given name whose project file is at projectPath,
+// without requiring the project file to exist. projectPath must be the absolute path that was used when the settings
+// were written. The returned function saves any changes made to the settings; if the settings are empty at that point
+// the settings file is removed.
+func OpenSettings(name tokens.PackageName, projectPath string) (*Settings, func() error, error) {
+	contract.Requiref(name != "", "name", "must not be empty")
+	contract.Requiref(projectPath != "", "projectPath", "must not be empty")
+
+	pw := &projectWorkspace{
+		name:    name,
+		project: projectPath,
+	}
+	if err := pw.readSettings(); err != nil {
+		return nil, nil, fmt.Errorf("unable to read workspace settings: %w", err)
+	}
+	return pw.settings, pw.Save, nil
+}
+
 func (pw *projectWorkspace) Settings() *Settings {
 	return pw.settings
 }
 
+func (pw *projectWorkspace) Snapshot() *Settings {
+	defer pw.lockAllStacks()()
+	return pw.settings.copyWith(func(v config.Value) config.Value { return v })
+}
+
+func (pw *projectWorkspace) Restore(s *Settings) {
+	contract.Requiref(s != nil, "s", "must not be nil")
+	defer pw.lockAllStacks()()
+	*pw.settings = *s.copyWith(func(v config.Value) config.Value { return v })
+	pw.settings.migrateConfig()
+}
+
 func (pw *projectWorkspace) Save() error {
+	_, err := pw.save(context.Background())
+	return err
+}
+
+func (pw *projectWorkspace) SaveWithResult() (SaveResult, error) {
+	return pw.save(context.Background())
+}
+
+// WithContext returns a view of the workspace whose disk operations honor ctx. The view shares the workspace's
+// settings and events; only the operations made through it are bound to ctx.
+func (pw *projectWorkspace) WithContext(ctx context.Context) W {
+	contract.Requiref(ctx != nil, "ctx", "must not be nil")
+	return &contextWorkspace{projectWorkspace: pw, ctx: ctx}
+}
+
+// contextWorkspace is a projectWorkspace whose saves are bound to a context.
+type contextWorkspace struct {
+	*projectWorkspace
+	ctx context.Context
+}
+
+func (cw *contextWorkspace) Save() error {
+	_, err := cw.save(cw.ctx)
+	return err
+}
+
+func (cw *contextWorkspace) SaveWithResult() (SaveResult, error) {
+	return cw.save(cw.ctx)
+}
+
+// save writes the settings, abandoning the write if ctx is canceled first. Because settings are written atomically,
+// a canceled save leaves any previously saved settings intact. The file isn't rewritten if it already holds the
+// settings.
+func (pw *projectWorkspace) save(ctx context.Context) (SaveResult, error) {
+	if err := ctx.Err(); err != nil {
+		return SaveUnchanged, err
+	}
+	defer pw.lockAllStacks()()
+
+	if pw.inMemory {
+		var b []byte
+		if !pw.settings.IsEmpty() {
+			var err error
+			if b, err = marshalSettings(pw.settings); err != nil {
+				return SaveUnchanged, err
+			}
+		}
+		result := SaveUnchanged
+		switch {
+		case b == nil && pw.saved != nil:
+			result = SaveDeleted
+		case b != nil && !bytes.Equal(b, pw.saved):
+			result = SaveWritten
+		}
+		pw.saved = b
+		pw.dirty = false
+		pw.emit(WorkspaceEvent{Kind: SettingsSaved})
+		return result, nil
+	}
+
+	store := pw.settingsStore(ctx)
 	settingsFile := pw.settingsPath()
 
 	// If the settings file is empty, don't write an new one, and delete the old one if present. Since we put workspaces
 	// under ~/.pulumi/workspaces, cleaning them out when possible prevents us from littering a bunch of files in the
 	// home directory.
 	if pw.settings.IsEmpty() {
-		err := os.Remove(settingsFile)
-		if err != nil && !os.IsNotExist(err) {
-			return err
+		result, err := pw.deleteSettings(ctx, store, settingsFile)
+		if err != nil {
+			return SaveUnchanged, err
+		}
+		if result == SaveDeleted {
+			pw.removeSettingsLockFile(settingsFile)
+		}
+		pw.emit(WorkspaceEvent{Kind: SettingsSaved})
+		return result, nil
+	}
+
+	// The settings directory must exist for the settings file to be locked.
+	if pw.store == nil {
+		if err := pw.filesystem().MkdirAll(filepath.Dir(settingsFile), 0o700); err != nil {
+			return SaveUnchanged, err
+		}
+	}
+	unlock, err := pw.lockSettingsFile(ctx, settingsFile)
+	if err != nil {
+		return SaveUnchanged, err
+	}
+	defer unlock()
+
+	if pw.project != "" {
+		pw.settings.ProjectPath = filepath.ToSlash(pw.project)
+	}
+	pw.settings.ProjectName = pw.name
+
+	b, err := marshalSettings(pw.settings)
+	if err != nil {
+		return SaveUnchanged, err
+	}
+	result := SaveUnchanged
+	existing, ok, err := store.Load(settingsFile)
+	if err != nil || !ok || pw.dirty || !bytes.Equal(existing, b) {
+		if err = ctx.Err(); err != nil {
+			return SaveUnchanged, err
+		}
+		if err = store.Save(settingsFile, b); err != nil {
+			return SaveUnchanged, err
+		}
+		result = SaveWritten
+	}
+	pw.dirty = false
+	pw.emit(WorkspaceEvent{Kind: SettingsSaved})
+	return result, nil
+}
+
+func (pw *projectWorkspace) Events() <-chan WorkspaceEvent {
+	return pw.eventChannel()
+}
+
+func (pw *projectWorkspace) eventChannel() chan WorkspaceEvent {
+	pw.eventsOnce.Do(func() {
+		pw.events = make(chan WorkspaceEvent, WorkspaceEventBufferSize)
+	})
+	return pw.events
+}
+
+// emit queues an event without blocking, discarding the oldest undelivered event if the channel is full.
+func (pw *projectWorkspace) emit(event WorkspaceEvent) {
+	events := pw.eventChannel()
+	for {
+		select {
+		case events <- event:
+			return
+		default:
+		}
+
+		select {
+		case <-events:
+		default:
+		}
+	}
+}
+
+// marshalSettings serializes the settings in their Format, as indented JSON by default. JSON output is canonicalized
+// by round-tripping it through a generic JSON value, so every object's keys are sorted, including those produced by
+// custom marshalers such as config.Map; the YAML encoder sorts keys itself. This keeps the file byte-for-byte stable
+// for a given set of settings. The stack configuration is also written under the key that older versions of Pulumi
+// read it from.
+func marshalSettings(settings *Settings) ([]byte, error) {
+	if len(settings.StackConfig) != 0 {
+		mirrored := *settings
+		mirrored.ConfigDeprecated = settings.StackConfig
+		settings = &mirrored
+	}
+
+	switch settings.Format {
+	case "", SettingsFormatJSON:
+	case SettingsFormatYAML:
+		return encoding.YAML.Marshal(settings)
+	default:
+		return nil, fmt.Errorf("unknown workspace settings format '%v'", settings.Format)
+	}
+
+	b, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	var canonical interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	// Keep numbers in their original textual form rather than round-tripping them through float64.
+	dec.UseNumber()
+	if err = dec.Decode(&canonical); err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(canonical, "", "    ")
+}
+
+func (pw *projectWorkspace) SetConfigFromEnv(
+	ctx context.Context, stack tokens.QName, prefix string, encrypter config.Encrypter,
+) ([]config.Key, error) {
+	return pw.setConfigFromEnviron(ctx, os.Environ(), stack, prefix, encrypter)
+}
+
+func (pw *projectWorkspace) setConfigFromEnviron(
+	ctx context.Context, environ []string, stack tokens.QName, prefix string, encrypter config.Encrypter,
+) ([]config.Key, error) {
+	contract.Requiref(prefix != "", "prefix", "must not be empty")
+
+	values := make(config.Map)
+	for _, kvp := range environ {
+		name, value, ok := strings.Cut(kvp, "=")
+		if !ok || !strings.HasPrefix(name, prefix) {
+			continue
 		}
+
+		key, secret, err := ConfigKeyFromEnv(pw.name, strings.TrimPrefix(name, prefix))
+		if err != nil {
+			return nil, fmt.Errorf("importing %s: %w", name, err)
+		}
+
+		if secret {
+			if encrypter == nil {
+				return nil, fmt.Errorf("importing %s: secret values can't be imported without an encrypter", name)
+			}
+			ciphertext, err := encrypter.EncryptValue(ctx, value)
+			if err != nil {
+				return nil, fmt.Errorf("encrypting %s: %w", name, err)
+			}
+			values[key] = config.NewSecureValue(ciphertext)
+		} else {
+			values[key] = config.NewValue(value)
+		}
+	}
+
+	return pw.setStackConfig(stack, values), nil
+}
+
+// setStackConfig stores values in the given stack's config, returning the sorted keys that were set.
+func (pw *projectWorkspace) setStackConfig(stack tokens.QName, values config.Map) []config.Key {
+	if len(values) == 0 {
 		return nil
 	}
+	defer pw.lockStack(stack)()
+
+	pw.mapsMutex.Lock()
+	if pw.settings.StackConfig == nil {
+		pw.settings.StackConfig = make(map[tokens.QName]config.Map)
+	}
+	stackConfig, ok := pw.settings.StackConfig[stack]
+	if !ok {
+		stackConfig = make(config.Map)
+		pw.settings.StackConfig[stack] = stackConfig
+	}
+	pw.mapsMutex.Unlock()
+
+	for k, v := range values {
+		stackConfig[k] = v
+	}
+	pw.emit(WorkspaceEvent{Kind: ConfigChanged, Stack: stack})
+	return sortedConfigKeys(values)
+}
+
+func (pw *projectWorkspace) ExportConfigDotenv(stack tokens.QName) ([]byte, error) {
+	defer pw.lockStack(stack)()
+
+	var buf bytes.Buffer
+	stackConfig := pw.stackConfig(stack)
+	for _, key := range sortedConfigKeys(stackConfig) {
+		value := stackConfig[key]
+		if value.Secure() {
+			logging.Warningf("skipping secret config value '%v' while exporting stack '%v' to dotenv", key, stack)
+			continue
+		}
+
+		name, err := ConfigKeyToEnv(pw.name, key)
+		if err != nil {
+			return nil, err
+		}
+		v, err := value.Value(nil)
+		contract.AssertNoErrorf(err, "plaintext config values never fail to decode")
+		fmt.Fprintf(&buf, "%s=%s\n", name, formatDotenvValue(v))
+	}
+	return buf.Bytes(), nil
+}
 
-	err := os.MkdirAll(filepath.Dir(settingsFile), 0o700)
+func (pw *projectWorkspace) ImportConfigDotenv(stack tokens.QName, data []byte) error {
+	entries, err := parseDotenv(data)
 	if err != nil {
 		return err
 	}
 
-	b, err := json.MarshalIndent(pw.settings, "", "    ")
+	values := make(config.Map, len(entries))
+	for _, entry := range entries {
+		key, secret, err := ConfigKeyFromEnv(pw.name, entry.name)
+		if err != nil {
+			return fmt.Errorf("importing %s: %w", entry.name, err)
+		}
+		if secret {
+			return fmt.Errorf("importing %s: secret values cannot be imported from dotenv", entry.name)
+		}
+		values[key] = config.NewValue(entry.value)
+	}
+	pw.setStackConfig(stack, values)
+	return nil
+}
+
+func (pw *projectWorkspace) ConfigKeys(stack tokens.QName) []config.Key {
+	defer pw.lockStack(stack)()
+
+	cfg := pw.stackConfig(stack)
+	if cfg == nil {
+		return nil
+	}
+	return sortedConfigKeys(cfg)
+}
+
+func (pw *projectWorkspace) EffectiveConfig(stack tokens.QName) (config.Map, error) {
+	proj, err := pw.loadProject()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return atomicWriteFile(settingsFile, b)
+
+	unlock := pw.lockStack(stack)
+	effective := config.Map{}
+	for k, v := range pw.stackConfig(stack) {
+		effective[k] = v
+	}
+	unlock()
+
+	if err = ApplyProjectConfig(string(stack), proj, effective); err != nil {
+		return nil, err
+	}
+	return effective, nil
 }
 
-// atomicWriteFile provides a rename based atomic write through a temporary file.
-func atomicWriteFile(path string, b []byte) error {
-	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path))
+func (pw *projectWorkspace) ConfigTypeReport(stack tokens.QName) map[config.Key]string {
+	proj, err := pw.loadProject()
 	if err != nil {
-		return fmt.Errorf("failed to create temporary file %s: %w", path, err)
+		return nil
 	}
-	defer func() { contract.Ignore(os.Remove(tmp.Name())) }()
 
-	if err = tmp.Chmod(0o600); err != nil {
-		return fmt.Errorf("failed to set temporary file permission: %w", err)
+	defer pw.lockStack(stack)()
+	stackConfig := pw.stackConfig(stack)
+
+	report := map[config.Key]string{}
+	for projectConfigKey, projectConfigType := range proj.Config {
+		if !projectConfigType.IsExplicitlyTyped() {
+			continue
+		}
+		key, err := parseProjectConfigKey(proj.Name.String(), projectConfigKey)
+		if err != nil {
+			continue
+		}
+		value, has := stackConfig[key]
+		if !has || value.Secure() {
+			continue
+		}
+		report[key] = configTypeProblem(projectConfigType, value)
 	}
-	if _, err = tmp.Write(b); err != nil {
-		return fmt.Errorf("failed to write to temporary file: %w", err)
+	return report
+}
+
+func (pw *projectWorkspace) MoveConfig(from, to tokens.QName, overwrite bool) error {
+	if from == to {
+		return fmt.Errorf("cannot move the config of stack '%v' onto itself", from)
 	}
-	if err = tmp.Sync(); err != nil {
-		return err
+
+	defer pw.lockStacks(from, to)()
+
+	pw.mapsMutex.Lock()
+	defer pw.mapsMutex.Unlock()
+
+	source, ok := pw.settings.StackConfig[from]
+	if !ok {
+		return fmt.Errorf("stack '%v' has no config to move", from)
+	}
+	if _, exists := pw.settings.StackConfig[to]; exists && !overwrite {
+		return fmt.Errorf("stack '%v' already has config; move with overwrite to replace it", to)
+	}
+
+	pw.settings.StackConfig[to] = source
+	delete(pw.settings.StackConfig, from)
+	pw.emit(WorkspaceEvent{Kind: ConfigChanged, Stack: from})
+	pw.emit(WorkspaceEvent{Kind: ConfigChanged, Stack: to})
+	return nil
+}
+
+func (pw *projectWorkspace) ClearAllConfig() {
+	defer pw.lockAllStacks()()
+
+	stacks := make([]string, 0, len(pw.settings.StackConfig))
+	for stack := range pw.settings.StackConfig {
+		stacks = append(stacks, string(stack))
+	}
+	sort.Strings(stacks)
+
+	pw.settings.StackConfig = nil
+	for _, stack := range stacks {
+		pw.emit(WorkspaceEvent{Kind: ConfigChanged, Stack: tokens.QName(stack)})
+	}
+}
+
+// loadProject returns the workspace's project, reading it from the project file unless the workspace is in-memory.
+func (pw *projectWorkspace) loadProject() (*Project, error) {
+	if pw.proj != nil {
+		return pw.proj, nil
+	}
+	if pw.project == "" {
+		return &Project{Name: pw.name}, nil
+	}
+	return LoadProject(pw.project)
+}
+
+// stackConfig returns the config map of the given stack, or nil if it has none. The caller must hold the stack's lock.
+func (pw *projectWorkspace) stackConfig(stack tokens.QName) config.Map {
+	pw.mapsMutex.Lock()
+	defer pw.mapsMutex.Unlock()
+	return pw.settings.StackConfig[stack]
+}
+
+func (pw *projectWorkspace) StackTags(stack tokens.QName) map[string]string {
+	defer pw.lockStack(stack)()
+
+	pw.mapsMutex.Lock()
+	tags, ok := pw.settings.StackTags[stack]
+	pw.mapsMutex.Unlock()
+	if !ok {
+		return nil
+	}
+
+	result := make(map[string]string, len(tags))
+	for k, v := range tags {
+		result[k] = v
+	}
+	return result
+}
+
+func (pw *projectWorkspace) SetStackTags(stack tokens.QName, tags map[string]string) {
+	defer pw.lockStack(stack)()
+	pw.mapsMutex.Lock()
+	defer pw.mapsMutex.Unlock()
+
+	if len(tags) == 0 {
+		delete(pw.settings.StackTags, stack)
+		return
+	}
+
+	stored := make(map[string]string, len(tags))
+	for k, v := range tags {
+		stored[k] = v
+	}
+	if pw.settings.StackTags == nil {
+		pw.settings.StackTags = make(map[tokens.QName]map[string]string)
 	}
-	if err = tmp.Close(); err != nil {
+	pw.settings.StackTags[stack] = stored
+}
+
+func (pw *projectWorkspace) LoadStackConfigFile(stack tokens.QName, projectDir string) (config.Map, error) {
+	path, err := stackConfigFilePath(stack, projectDir)
+	if err != nil {
+		return nil, err
+	}
+	ps, err := LoadProjectStack(&Project{Name: pw.name}, path)
+	if err != nil {
+		return nil, fmt.Errorf("could not load stack config file '%s': %w", path, err)
+	}
+	return ps.Config, nil
+}
+
+func (pw *projectWorkspace) SaveStackConfigFile(stack tokens.QName, projectDir string, cfg config.Map) error {
+	path, err := stackConfigFilePath(stack, projectDir)
+	if err != nil {
 		return err
 	}
-	return os.Rename(tmp.Name(), path)
+	ps, err := LoadProjectStack(&Project{Name: pw.name}, path)
+	if err != nil {
+		return fmt.Errorf("could not load stack config file '%s': %w", path, err)
+	}
+	ps.Config = cfg
+	return ps.Save(path)
+}
+
+func (pw *projectWorkspace) ListLocalStacks(projectDir string) ([]tokens.QName, error) {
+	_, projectPath, files, err := projectStackConfigFiles(projectDir)
+	if err != nil {
+		return nil, err
+	}
+
+	ext := filepath.Ext(projectPath)
+	prefix := strings.TrimSuffix(filepath.Base(projectPath), ext) + "."
+	var stacks []string
+	for _, file := range files {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file), prefix), ext)
+		if !tokens.IsQName(name) {
+			logging.Warningf("ignoring stack config file %s: '%s' is not a valid stack name", file, name)
+			continue
+		}
+		stacks = append(stacks, name)
+	}
+	sort.Strings(stacks)
+
+	result := make([]tokens.QName, len(stacks))
+	for i, stack := range stacks {
+		result[i] = tokens.QName(stack)
+	}
+	return result, nil
+}
+
+// stackConfigFilePath returns the path of the config file of the given stack for the project in projectDir. The file
+// is named after the project file and the stack and placed in the project's stackConfigDir, if the project in
+// projectDir sets one, and otherwise next to the project file. It has the same extension as the project file,
+// defaulting to `.yaml`.
+func stackConfigFilePath(stack tokens.QName, projectDir string) (string, error) {
+	for _, name := range ProjectFileNames() {
+		for _, projectExt := range encoding.Exts {
+			projectPath := filepath.Join(projectDir, name+projectExt)
+			if _, err := os.Stat(projectPath); err != nil {
+				continue
+			}
+			proj, err := LoadProject(projectPath)
+			if err != nil {
+				return "", err
+			}
+			dir := projectDir
+			if proj.StackConfigDir != "" {
+				dir = filepath.Join(projectDir, proj.StackConfigDir)
+			}
+			return filepath.Join(dir, stackFileName(projectPath, stack)), nil
+		}
+	}
+	return filepath.Join(projectDir, stackFileName(ProjectFile+".yaml", stack)), nil
+}
+
+// deleteSettings deletes the settings stored under settingsFile, if there are any, returning SaveDeleted if it did.
+func (pw *projectWorkspace) deleteSettings(
+	ctx context.Context, store SettingsStore, settingsFile string,
+) (SaveResult, error) {
+	if pw.settingsFileMissing(settingsFile) {
+		return SaveUnchanged, nil
+	}
+	unlock, err := pw.lockSettingsFile(ctx, settingsFile)
+	if err != nil {
+		return SaveUnchanged, err
+	}
+	defer unlock()
+
+	_, ok, err := store.Load(settingsFile)
+	if err != nil || !ok {
+		return SaveUnchanged, err
+	}
+	if err = store.Delete(settingsFile); err != nil {
+		return SaveUnchanged, err
+	}
+	return SaveDeleted, nil
+}
+
+// settingsFileMissing returns true if the settings file at path is known not to exist, in which case there is nothing
+// to read or delete, and no need to create its lock file. It is false for workspaces whose settings aren't files on
+// disk, since their settings aren't locked.
+func (pw *projectWorkspace) settingsFileMissing(path string) bool {
+	if pw.fs != nil || pw.store != nil {
+		return false
+	}
+	_, err := os.Stat(path)
+	return os.IsNotExist(err)
+}
+
+// removeSettingsLockFile removes the lock file that lockSettingsFile leaves next to the settings file at path, once
+// the settings file has been deleted, so that workspaces without settings leave no files behind.
+func (pw *projectWorkspace) removeSettingsLockFile(path string) {
+	if pw.fs != nil || pw.store != nil {
+		return
+	}
+	if err := os.Remove(path + ".lock"); err != nil && !os.IsNotExist(err) {
+		logging.V(5).Infof("could not remove settings lock file %s: %v", path+".lock", err)
+	}
+}
+
+// PruneOrphanedSettings finds the workspace settings files whose project file no longer exists and removes them, along
+// with their lock files, returning their paths in sorted order. If dryRun is true, the files are only listed. Settings
+// files that don't record their project file, because they were last saved by an older version, are left alone.
+func PruneOrphanedSettings(dryRun bool) ([]string, error) {
+	dir, err := GetPulumiPath(WorkspaceDir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var orphans []string
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), "-"+WorkspaceFile) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		b, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		var settings struct {
+			ProjectPath string `json:"projectPath"`
+		}
+		if b, _, err = settingsAsJSON(b); err != nil {
+			continue
+		}
+		if json.Unmarshal(b, &settings) != nil || settings.ProjectPath == "" {
+			continue
+		}
+		if _, err := os.Stat(filepath.FromSlash(settings.ProjectPath)); !os.IsNotExist(err) {
+			continue
+		}
+
+		if !dryRun {
+			if err := os.Remove(path); err != nil {
+				return nil, err
+			}
+			if err := os.Remove(path + ".lock"); err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+		}
+		orphans = append(orphans, path)
+	}
+	return orphans, nil
+}
+
+// StoredWorkspace is a workspace settings file found in the workspace directory by ListStoredWorkspaces.
+type StoredWorkspace struct {
+	// ProjectName is the name of the project the settings belong to, as encoded in the file name.
+	ProjectName tokens.PackageName
+	// Hash is the hex sha1 hash of the project file path, as encoded in the file name.
+	Hash string
+	// Path is the path of the settings file.
+	Path string
+}
+
+// ListStoredWorkspaces returns the workspace settings files in the workspace directory, in sorted order of their
+// paths. Files whose names don't follow the `<project>-<sha1>-workspace.json` pattern are skipped.
+func ListStoredWorkspaces() ([]StoredWorkspace, error) {
+	dir, err := GetPulumiPath(WorkspaceDir)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var stored []StoredWorkspace
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		name, hash, ok := parseSettingsFileName(entry.Name())
+		if !ok {
+			continue
+		}
+		stored = append(stored, StoredWorkspace{
+			ProjectName: tokens.PackageName(name),
+			Hash:        hash,
+			Path:        filepath.Join(dir, entry.Name()),
+		})
+	}
+	return stored, nil
+}
+
+// parseSettingsFileName splits the name of a settings file, as chosen by the default settings path, into its
+// project name and the hash of its project file path.
+func parseSettingsFileName(fileName string) (string, string, bool) {
+	const hashLen = sha1.Size * 2
+
+	rest := strings.TrimSuffix(fileName, "-"+WorkspaceFile)
+	if rest == fileName || len(rest) < hashLen+2 || rest[len(rest)-hashLen-1] != '-' {
+		return "", "", false
+	}
+	name, hash := rest[:len(rest)-hashLen-1], rest[len(rest)-hashLen:]
+	if _, err := hex.DecodeString(hash); err != nil || strings.ToLower(hash) != hash {
+		return "", "", false
+	}
+	return name, hash, true
+}
+
+// ProjectPath returns the path of the project file the settings belong to, or "" if it isn't known. The path is read
+// from the settings file, which only records it if it was last saved by a version of Pulumi that does so, and is only
+// returned if it matches the hash in the file name. The project file need not still exist.
+func (sw StoredWorkspace) ProjectPath() string {
+	b, err := os.ReadFile(sw.Path)
+	if err != nil {
+		return ""
+	}
+	if b, _, err = settingsAsJSON(b); err != nil {
+		return ""
+	}
+	var settings struct {
+		ProjectPath string `json:"projectPath"`
+	}
+	if json.Unmarshal(b, &settings) != nil || settings.ProjectPath == "" {
+		return ""
+	}
+	projectPath := filepath.FromSlash(settings.ProjectPath)
+	if sha1HexString(projectPath) != sw.Hash {
+		return ""
+	}
+	return projectPath
+}
+
+// ConfigKeyFromEnv maps the name of an environment variable, with any import prefix already removed, onto a config
+// key. The name is lowercased; a double underscore separates an explicit namespace from the key name, and names
+// without one are namespaced by the project. A trailing "_SECRET" is removed and reported via the secret result. For
+// example, "AWS__REGION" maps to "aws:region" and "DB_PASSWORD_SECRET" maps to the secret "<project>:db_password".
+func ConfigKeyFromEnv(project tokens.PackageName, name string) (config.Key, bool, error) {
+	secret := strings.HasSuffix(name, "_SECRET")
+	name = strings.ToLower(strings.TrimSuffix(name, "_SECRET"))
+
+	namespace, keyName, ok := strings.Cut(name, "__")
+	if !ok {
+		namespace, keyName = string(project), name
+	}
+	if namespace == "" || keyName == "" || strings.Contains(keyName, ":") {
+		return config.Key{}, false, fmt.Errorf("cannot derive a config key from %q", name)
+	}
+
+	key, err := config.ParseKey(namespace + ":" + keyName)
+	if err != nil {
+		return config.Key{}, false, err
+	}
+	return key, secret, nil
+}
+
+// ConfigKeyToEnv is the inverse of ConfigKeyFromEnv: it returns the uppercased name of the environment variable
+// that holds the config key. Keys in the project's namespace map onto their name alone, and keys in other namespaces
+// onto the namespace and name separated by a double underscore, so `proj:region` becomes `REGION` and `aws:profile`
+// becomes `AWS__PROFILE`. Because names are uppercased, only lowercase keys survive a round trip unchanged.
+func ConfigKeyToEnv(project tokens.PackageName, key config.Key) (string, error) {
+	name := key.Name()
+	if strings.Contains(name, "__") || strings.ContainsAny(name, "= \t\r\n#") ||
+		strings.HasSuffix(strings.ToUpper(name), "_SECRET") {
+		return "", fmt.Errorf("config key '%v' cannot be represented as an environment variable", key)
+	}
+	if key.Namespace() != string(project) {
+		name = key.Namespace() + "__" + name
+	}
+	return strings.ToUpper(name), nil
+}
+
+func (pw *projectWorkspace) ProjectPath() string {
+	return pw.project
+}
+
+func (pw *projectWorkspace) ProjectRoot() string {
+	if pw.project == "" {
+		return ""
+	}
+	return filepath.Dir(pw.project)
+}
+
+func (pw *projectWorkspace) WorkspaceSettingsFile() string {
+	if pw.inMemory {
+		return ""
+	}
+	return pw.settingsPath()
 }
 
 func (pw *projectWorkspace) readSettings() error {
+	if pw.inMemory {
+		var settings Settings
+		if pw.saved != nil {
+			b, format, err := settingsAsJSON(pw.saved)
+			if err == nil {
+				err = json.Unmarshal(b, &settings)
+			}
+			if err != nil {
+				return fmt.Errorf("could not parse in-memory settings: %w", err)
+			}
+			settings.Format = format
+		}
+		pw.dirty = settings.migrateConfig()
+		pw.settings = &settings
+		return nil
+	}
+
 	settingsPath := pw.settingsPath()
+	if pw.settingsFileMissing(settingsPath) {
+		// not an error to not have an existing settings file, and there's nothing to lock.
+		pw.settings = &Settings{}
+		return nil
+	}
+
+	// Reading without the lock is better than not reading at all, e.g. if the settings directory is read-only.
+	unlock, err := pw.lockSettingsFile(context.Background(), settingsPath)
+	if err != nil && !errors.Is(err, fs.ErrPermission) {
+		return err
+	} else if err == nil {
+		defer unlock()
+	}
 
-	b, err := os.ReadFile(settingsPath)
-	if err != nil && os.IsNotExist(err) {
+	b, ok, err := pw.settingsStore(context.Background()).Load(settingsPath)
+	if err != nil {
+		return err
+	} else if !ok {
 		// not an error to not have an existing settings file.
 		pw.settings = &Settings{}
 		return nil
-	} else if err != nil {
-		return err
 	}
 
 	var settings Settings
 
+	b, format, err := settingsAsJSON(b)
+	if err != nil {
+		return fmt.Errorf("could not parse file %s: %w", settingsPath, err)
+	}
+	if !json.Valid(b) {
+		return fmt.Errorf("could not parse file %s: %w", settingsPath, json.Unmarshal(b, &settings))
+	}
+	if err = ValidateSettings(b); err != nil {
+		return fmt.Errorf("workspace settings file %s is invalid; fix or delete it to reset the workspace settings: %w",
+			settingsPath, err)
+	}
 	err = json.Unmarshal(b, &settings)
 	if err != nil {
 		return fmt.Errorf("could not parse file %s: %w", settingsPath, err)
 	}
+	settings.Format = format
+	pw.dirty = settings.migrateConfig()
 
 	pw.settings = &settings
 	return nil
 }
 
+// settingsLockTimeout bounds how long reading or saving the settings waits for another process to release them.
+var settingsLockTimeout = 30 * time.Second
+
+// settingsFileMutexes holds the *fsutil.FileMutex of each settings file, keyed by path, so that every workspace in the
+// process that uses a settings file shares its mutex.
+var settingsFileMutexes sync.Map
+
+// lockSettingsFile takes the advisory lock that serializes reading and writing the settings file at path, across
+// workspaces and processes, and returns a function that releases it. The lock is held on a `.lock` file next to the
+// settings file, which is left in place until the settings file is deleted. It gives up after settingsLockTimeout or
+// when ctx is canceled. There's nothing to lock if the settings directory doesn't exist, nor for workspaces that use a
+// substitute filesystem or a SettingsStore.
+func (pw *projectWorkspace) lockSettingsFile(ctx context.Context, path string) (func(), error) {
+	if pw.fs != nil || pw.store != nil {
+		return func() {}, nil
+	}
+	if _, err := os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+		return func() {}, nil
+	}
+
+	m, _ := settingsFileMutexes.LoadOrStore(path, fsutil.NewFileMutex(path+".lock"))
+	mutex := m.(*fsutil.FileMutex)
+
+	locked := make(chan error, 1)
+	go func() {
+		locked <- mutex.Lock()
+	}()
+	abandon := func() {
+		// Release the lock as soon as the abandoned attempt gets it.
+		go func() {
+			if err := <-locked; err == nil {
+				contract.IgnoreError(mutex.Unlock())
+			}
+		}()
+	}
+
+	timer := time.NewTimer(settingsLockTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-locked:
+		if err != nil {
+			return nil, fmt.Errorf("could not lock workspace settings file %s: %w", path, err)
+		}
+		return func() { contract.IgnoreError(mutex.Unlock()) }, nil
+	case <-timer.C:
+		abandon()
+		return nil, fmt.Errorf("timed out after %v waiting for the lock on workspace settings file %s; "+
+			"another pulumi process may be using it", settingsLockTimeout, path)
+	case <-ctx.Done():
+		abandon()
+		return nil, ctx.Err()
+	}
+}
+
+func (pw *projectWorkspace) filesystem() workspaceFS {
+	if pw.fs != nil {
+		return pw.fs
+	}
+	return osFS{}
+}
+
+// settingsStore returns the store that holds the workspace settings. Saves to the default, file-backed store are
+// abandoned if ctx is canceled.
+func (pw *projectWorkspace) settingsStore(ctx context.Context) SettingsStore {
+	if pw.store != nil {
+		return pw.store
+	}
+	return fileSettingsStore{ctx: ctx, fs: pw.filesystem()}
+}
+
 func (pw *projectWorkspace) settingsPath() string {
-	uniqueFileName := string(pw.name) + "-" + sha1HexString(pw.project) + "-" + WorkspaceFile
-	path, err := GetPulumiPath(WorkspaceDir, uniqueFileName)
-	contract.AssertNoErrorf(err, "could not get workspace path")
-	return path
+	if pw.settingsPathFunc != nil {
+		return pw.settingsPathFunc(pw.name, pw.project)
+	}
+	return DefaultSettingsPath(pw.name, pw.project)
 }
 
 // sha1HexString returns a hex string of the sha1 hash of value.
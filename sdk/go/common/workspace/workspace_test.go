@@ -0,0 +1,1517 @@
+// Copyright 2016-2023, Pulumi Corporation.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package workspace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource/config"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/tokens"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/cmdutil"
+	"github.com/pulumi/pulumi/sdk/v3/go/common/util/fsutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestWorkspace returns a workspace for the given project whose settings are stored under a temporary
+// PULUMI_HOME.
+func newTestWorkspace(t *testing.T, name tokens.PackageName, settings *Settings) *projectWorkspace {
+	t.Setenv(PulumiHomeEnvVar, t.TempDir())
+
+	if settings == nil {
+		settings = &Settings{}
+	}
+	return &projectWorkspace{
+		name:     name,
+		project:  filepath.Join(string(filepath.Separator), "projects", string(name), "Pulumi.yaml"),
+		settings: settings,
+	}
+}
+
+//nolint:paralleltest // mutates environment
+func TestSaveSettingsGolden(t *testing.T) {
+	settings := &Settings{
+		Stack: "dev",
+		StackConfig: map[tokens.QName]config.Map{
+			"prod": {
+				config.MustMakeKey("golden", "zone"):  config.NewValue("us-west-2a"),
+				config.MustMakeKey("aws", "region"):   config.NewValue("us-west-2"),
+				config.MustMakeKey("golden", "token"): config.NewSecureValue("c2VjcmV0"),
+			},
+			"dev": {
+				config.MustMakeKey("golden", "tags"): config.NewObjectValue(
+					`{"team":"payments","env":"dev","nested":{"z":1,"a":[3,2,1]}}`),
+				config.MustMakeKey("golden", "db"): config.NewSecureObjectValue(
+					`{"user":"admin","password":{"secure":"cGFzc3dvcmQ="}}`),
+				config.MustMakeKey("golden", "count"): config.NewValue("10"),
+			},
+		},
+	}
+
+	w := newTestWorkspace(t, "golden", settings)
+	require.NoError(t, w.Save())
+	actual, err := os.ReadFile(w.settingsPath())
+	require.NoError(t, err)
+
+	// Saving again must produce exactly the same bytes.
+	for i := 0; i < 10; i++ {
+		require.NoError(t, w.Save())
+		again, err := os.ReadFile(w.settingsPath())
+		require.NoError(t, err)
+		require.Equal(t, string(actual), string(again))
+	}
+
+	goldenPath := filepath.Join("testdata", "settings.golden.json")
+	if cmdutil.IsTruthy(os.Getenv("PULUMI_ACCEPT")) {
+		err = os.WriteFile(goldenPath, actual, 0o600)
+		require.NoError(t, err)
+		return
+	}
+
+	expected, err := os.ReadFile(goldenPath)
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual))
+}
+
+//nolint:paralleltest // mutates environment
+func TestSetConfigFromEnv(t *testing.T) {
+	t.Setenv("PULUMI_CONFIG_INSTANCE_SIZE", "t3.micro")
+	t.Setenv("PULUMI_CONFIG_AWS__REGION", "us-west-2")
+	t.Setenv("PULUMI_CONFIG_DB_PASSWORD_SECRET", "hunter2")
+	t.Setenv("OTHER_CONFIG_IGNORED", "ignored")
+
+	w := newTestWorkspace(t, "proj", nil)
+	imported, err := w.SetConfigFromEnv(context.Background(), "dev", "PULUMI_CONFIG_", config.Base64Crypter)
+	require.NoError(t, err)
+
+	assert.Equal(t, []config.Key{
+		config.MustMakeKey("aws", "region"),
+		config.MustMakeKey("proj", "db_password"),
+		config.MustMakeKey("proj", "instance_size"),
+	}, imported)
+
+	stackConfig := w.Settings().StackConfig["dev"]
+	assert.Equal(t, config.NewValue("t3.micro"), stackConfig[config.MustMakeKey("proj", "instance_size")])
+	assert.Equal(t, config.NewValue("us-west-2"), stackConfig[config.MustMakeKey("aws", "region")])
+
+	password := stackConfig[config.MustMakeKey("proj", "db_password")]
+	assert.True(t, password.Secure())
+	plaintext, err := password.Value(config.Base64Crypter)
+	require.NoError(t, err)
+	assert.Equal(t, "hunter2", plaintext)
+}
+
+func TestSetConfigFromEnvironNoMatches(t *testing.T) {
+	t.Parallel()
+
+	w := &projectWorkspace{name: "proj", settings: &Settings{}}
+	imported, err := w.setConfigFromEnviron(context.Background(),
+		[]string{"HOME=/home/user", "PATH=/usr/bin"}, "dev", "PULUMI_CONFIG_", config.Base64Crypter)
+	require.NoError(t, err)
+	assert.Empty(t, imported)
+	assert.True(t, w.Settings().IsEmpty())
+}
+
+func TestSetConfigFromEnvironWithoutEncrypter(t *testing.T) {
+	t.Parallel()
+
+	w := &projectWorkspace{name: "proj", settings: &Settings{}}
+	imported, err := w.setConfigFromEnviron(context.Background(),
+		[]string{"PULUMI_CONFIG_REGION=us-west-2"}, "dev", "PULUMI_CONFIG_", nil /*encrypter*/)
+	require.NoError(t, err)
+	assert.Equal(t, []config.Key{config.MustMakeKey("proj", "region")}, imported)
+
+	_, err = w.setConfigFromEnviron(context.Background(),
+		[]string{"PULUMI_CONFIG_SIZE=large", "PULUMI_CONFIG_TOKEN_SECRET=hunter2"}, "dev", "PULUMI_CONFIG_", nil)
+	assert.EqualError(t, err,
+		"importing PULUMI_CONFIG_TOKEN_SECRET: secret values can't be imported without an encrypter")
+	assert.Equal(t, []config.Key{config.MustMakeKey("proj", "region")}, w.ConfigKeys("dev"),
+		"nothing is imported if any variable can't be")
+}
+
+func TestSetConfigFromEnvironInvalidName(t *testing.T) {
+	t.Parallel()
+
+	w := &projectWorkspace{name: "proj", settings: &Settings{}}
+	_, err := w.setConfigFromEnviron(context.Background(),
+		[]string{"PULUMI_CONFIG_AWS__=value"}, "dev", "PULUMI_CONFIG_", config.Base64Crypter)
+	assert.ErrorContains(t, err, "importing PULUMI_CONFIG_AWS__: cannot derive a config key")
+	assert.True(t, w.Settings().IsEmpty())
+}
+
+//nolint:paralleltest // mutates environment
+func TestConfigKeys(t *testing.T) {
+	w := newTestWorkspace(t, "proj", &Settings{
+		StackConfig: map[tokens.QName]config.Map{
+			"dev": {
+				config.MustMakeKey("proj", "region"):   config.NewValue("us-west-2"),
+				config.MustMakeKey("aws", "profile"):   config.NewValue("dev"),
+				config.MustMakeKey("proj", "password"): config.NewSecureValue("c2VjcmV0"),
+				config.MustMakeKey("proj", "debug"):    config.NewValue("true"),
+			},
+		},
+	})
+
+	assert.Equal(t, []config.Key{
+		config.MustMakeKey("aws", "profile"),
+		config.MustMakeKey("proj", "debug"),
+		config.MustMakeKey("proj", "password"),
+		config.MustMakeKey("proj", "region"),
+	}, w.ConfigKeys("dev"))
+	assert.Nil(t, w.ConfigKeys("prod"))
+}
+
+//nolint:paralleltest // mutates environment
+func TestStackTagsPersist(t *testing.T) {
+	w := newTestWorkspace(t, "proj", nil)
+	assert.Nil(t, w.StackTags("prod"))
+
+	tags := map[string]string{"env": "prod", "team": "payments"}
+	w.SetStackTags("prod", tags)
+	tags["env"] = "mutated"
+	assert.Equal(t, map[string]string{"env": "prod", "team": "payments"}, w.StackTags("prod"))
+	assert.False(t, w.Settings().IsEmpty())
+	require.NoError(t, w.Save())
+
+	reloaded := &projectWorkspace{name: w.name, project: w.project}
+	require.NoError(t, reloaded.readSettings())
+	assert.Equal(t, map[string]string{"env": "prod", "team": "payments"}, reloaded.StackTags("prod"))
+	assert.Nil(t, reloaded.StackTags("dev"))
+}
+
+//nolint:paralleltest // mutates environment
+func TestStackTagsRemovalDeletesEmptySettings(t *testing.T) {
+	w := newTestWorkspace(t, "proj", nil)
+	w.SetStackTags("prod", map[string]string{"env": "prod"})
+	require.NoError(t, w.Save())
+	assert.FileExists(t, w.settingsPath())
+
+	w.SetStackTags("prod", nil)
+	assert.True(t, w.Settings().IsEmpty())
+	require.NoError(t, w.Save())
+	assert.NoFileExists(t, w.settingsPath())
+}
+
+//nolint:paralleltest // mutates environment
+func TestWorkspaceEvents(t *testing.T) {
+	w := newTestWorkspace(t, "proj", nil)
+	events := w.Events()
+
+	_, err := w.setConfigFromEnviron(
+		context.Background(), []string{"CFG_REGION=us-west-2"}, "dev", "CFG_", config.Base64Crypter)
+	require.NoError(t, err)
+	require.NoError(t, w.Save())
+
+	assert.Equal(t, WorkspaceEvent{Kind: ConfigChanged, Stack: "dev"}, <-events)
+	assert.Equal(t, WorkspaceEvent{Kind: SettingsSaved}, <-events)
+	assert.Empty(t, events)
+}
+
+func TestWorkspaceEventsDropOldest(t *testing.T) {
+	t.Parallel()
+
+	w := &projectWorkspace{name: "proj", settings: &Settings{}}
+	for i := 0; i < WorkspaceEventBufferSize+2; i++ {
+		w.emit(WorkspaceEvent{Kind: ConfigChanged, Stack: tokens.QName(fmt.Sprintf("stack%d", i))})
+	}
+
+	events := w.Events()
+	require.Len(t, events, WorkspaceEventBufferSize)
+	assert.Equal(t, tokens.QName("stack2"), (<-events).Stack)
+}
+
+//nolint:paralleltest // mutates environment
+func TestInMemoryWorkspace(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv(PulumiHomeEnvVar, home)
+
+	proj := &Project{Name: "proj", Runtime: NewProjectRuntimeInfo("nodejs", nil)}
+	w := NewInMemory(proj)
+	assert.Equal(t, "", w.WorkspaceSettingsFile())
+	assert.True(t, w.Settings().IsEmpty())
+
+	w.Settings().Stack = "dev"
+	w.SetStackTags("dev", map[string]string{"env": "dev"})
+	require.NoError(t, w.Save())
+
+	// Discard the in-memory changes and read back what was saved.
+	pw := w.(*projectWorkspace)
+	w.Settings().Stack = "unsaved"
+	require.NoError(t, pw.readSettings())
+	assert.Equal(t, "dev", w.Settings().Stack)
+	assert.Equal(t, map[string]string{"env": "dev"}, w.StackTags("dev"))
+
+	// Saving empty settings clears the saved state.
+	w.Settings().Stack = ""
+	w.SetStackTags("dev", nil)
+	require.NoError(t, w.Save())
+	w.Settings().Stack = "unsaved"
+	require.NoError(t, pw.readSettings())
+	assert.True(t, w.Settings().IsEmpty())
+
+	// Nothing was written to disk.
+	entries, err := os.ReadDir(home)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// Each in-memory workspace is independent.
+	assert.True(t, NewInMemory(proj).Settings().IsEmpty())
+}
+
+//nolint:paralleltest // mutates environment
+func TestOpenSettingsForDeletedProject(t *testing.T) {
+	t.Setenv(PulumiHomeEnvVar, t.TempDir())
+
+	dir := mkTempDir(t)
+	projectPath := filepath.Join(dir, "Pulumi.yaml")
+	require.NoError(t, os.WriteFile(projectPath, []byte("name: gone\nruntime: nodejs\n"), 0o600))
+
+	w, err := NewFrom(dir)
+	require.NoError(t, err)
+	w.Settings().Stack = "dev"
+	require.NoError(t, w.Save())
+	require.NoError(t, os.Remove(projectPath))
+
+	settings, save, err := OpenSettings("gone", projectPath)
+	require.NoError(t, err)
+	assert.Equal(t, "dev", settings.Stack)
+
+	// Clearing the settings and saving removes the orphaned file.
+	settings.Stack = ""
+	require.NoError(t, save())
+	assert.NoFileExists(t, w.WorkspaceSettingsFile())
+
+	settings, _, err = OpenSettings("gone", projectPath)
+	require.NoError(t, err)
+	assert.True(t, settings.IsEmpty())
+}
+
+//nolint:paralleltest // mutates environment
+func TestConfigDotenvRoundtrip(t *testing.T) {
+	w := newTestWorkspace(t, "proj", &Settings{
+		StackConfig: map[tokens.QName]config.Map{
+			"dev": {
+				config.MustMakeKey("proj", "region"):   config.NewValue("us-west-2"),
+				config.MustMakeKey("aws", "profile"):   config.NewValue("dev"),
+				config.MustMakeKey("proj", "greeting"): config.NewValue("hello \"world\"\n# not a comment"),
+				config.MustMakeKey("proj", "empty"):    config.NewValue(""),
+			},
+		},
+	})
+
+	data, err := w.ExportConfigDotenv("dev")
+	require.NoError(t, err)
+	assert.Equal(t, "AWS__PROFILE=dev\n"+
+		"EMPTY=\"\"\n"+
+		"GREETING=\"hello \\\"world\\\"\\n# not a comment\"\n"+
+		"REGION=us-west-2\n", string(data))
+
+	other := newTestWorkspace(t, "proj", nil)
+	require.NoError(t, other.ImportConfigDotenv("dev", data))
+	assert.Equal(t, w.Settings().StackConfig["dev"], other.Settings().StackConfig["dev"])
+}
+
+//nolint:paralleltest // mutates environment
+func TestConfigDotenvSkipsSecrets(t *testing.T) {
+	w := newTestWorkspace(t, "proj", &Settings{
+		StackConfig: map[tokens.QName]config.Map{
+			"dev": {
+				config.MustMakeKey("proj", "region"):   config.NewValue("us-west-2"),
+				config.MustMakeKey("proj", "password"): config.NewSecureValue("c2VjcmV0"),
+			},
+		},
+	})
+
+	data, err := w.ExportConfigDotenv("dev")
+	require.NoError(t, err)
+	assert.Equal(t, "REGION=us-west-2\n", string(data))
+
+	err = w.ImportConfigDotenv("dev", []byte("PASSWORD_SECRET=hunter2\n"))
+	assert.ErrorContains(t, err, "secret values cannot be imported from dotenv")
+}
+
+//nolint:paralleltest // mutates environment
+func TestImportConfigDotenvFormat(t *testing.T) {
+	w := newTestWorkspace(t, "proj", nil)
+	data := "# local overrides\n\nexport REGION=us-east-1\r\nNAME = 'literal \\n value'\n"
+	require.NoError(t, w.ImportConfigDotenv("dev", []byte(data)))
+	assert.Equal(t, config.Map{
+		config.MustMakeKey("proj", "region"): config.NewValue("us-east-1"),
+		config.MustMakeKey("proj", "name"):   config.NewValue("literal \\n value"),
+	}, w.Settings().StackConfig["dev"])
+
+	assert.ErrorContains(t, w.ImportConfigDotenv("dev", []byte("REGION\n")),
+		"line 1: expected an assignment of the form NAME=value")
+}
+
+func TestNewFromWithSettingsPath(t *testing.T) {
+	t.Parallel()
+
+	dir := mkTempDir(t)
+	projectPath := filepath.Join(dir, "Pulumi.yaml")
+	require.NoError(t, os.WriteFile(projectPath, []byte("name: proj\nruntime: nodejs\n"), 0o600))
+
+	settingsPath := func(name tokens.PackageName, project string) string {
+		assert.Equal(t, tokens.PackageName("proj"), name)
+		assert.Equal(t, projectPath, project)
+		return filepath.Join(filepath.Dir(project), ".pulumi", string(name)+".settings.json")
+	}
+	expected := filepath.Join(dir, ".pulumi", "proj.settings.json")
+
+	w, err := NewFromWithSettingsPath(dir, settingsPath)
+	require.NoError(t, err)
+	assert.Equal(t, expected, w.WorkspaceSettingsFile())
+
+	w.Settings().Stack = "dev"
+	require.NoError(t, w.Save())
+	assert.FileExists(t, expected)
+
+	reopened, err := NewFromWithSettingsPath(dir, settingsPath)
+	require.NoError(t, err)
+	assert.NotSame(t, w, reopened)
+	assert.Equal(t, "dev", reopened.Settings().Stack)
+}
+
+// memorySettingsStore is a SettingsStore that keeps the settings in a map.
+type memorySettingsStore struct {
+	mutex sync.Mutex
+	data  map[string][]byte
+}
+
+func (s *memorySettingsStore) Load(key string) ([]byte, bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	b, ok := s.data[key]
+	return b, ok, nil
+}
+
+func (s *memorySettingsStore) Save(key string, data []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.data == nil {
+		s.data = make(map[string][]byte)
+	}
+	s.data[key] = data
+	return nil
+}
+
+func (s *memorySettingsStore) Delete(key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.data, key)
+	return nil
+}
+
+//nolint:paralleltest // mutates environment
+func TestNewFromWithSettingsStore(t *testing.T) {
+	t.Setenv(PulumiHomeEnvVar, t.TempDir())
+
+	dir := mkTempDir(t)
+	projectPath := filepath.Join(dir, "Pulumi.yaml")
+	require.NoError(t, os.WriteFile(projectPath, []byte("name: proj\nruntime: nodejs\n"), 0o600))
+	key := DefaultSettingsPath("proj", projectPath)
+
+	store := &memorySettingsStore{}
+	w, err := NewFromWithSettingsStore(dir, store)
+	require.NoError(t, err)
+	assert.Equal(t, key, w.WorkspaceSettingsFile())
+
+	w.Settings().Stack = "dev"
+	result, err := w.SaveWithResult()
+	require.NoError(t, err)
+	assert.Equal(t, SaveWritten, result)
+	assert.Contains(t, string(store.data[key]), `"stack": "dev"`)
+	// The settings are only kept in the store.
+	assert.NoFileExists(t, key)
+
+	result, err = w.SaveWithResult()
+	require.NoError(t, err)
+	assert.Equal(t, SaveUnchanged, result)
+
+	reopened, err := NewFromWithSettingsStore(dir, store)
+	require.NoError(t, err)
+	assert.NotSame(t, w, reopened)
+	assert.Equal(t, "dev", reopened.Settings().Stack)
+
+	reopened.Settings().Stack = ""
+	result, err = reopened.SaveWithResult()
+	require.NoError(t, err)
+	assert.Equal(t, SaveDeleted, result)
+	assert.Empty(t, store.data)
+}
+
+// slowFS is a workspaceFS whose temporary files block writes until ctx is done, simulating a filesystem too slow to
+// finish a write before a deadline.
+type slowFS struct {
+	osFS
+	ctx context.Context
+}
+
+func (fs slowFS) CreateTemp(dir, pattern string) (workspaceFile, error) {
+	f, err := fs.osFS.CreateTemp(dir, pattern)
+	if err != nil {
+		return nil, err
+	}
+	return slowFile{workspaceFile: f, ctx: fs.ctx}, nil
+}
+
+type slowFile struct {
+	workspaceFile
+	ctx context.Context
+}
+
+func (f slowFile) Write(b []byte) (int, error) {
+	<-f.ctx.Done()
+	return f.workspaceFile.Write(b)
+}
+
+//nolint:paralleltest // mutates environment
+func TestWithContextCanceledSavePreservesOriginal(t *testing.T) {
+	w := newTestWorkspace(t, "proj", &Settings{Stack: "dev"})
+	require.NoError(t, w.Save())
+	original, err := os.ReadFile(w.settingsPath())
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	w.fs = slowFS{ctx: ctx}
+
+	w.Settings().Stack = "prod"
+	err = w.WithContext(ctx).Save()
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+
+	current, err := os.ReadFile(w.settingsPath())
+	require.NoError(t, err)
+	assert.Equal(t, original, current)
+
+	entries, err := filepath.Glob(filepath.Join(filepath.Dir(w.settingsPath()), "*.json*"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{w.settingsPath(), w.settingsPath() + ".lock"}, entries,
+		"the temporary file should have been removed")
+
+	// Without the context, the workspace saves as usual.
+	w.fs = nil
+	require.NoError(t, w.Save())
+	current, err = os.ReadFile(w.settingsPath())
+	require.NoError(t, err)
+	assert.Contains(t, string(current), `"prod"`)
+}
+
+//nolint:paralleltest // mutates environment
+func TestWithContextAlreadyCanceled(t *testing.T) {
+	w := newTestWorkspace(t, "proj", &Settings{Stack: "dev"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.ErrorIs(t, w.WithContext(ctx).Save(), context.Canceled)
+	assert.NoFileExists(t, w.settingsPath())
+}
+
+//nolint:paralleltest // mutates environment
+func TestSettingsFormatRoundtrip(t *testing.T) {
+	for _, format := range []SettingsFormat{SettingsFormatJSON, SettingsFormatYAML} {
+		format := format
+		t.Run(string(format), func(t *testing.T) {
+			w := newTestWorkspace(t, "proj", &Settings{
+				Stack: "dev",
+				StackConfig: map[tokens.QName]config.Map{
+					"dev": {
+						config.MustMakeKey("proj", "region"): config.NewValue("us-west-2"),
+						config.MustMakeKey("proj", "token"):  config.NewSecureValue("c2VjcmV0"),
+						config.MustMakeKey("proj", "tags"):   config.NewObjectValue(`{"team":"payments"}`),
+					},
+				},
+				StackTags: map[tokens.QName]map[string]string{"dev": {"owner": "payments"}},
+				Format:    format,
+			})
+			require.NoError(t, w.Save())
+
+			b, err := os.ReadFile(w.settingsPath())
+			require.NoError(t, err)
+			assert.Equal(t, format, detectSettingsFormat(b))
+			if format == SettingsFormatYAML {
+				assert.Contains(t, string(b), "stack: dev\n")
+			}
+
+			read := &projectWorkspace{name: w.name, project: w.project}
+			require.NoError(t, read.readSettings())
+			assert.Equal(t, w.settings, read.settings)
+
+			// Saving the settings that were read keeps the file's format.
+			result, err := read.SaveWithResult()
+			require.NoError(t, err)
+			assert.Equal(t, SaveUnchanged, result)
+		})
+	}
+}
+
+//nolint:paralleltest // mutates environment
+func TestSettingsFormatChange(t *testing.T) {
+	w := newTestWorkspace(t, "proj", &Settings{Stack: "dev", Format: SettingsFormatYAML})
+	require.NoError(t, w.Save())
+
+	w.settings.Format = SettingsFormatJSON
+	require.NoError(t, w.Save())
+	b, err := os.ReadFile(w.settingsPath())
+	require.NoError(t, err)
+	assert.Equal(t, SettingsFormatJSON, detectSettingsFormat(b))
+
+	w.settings.Format = "toml"
+	assert.EqualError(t, w.Save(), "unknown workspace settings format 'toml'")
+}
+
+//nolint:paralleltest // mutates environment
+func TestReadLegacySettingsMigratesConfig(t *testing.T) {
+	w := newTestWorkspace(t, "proj", nil)
+	path := w.settingsPath()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+	legacy := `{
+    "stack": "dev",
+    "config": {"dev": {"proj:region": "us-west-2", "proj:password": {"secure": "c2VjcmV0"}}}
+}`
+	require.NoError(t, os.WriteFile(path, []byte(legacy), 0o600))
+
+	require.NoError(t, w.readSettings())
+	assert.Equal(t, &Settings{
+		Stack: "dev",
+		StackConfig: map[tokens.QName]config.Map{
+			"dev": {
+				config.MustMakeKey("proj", "region"):   config.NewValue("us-west-2"),
+				config.MustMakeKey("proj", "password"): config.NewSecureValue("c2VjcmV0"),
+			},
+		},
+		Format: SettingsFormatJSON,
+	}, w.settings)
+	assert.True(t, w.dirty)
+
+	result, err := w.SaveWithResult()
+	require.NoError(t, err)
+	assert.Equal(t, SaveWritten, result)
+	assert.False(t, w.dirty)
+
+	// The new layout keeps the legacy key, so that older versions can still read the config.
+	b, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var saved map[string]interface{}
+	require.NoError(t, json.Unmarshal(b, &saved))
+	assert.Equal(t, saved["stackConfig"], saved["config"])
+
+	// Once StackConfig is saved, it is what the config is read from.
+	read := &projectWorkspace{name: w.name, project: w.project}
+	require.NoError(t, read.readSettings())
+	assert.Equal(t, w.settings, read.settings)
+	assert.False(t, read.dirty)
+}
+
+//nolint:paralleltest // mutates environment
+func TestReadInvalidSettings(t *testing.T) {
+	w := newTestWorkspace(t, "proj", nil)
+	path := w.settingsPath()
+	require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o700))
+	require.NoError(t, os.WriteFile(path, []byte(`{"stackTags": {"dev": ["team"]}}`), 0o600))
+
+	err := w.readSettings()
+	assert.ErrorContains(t, err, fmt.Sprintf(
+		"workspace settings file %s is invalid; fix or delete it to reset the workspace settings", path))
+	assert.ErrorContains(t, err, "#/stackTags/dev: expected object or null, but got array")
+
+	require.NoError(t, os.WriteFile(path, []byte(`{"stack": `), 0o600))
+	assert.ErrorContains(t, w.readSettings(), "could not parse file "+path)
+}
+
+func TestStackConfigFileRoundtrip(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Pulumi.yaml"), []byte("name: proj\nruntime: nodejs\n"), 0o600))
+	stackFile := filepath.Join(dir, "Pulumi.dev.yaml")
+	require.NoError(t, os.WriteFile(stackFile, []byte(`secretsprovider: passphrase
+config:
+  region: us-west-2
+  aws:profile: dev
+  password:
+    secure: c2VjcmV0
+`), 0o600))
+
+	w := NewInMemory(&Project{Name: "proj"})
+	cfg, err := w.LoadStackConfigFile("dev", dir)
+	require.NoError(t, err)
+	assert.Equal(t, config.Map{
+		config.MustMakeKey("proj", "region"):   config.NewValue("us-west-2"),
+		config.MustMakeKey("aws", "profile"):   config.NewValue("dev"),
+		config.MustMakeKey("proj", "password"): config.NewSecureValue("c2VjcmV0"),
+	}, cfg)
+
+	cfg[config.MustMakeKey("proj", "region")] = config.NewValue("eu-west-1")
+	require.NoError(t, w.SaveStackConfigFile("dev", dir, cfg))
+
+	reloaded, err := w.LoadStackConfigFile("dev", dir)
+	require.NoError(t, err)
+	assert.Equal(t, cfg, reloaded)
+
+	ps, err := LoadProjectStack(&Project{Name: "proj"}, stackFile)
+	require.NoError(t, err)
+	assert.Equal(t, "passphrase", ps.SecretsProvider)
+}
+
+func TestListLocalStacks(t *testing.T) {
+	t.Parallel()
+
+	dir := writeProjectFiles(t, map[string]string{
+		"Pulumi.yaml":          "name: proj\nruntime: nodejs\n",
+		"Pulumi.prod.yaml":     "config:\n  proj:region: us-east-1\n",
+		"Pulumi.dev.yaml":      "config:\n  proj:region: us-west-2\n",
+		"Pulumi.dev-2.yaml":    "config: {}\n",
+		"Pulumi.bad name.yaml": "config: {}\n",
+		"Pulumi.staging.json":  "{}\n",
+		"other.yaml":           "config: {}\n",
+	})
+	w, err := NewFromWithSettingsPath(dir, SettingsPathUnder(t.TempDir()))
+	require.NoError(t, err)
+
+	stacks, err := w.ListLocalStacks(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []tokens.QName{"dev", "dev-2", "prod"}, stacks)
+
+	nested := writeProjectFiles(t, map[string]string{
+		"Pulumi.yaml":             "name: proj\nruntime: nodejs\nstackConfigDir: stacks\n",
+		"Pulumi.ignored.yaml":     "config: {}\n",
+		"stacks/Pulumi.test.yaml": "config: {}\n",
+	})
+	stacks, err = w.ListLocalStacks(nested)
+	require.NoError(t, err)
+	assert.Equal(t, []tokens.QName{"test"}, stacks)
+
+	_, err = w.ListLocalStacks(t.TempDir())
+	assert.ErrorIs(t, err, ErrProjectNotFound)
+}
+
+func TestStackConfigFileHonorsStackConfigDir(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Pulumi.yaml"),
+		[]byte("name: proj\nruntime: nodejs\nstackConfigDir: stacks\n"), 0o600))
+
+	w := NewInMemory(&Project{Name: "proj"})
+	cfg, err := w.LoadStackConfigFile("dev", dir)
+	require.NoError(t, err)
+	assert.Empty(t, cfg)
+
+	cfg = config.Map{config.MustMakeKey("proj", "region"): config.NewValue("us-west-2")}
+	require.NoError(t, w.SaveStackConfigFile("dev", dir, cfg))
+	assert.FileExists(t, filepath.Join(dir, "stacks", "Pulumi.dev.yaml"))
+
+	reloaded, err := w.LoadStackConfigFile("dev", dir)
+	require.NoError(t, err)
+	assert.Equal(t, cfg, reloaded)
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	t.Parallel()
+
+	w := NewInMemory(&Project{Name: "proj"})
+	settings := w.Settings()
+	settings.Stack = "dev"
+	settings.StackConfig = map[tokens.QName]config.Map{
+		"dev": {config.MustMakeKey("proj", "region"): config.NewValue("us-west-2")},
+	}
+	w.SetStackTags("dev", map[string]string{"team": "payments"})
+
+	snapshot := w.Snapshot()
+
+	// Mutations after the snapshot don't affect it.
+	settings.Stack = "prod"
+	settings.StackConfig["dev"][config.MustMakeKey("proj", "region")] = config.NewValue("eu-west-1")
+	settings.StackConfig["prod"] = config.Map{config.MustMakeKey("proj", "region"): config.NewValue("us-east-1")}
+	w.SetStackTags("dev", map[string]string{"team": "platform"})
+	assert.Equal(t, "dev", snapshot.Stack)
+	assert.Equal(t, config.NewValue("us-west-2"), snapshot.StackConfig["dev"][config.MustMakeKey("proj", "region")])
+	assert.Equal(t, map[string]string{"team": "payments"}, snapshot.StackTags["dev"])
+
+	w.Restore(snapshot)
+	assert.Same(t, settings, w.Settings(), "restoring should update the settings in place")
+	assert.Equal(t, snapshot, w.Settings())
+	assert.Equal(t, map[string]string{"team": "payments"}, w.StackTags("dev"))
+
+	// The restored settings don't alias the snapshot.
+	w.Settings().StackConfig["dev"][config.MustMakeKey("proj", "region")] = config.NewValue("ap-south-1")
+	assert.Equal(t, config.NewValue("us-west-2"), snapshot.StackConfig["dev"][config.MustMakeKey("proj", "region")])
+
+	require.NoError(t, w.Save())
+}
+
+//nolint:paralleltest // mutates environment
+func TestPruneOrphanedSettings(t *testing.T) {
+	t.Setenv(PulumiHomeEnvVar, t.TempDir())
+
+	projects := t.TempDir()
+	livePath := filepath.Join(projects, "live", "Pulumi.yaml")
+	require.NoError(t, os.MkdirAll(filepath.Dir(livePath), 0o700))
+	require.NoError(t, os.WriteFile(livePath, []byte("name: live\nruntime: nodejs\n"), 0o600))
+
+	live := &projectWorkspace{name: "live", project: livePath, settings: &Settings{Stack: "dev"}}
+	require.NoError(t, live.Save())
+	orphan := &projectWorkspace{
+		name: "gone", project: filepath.Join(projects, "gone", "Pulumi.yaml"), settings: &Settings{Stack: "dev"},
+	}
+	require.NoError(t, orphan.Save())
+
+	// Settings saved before the project path was recorded are left alone.
+	legacy := &projectWorkspace{name: "legacy", project: filepath.Join(projects, "legacy", "Pulumi.yaml")}
+	require.NoError(t, os.WriteFile(legacy.settingsPath(), []byte(`{"stack": "dev"}`), 0o600))
+
+	pruned, err := PruneOrphanedSettings(true /*dryRun*/)
+	require.NoError(t, err)
+	assert.Equal(t, []string{orphan.settingsPath()}, pruned)
+	assert.FileExists(t, orphan.settingsPath())
+	assert.FileExists(t, orphan.settingsPath()+".lock")
+
+	pruned, err = PruneOrphanedSettings(false /*dryRun*/)
+	require.NoError(t, err)
+	assert.Equal(t, []string{orphan.settingsPath()}, pruned)
+	assert.NoFileExists(t, orphan.settingsPath())
+	assert.NoFileExists(t, orphan.settingsPath()+".lock")
+	assert.FileExists(t, live.settingsPath())
+	assert.FileExists(t, legacy.settingsPath())
+
+	pruned, err = PruneOrphanedSettings(false /*dryRun*/)
+	require.NoError(t, err)
+	assert.Empty(t, pruned)
+}
+
+//nolint:paralleltest // mutates environment
+func TestSettingsLockFileIsNotLeftBehind(t *testing.T) {
+	t.Setenv(PulumiHomeEnvVar, t.TempDir())
+
+	projects := t.TempDir()
+	path := filepath.Join(projects, "Pulumi.yaml")
+	require.NoError(t, os.WriteFile(path, []byte("name: proj\nruntime: nodejs\n"), 0o600))
+	dir, err := GetPulumiPath(WorkspaceDir)
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(dir, 0o700))
+	listFiles := func() []string {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	}
+
+	// Opening a workspace without settings, and saving it while it has none, doesn't create any files.
+	w := &projectWorkspace{name: "proj", project: path}
+	require.NoError(t, w.readSettings())
+	require.NoError(t, w.Save())
+	assert.Empty(t, listFiles())
+
+	// Deleting the settings removes their lock file as well.
+	w.Settings().Stack = "dev"
+	require.NoError(t, w.Save())
+	assert.ElementsMatch(t, []string{
+		filepath.Base(w.settingsPath()), filepath.Base(w.settingsPath()) + ".lock",
+	}, listFiles())
+	require.NoError(t, w.readSettings())
+	w.Settings().Stack = ""
+	result, err := w.SaveWithResult()
+	require.NoError(t, err)
+	assert.Equal(t, SaveDeleted, result)
+	assert.Empty(t, listFiles())
+}
+
+//nolint:paralleltest // mutates environment
+func TestPruneOrphanedSettingsWithoutWorkspaces(t *testing.T) {
+	t.Setenv(PulumiHomeEnvVar, t.TempDir())
+
+	pruned, err := PruneOrphanedSettings(false /*dryRun*/)
+	require.NoError(t, err)
+	assert.Empty(t, pruned)
+}
+
+//nolint:paralleltest // mutates environment
+func TestListStoredWorkspaces(t *testing.T) {
+	t.Setenv(PulumiHomeEnvVar, t.TempDir())
+
+	stored, err := ListStoredWorkspaces()
+	require.NoError(t, err)
+	assert.Empty(t, stored)
+
+	projects := t.TempDir()
+	current := &projectWorkspace{
+		name: "my-proj", project: filepath.Join(projects, "current", "Pulumi.yaml"), settings: &Settings{Stack: "dev"},
+	}
+	require.NoError(t, current.Save())
+	// Settings saved before the project path was recorded can't be traced back to their project.
+	legacy := &projectWorkspace{name: "legacy", project: filepath.Join(projects, "legacy", "Pulumi.yaml")}
+	require.NoError(t, os.WriteFile(legacy.settingsPath(), []byte(`{"stack": "dev"}`), 0o600))
+	// Files that weren't written by a workspace are skipped.
+	dir := filepath.Dir(current.settingsPath())
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes-"+WorkspaceFile), []byte(`{}`), 0o600))
+
+	stored, err = ListStoredWorkspaces()
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+	assert.Equal(t, StoredWorkspace{
+		ProjectName: "legacy", Hash: sha1HexString(legacy.project), Path: legacy.settingsPath(),
+	}, stored[0])
+	assert.Equal(t, StoredWorkspace{
+		ProjectName: "my-proj", Hash: sha1HexString(current.project), Path: current.settingsPath(),
+	}, stored[1])
+	assert.Equal(t, "", stored[0].ProjectPath())
+	assert.Equal(t, current.project, stored[1].ProjectPath())
+}
+func TestSettingsRecordProject(t *testing.T) {
+	t.Parallel()
+
+	dir := mkTempDir(t)
+	projectPath := filepath.Join(dir, "Pulumi.yaml")
+	require.NoError(t, os.WriteFile(projectPath, []byte("name: proj\nruntime: nodejs\n"), 0o600))
+	settingsPath := func(name tokens.PackageName, project string) string {
+		return filepath.Join(filepath.Dir(project), ".pulumi", string(name)+".settings.json")
+	}
+
+	w, err := NewFromWithSettingsPath(dir, settingsPath)
+	require.NoError(t, err)
+
+	// The recorded project doesn't make otherwise empty settings worth writing.
+	require.NoError(t, w.Save())
+	assert.True(t, w.Settings().IsEmpty())
+	assert.NoFileExists(t, w.WorkspaceSettingsFile())
+
+	w.Settings().Stack = "dev"
+	require.NoError(t, w.Save())
+
+	reopened, err := NewFromWithSettingsPath(dir, settingsPath)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.ToSlash(projectPath), reopened.Settings().ProjectPath)
+	assert.Equal(t, tokens.PackageName("proj"), reopened.Settings().ProjectName)
+
+	reopened.Settings().Stack = ""
+	assert.True(t, reopened.Settings().IsEmpty())
+}
+
+func TestConcurrentStackEdits(t *testing.T) {
+	t.Parallel()
+
+	w := NewInMemory(&Project{Name: "proj"})
+
+	const stacks, edits = 8, 25
+	var wg sync.WaitGroup
+	for i := 0; i < stacks; i++ {
+		stack := tokens.QName(fmt.Sprintf("stack%d", i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < edits; j++ {
+				assert.NoError(t, w.ImportConfigDotenv(stack, []byte(fmt.Sprintf("KEY%d=value%d\n", j, j))))
+				w.SetStackTags(stack, map[string]string{"edits": fmt.Sprint(j + 1)})
+				assert.Len(t, w.ConfigKeys(stack), j+1)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < edits; j++ {
+			assert.NoError(t, w.Save())
+			w.Snapshot()
+		}
+	}()
+	wg.Wait()
+
+	for i := 0; i < stacks; i++ {
+		stack := tokens.QName(fmt.Sprintf("stack%d", i))
+		assert.Len(t, w.ConfigKeys(stack), edits)
+		assert.Equal(t, map[string]string{"edits": fmt.Sprint(edits)}, w.StackTags(stack))
+	}
+}
+
+func TestConcurrentStackCreationWithSave(t *testing.T) {
+	t.Parallel()
+
+	// Each edit adds a new stack to the settings while the whole workspace is saved and snapshotted. Run with -race to
+	// check that saving doesn't read the settings' maps while they are being inserted into.
+	w := NewInMemory(&Project{Name: "proj"})
+
+	const stacks = 50
+	var wg sync.WaitGroup
+	for i := 0; i < stacks; i++ {
+		stack := tokens.QName(fmt.Sprintf("stack%d", i))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, w.ImportConfigDotenv(stack, []byte("KEY=value\n")))
+			w.SetStackTags(stack, map[string]string{"created": "true"})
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < stacks; j++ {
+			assert.NoError(t, w.Save())
+			w.Snapshot()
+		}
+	}()
+	wg.Wait()
+
+	for i := 0; i < stacks; i++ {
+		stack := tokens.QName(fmt.Sprintf("stack%d", i))
+		assert.Len(t, w.ConfigKeys(stack), 1)
+		assert.Equal(t, map[string]string{"created": "true"}, w.StackTags(stack))
+	}
+}
+
+func TestStackLocksAreIndependent(t *testing.T) {
+	t.Parallel()
+
+	w := NewInMemory(&Project{Name: "proj"})
+	pw := w.(*projectWorkspace)
+
+	unlock := pw.lockStack("dev")
+
+	// Another stack can be edited while dev is locked...
+	w.SetStackTags("prod", map[string]string{"team": "payments"})
+
+	// ...but edits to dev wait for its lock.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.SetStackTags("dev", map[string]string{"team": "platform"})
+	}()
+	select {
+	case <-done:
+		t.Fatal("edit to a locked stack did not wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	unlock()
+	<-done
+	assert.Equal(t, map[string]string{"team": "platform"}, w.StackTags("dev"))
+	assert.Equal(t, map[string]string{"team": "payments"}, w.StackTags("prod"))
+}
+
+func TestEffectiveConfig(t *testing.T) {
+	t.Parallel()
+
+	proj, err := loadProjectFromText(t, `name: proj
+runtime: nodejs
+config:
+  region:
+    default: us-west-2
+  size:
+    default: t3.micro
+  aws:profile:
+    value: shared
+`)
+	require.NoError(t, err)
+
+	w := NewInMemory(proj)
+	require.NoError(t, w.ImportConfigDotenv("dev", []byte("SIZE=t3.large\nREPLICAS=3\n")))
+
+	region := config.MustMakeKey("proj", "region")
+	size := config.MustMakeKey("proj", "size")
+	replicas := config.MustMakeKey("proj", "replicas")
+	profile := config.MustMakeKey("aws", "profile")
+
+	cfg, err := w.EffectiveConfig("dev")
+	require.NoError(t, err)
+	assert.Equal(t, config.Map{
+		region:   config.NewValue("us-west-2"), // only in the project's defaults
+		replicas: config.NewValue("3"),         // only in the stack
+		size:     config.NewValue("t3.large"),  // in both, so the stack wins
+		profile:  config.NewValue("shared"),
+	}, cfg)
+
+	// The stack's own config is left untouched.
+	assert.Equal(t, []config.Key{replicas, size}, w.ConfigKeys("dev"))
+
+	// A stack without any config inherits every project-wide value.
+	cfg, err = w.EffectiveConfig("prod")
+	require.NoError(t, err)
+	assert.Equal(t, config.Map{
+		region:  config.NewValue("us-west-2"),
+		size:    config.NewValue("t3.micro"),
+		profile: config.NewValue("shared"),
+	}, cfg)
+}
+
+func TestEffectiveConfigMissingRequired(t *testing.T) {
+	t.Parallel()
+
+	proj, err := loadProjectFromText(t, "name: proj\nruntime: nodejs\nconfig:\n  region:\n    type: string\n")
+	require.NoError(t, err)
+
+	_, err = NewInMemory(proj).EffectiveConfig("dev")
+	assert.EqualError(t, err, "Stack 'dev' is missing configuration value 'region'")
+}
+
+//nolint:paralleltest // mutates environment
+func TestSettingsUnderPulumiHome(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv(PulumiHomeEnvVar, home)
+
+	dir := mkTempDir(t)
+	projectPath := filepath.Join(dir, "Pulumi.yaml")
+	require.NoError(t, os.WriteFile(projectPath, []byte("name: proj\nruntime: nodejs\n"), 0o600))
+
+	w, err := NewFrom(dir)
+	require.NoError(t, err)
+	assert.Equal(t, home, filepath.Dir(filepath.Dir(w.WorkspaceSettingsFile())))
+
+	w.Settings().Stack = "dev"
+	require.NoError(t, w.Save())
+	assert.FileExists(t, w.WorkspaceSettingsFile())
+
+	settings, _, err := OpenSettings("proj", projectPath)
+	require.NoError(t, err)
+	assert.Equal(t, "dev", settings.Stack)
+}
+
+func TestSettingsPathUnder(t *testing.T) {
+	t.Parallel()
+
+	root := t.TempDir()
+	dir := mkTempDir(t)
+	projectPath := filepath.Join(dir, "Pulumi.yaml")
+	require.NoError(t, os.WriteFile(projectPath, []byte("name: proj\nruntime: nodejs\n"), 0o600))
+
+	w, err := NewFromWithSettingsPath(dir, SettingsPathUnder(root))
+	require.NoError(t, err)
+	expected := filepath.Join(root, WorkspaceDir, "proj-"+sha1HexString(projectPath)+"-"+WorkspaceFile)
+	assert.Equal(t, expected, w.WorkspaceSettingsFile())
+
+	w.Settings().Stack = "dev"
+	require.NoError(t, w.Save())
+	assert.FileExists(t, expected)
+
+	reopened, err := NewFromWithSettingsPath(dir, SettingsPathUnder(root))
+	require.NoError(t, err)
+	assert.Equal(t, "dev", reopened.Settings().Stack)
+}
+
+//nolint:paralleltest // mutates environment
+func TestNewFromReloadsChangedProject(t *testing.T) {
+	t.Setenv(PulumiHomeEnvVar, t.TempDir())
+
+	dir := mkTempDir(t)
+	projectPath := filepath.Join(dir, "Pulumi.yaml")
+	require.NoError(t, os.WriteFile(projectPath, []byte("name: proj\nruntime: nodejs\n"), 0o600))
+
+	w, err := NewFrom(dir)
+	require.NoError(t, err)
+	assert.Equal(t, tokens.PackageName("proj"), w.(*projectWorkspace).name)
+
+	// An unchanged project file is served from the cache.
+	cached, err := NewFrom(dir)
+	require.NoError(t, err)
+	assert.Same(t, w, cached)
+
+	require.NoError(t, os.WriteFile(projectPath, []byte("name: renamed\nruntime: nodejs\n"), 0o600))
+	// Make sure the change is visible even on filesystems with coarse modification times.
+	later := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(projectPath, later, later))
+
+	reloaded, err := NewFrom(dir)
+	require.NoError(t, err)
+	assert.NotSame(t, w, reloaded)
+	assert.Equal(t, tokens.PackageName("renamed"), reloaded.(*projectWorkspace).name)
+	assert.Equal(t, WorkspaceEvent{Kind: ProjectReloaded}, <-w.Events())
+
+	again, err := NewFrom(dir)
+	require.NoError(t, err)
+	assert.Same(t, reloaded, again)
+}
+
+func TestMoveConfig(t *testing.T) {
+	t.Parallel()
+
+	region := config.MustMakeKey("proj", "region")
+	token := config.MustMakeKey("proj", "token")
+	newWorkspace := func() W {
+		w := NewInMemory(&Project{Name: "proj"})
+		w.Settings().StackConfig = map[tokens.QName]config.Map{
+			"dev": {
+				region: config.NewValue("us-west-2"),
+				token:  config.NewSecureValue("c2VjcmV0"),
+			},
+			"prod": {region: config.NewValue("eu-west-1")},
+		}
+		return w
+	}
+
+	t.Run("Move", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWorkspace()
+		require.NoError(t, w.MoveConfig("dev", "staging", false /*overwrite*/))
+		assert.Nil(t, w.ConfigKeys("dev"))
+		assert.Equal(t, config.Map{
+			region: config.NewValue("us-west-2"),
+			token:  config.NewSecureValue("c2VjcmV0"),
+		}, w.Settings().StackConfig["staging"])
+		assert.Equal(t, WorkspaceEvent{Kind: ConfigChanged, Stack: "dev"}, <-w.Events())
+		assert.Equal(t, WorkspaceEvent{Kind: ConfigChanged, Stack: "staging"}, <-w.Events())
+	})
+
+	t.Run("ExistingTarget", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWorkspace()
+		err := w.MoveConfig("dev", "prod", false /*overwrite*/)
+		assert.EqualError(t, err, "stack 'prod' already has config; move with overwrite to replace it")
+		assert.Equal(t, []config.Key{region, token}, w.ConfigKeys("dev"))
+		assert.Equal(t, config.Map{region: config.NewValue("eu-west-1")}, w.Settings().StackConfig["prod"])
+	})
+
+	t.Run("Overwrite", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWorkspace()
+		require.NoError(t, w.MoveConfig("dev", "prod", true /*overwrite*/))
+		assert.Nil(t, w.ConfigKeys("dev"))
+		assert.Equal(t, []config.Key{region, token}, w.ConfigKeys("prod"))
+		assert.Equal(t, config.NewSecureValue("c2VjcmV0"), w.Settings().StackConfig["prod"][token])
+	})
+
+	t.Run("MissingSource", func(t *testing.T) {
+		t.Parallel()
+
+		w := newWorkspace()
+		assert.EqualError(t, w.MoveConfig("test", "prod", true /*overwrite*/), "stack 'test' has no config to move")
+		assert.EqualError(t, w.MoveConfig("dev", "dev", true /*overwrite*/),
+			"cannot move the config of stack 'dev' onto itself")
+	})
+}
+
+//nolint:paralleltest // mutates environment
+func TestEvictFromCache(t *testing.T) {
+	t.Setenv(PulumiHomeEnvVar, t.TempDir())
+
+	dir := mkTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Pulumi.yaml"), []byte("name: proj\nruntime: nodejs\n"), 0o600))
+
+	w, err := NewFrom(dir)
+	require.NoError(t, err)
+	w.Settings().Stack = "dev"
+	require.NoError(t, w.Save())
+
+	// Change the settings behind the cached workspace's back.
+	require.NoError(t, os.WriteFile(w.WorkspaceSettingsFile(), []byte(`{"stack": "prod"}`), 0o600))
+	cached, err := NewFrom(dir)
+	require.NoError(t, err)
+	assert.Same(t, w, cached)
+	assert.Equal(t, "dev", cached.Settings().Stack)
+
+	EvictFromCache(dir)
+	fresh, err := NewFrom(dir)
+	require.NoError(t, err)
+	assert.NotSame(t, w, fresh)
+	assert.Equal(t, "prod", fresh.Settings().Stack)
+
+	ClearCache()
+	cleared, err := NewFrom(dir)
+	require.NoError(t, err)
+	assert.NotSame(t, fresh, cleared)
+	assert.Equal(t, "prod", cleared.Settings().Stack)
+}
+
+func TestWorkspaceProjectPath(t *testing.T) {
+	t.Parallel()
+
+	dir := mkTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Pulumi.yaml"), []byte("name: proj\nruntime: nodejs\n"), 0o600))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "src"), 0o700))
+
+	w, err := NewFromWithSettingsPath(filepath.Join(dir, "src"), SettingsPathUnder(t.TempDir()))
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(dir, "Pulumi.yaml"), w.ProjectPath())
+	assert.Equal(t, dir, w.ProjectRoot())
+
+	inMemory := NewInMemory(&Project{Name: "proj"})
+	assert.Empty(t, inMemory.ProjectPath())
+	assert.Empty(t, inMemory.ProjectRoot())
+}
+
+func TestSettingsDeleteStack(t *testing.T) {
+	t.Parallel()
+
+	dir := mkTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Pulumi.yaml"), []byte("name: proj\nruntime: nodejs\n"), 0o600))
+	w, err := NewFromWithSettingsPath(dir, SettingsPathUnder(t.TempDir()))
+	require.NoError(t, err)
+
+	settings := w.Settings()
+	settings.Stack = "dev"
+	settings.StackConfig = map[tokens.QName]config.Map{
+		"dev":  {config.MustMakeKey("proj", "region"): config.NewValue("us-west-2")},
+		"prod": {config.MustMakeKey("proj", "region"): config.NewValue("us-east-1")},
+	}
+	settings.StackTags = map[tokens.QName]map[string]string{"dev": {"owner": "payments"}}
+	require.NoError(t, w.Save())
+
+	// Deleting one of several stacks keeps the others, and the settings file.
+	settings.DeleteStack("dev")
+	assert.Empty(t, settings.Stack)
+	assert.Len(t, settings.StackConfig, 1)
+	assert.Contains(t, settings.StackConfig, tokens.QName("prod"))
+	assert.Nil(t, settings.StackTags)
+	assert.False(t, settings.IsEmpty())
+	require.NoError(t, w.Save())
+	assert.FileExists(t, w.WorkspaceSettingsFile())
+
+	// Deleting a stack the settings don't know about changes nothing.
+	settings.DeleteStack("staging")
+	assert.Len(t, settings.StackConfig, 1)
+
+	// Deleting the last stack empties the settings, so saving them removes the settings file.
+	settings.DeleteStack("prod")
+	assert.True(t, settings.IsEmpty())
+	result, err := w.SaveWithResult()
+	require.NoError(t, err)
+	assert.Equal(t, SaveDeleted, result)
+	assert.NoFileExists(t, w.WorkspaceSettingsFile())
+}
+
+func TestConfigTypeReport(t *testing.T) {
+	t.Parallel()
+
+	dir := mkTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Pulumi.yaml"), []byte(`name: proj
+runtime: nodejs
+config:
+  count:
+    type: integer
+  ratio:
+    type: integer
+  enabled:
+    type: boolean
+  verbose:
+    type: boolean
+  owner:
+    type: string
+  tags:
+    type: array
+    items:
+      type: string
+  ports:
+    type: array
+    items:
+      type: integer
+  token:
+    type: string
+  untyped: hello
+  proj:zone:
+    type: string
+`), 0o600))
+	w, err := NewFromWithSettingsPath(dir, SettingsPathUnder(t.TempDir()))
+	require.NoError(t, err)
+
+	key := func(name string) config.Key { return config.MustMakeKey("proj", name) }
+	w.Settings().StackConfig = map[tokens.QName]config.Map{
+		"dev": {
+			key("count"):                        config.NewValue("10"),
+			key("ratio"):                        config.NewValue("1.5"),
+			key("enabled"):                      config.NewValue("true"),
+			key("verbose"):                      config.NewValue("yes"),
+			key("owner"):                        config.NewValue("payments"),
+			key("tags"):                         config.NewObjectValue(`["a","b"]`),
+			key("ports"):                        config.NewObjectValue(`[80,"https"]`),
+			key("token"):                        config.NewSecureValue("c2VjcmV0"),
+			key("untyped"):                      config.NewValue("world"),
+			key("extra"):                        config.NewValue("1"),
+			key("zone"):                         config.NewValue("us-west-2a"),
+			config.MustMakeKey("aws", "region"): config.NewValue("us-west-2"),
+		},
+	}
+
+	assert.Equal(t, map[config.Key]string{
+		key("count"):   "",
+		key("ratio"):   "value '1.5' does not coerce to type 'integer'",
+		key("enabled"): "",
+		key("verbose"): "value 'yes' does not coerce to type 'boolean'",
+		key("owner"):   "",
+		key("tags"):    "",
+		key("ports"):   `value '[80,"https"]' does not coerce to type 'array<integer>'`,
+		key("zone"):    "",
+	}, w.ConfigTypeReport("dev"))
+	assert.Empty(t, w.ConfigTypeReport("prod"))
+}
+
+func TestSaveWithResult(t *testing.T) {
+	t.Parallel()
+
+	dir := mkTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Pulumi.yaml"), []byte("name: proj\nruntime: nodejs\n"), 0o600))
+	w, err := NewFromWithSettingsPath(dir, SettingsPathUnder(t.TempDir()))
+	require.NoError(t, err)
+
+	inMemory := NewInMemory(&Project{Name: "proj"})
+
+	for _, w := range []W{w, inMemory} {
+		result, err := w.SaveWithResult()
+		require.NoError(t, err)
+		assert.Equal(t, SaveUnchanged, result, "empty settings without a file")
+
+		w.Settings().Stack = "dev"
+		result, err = w.SaveWithResult()
+		require.NoError(t, err)
+		assert.Equal(t, SaveWritten, result)
+
+		result, err = w.SaveWithResult()
+		require.NoError(t, err)
+		assert.Equal(t, SaveUnchanged, result, "settings that were already saved")
+
+		w.Settings().Stack = "prod"
+		result, err = w.SaveWithResult()
+		require.NoError(t, err)
+		assert.Equal(t, SaveWritten, result)
+
+		w.Settings().Stack = ""
+		result, err = w.SaveWithResult()
+		require.NoError(t, err)
+		assert.Equal(t, SaveDeleted, result)
+
+		result, err = w.SaveWithResult()
+		require.NoError(t, err)
+		assert.Equal(t, SaveUnchanged, result, "empty settings whose file was deleted")
+	}
+	assert.NoFileExists(t, w.WorkspaceSettingsFile())
+	assert.Equal(t, "Deleted", SaveDeleted.String())
+}
+
+func TestClearAllConfig(t *testing.T) {
+	t.Parallel()
+
+	dir := mkTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Pulumi.yaml"), []byte("name: proj\nruntime: nodejs\n"), 0o600))
+	w, err := NewFromWithSettingsPath(dir, SettingsPathUnder(t.TempDir()))
+	require.NoError(t, err)
+	events := w.Events()
+
+	require.NoError(t, w.ImportConfigDotenv("dev", []byte("REGION=us-west-2\n")))
+	require.NoError(t, w.ImportConfigDotenv("prod", []byte("REGION=us-east-1\n")))
+	w.SetStackTags("prod", map[string]string{"team": "payments"})
+	require.NoError(t, w.Save())
+	for len(events) > 0 {
+		<-events
+	}
+
+	// The tags survive, so the settings file is rewritten without the config.
+	w.ClearAllConfig()
+	assert.Nil(t, w.ConfigKeys("dev"))
+	assert.Nil(t, w.ConfigKeys("prod"))
+	assert.Equal(t, map[string]string{"team": "payments"}, w.StackTags("prod"))
+	assert.Equal(t, WorkspaceEvent{Kind: ConfigChanged, Stack: "dev"}, <-events)
+	assert.Equal(t, WorkspaceEvent{Kind: ConfigChanged, Stack: "prod"}, <-events)
+
+	result, err := w.SaveWithResult()
+	require.NoError(t, err)
+	assert.Equal(t, SaveWritten, result)
+	b, err := os.ReadFile(w.WorkspaceSettingsFile())
+	require.NoError(t, err)
+	assert.NotContains(t, string(b), "us-west-2")
+	assert.Contains(t, string(b), "payments")
+
+	// With only config set, clearing it leaves nothing to save, so the settings file is deleted.
+	w.SetStackTags("prod", nil)
+	require.NoError(t, w.ImportConfigDotenv("dev", []byte("REGION=us-west-2\n")))
+	require.NoError(t, w.Save())
+	w.ClearAllConfig()
+	result, err = w.SaveWithResult()
+	require.NoError(t, err)
+	assert.Equal(t, SaveDeleted, result)
+	assert.NoFileExists(t, w.WorkspaceSettingsFile())
+}
+
+func TestConcurrentSavesKeepSettingsValid(t *testing.T) {
+	t.Parallel()
+
+	dir := mkTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Pulumi.yaml"), []byte("name: proj\nruntime: nodejs\n"), 0o600))
+	settingsPath := SettingsPathUnder(t.TempDir())
+
+	// Each workspace stands in for a separate pulumi process sharing the Pulumi home.
+	var wg sync.WaitGroup
+	errs := make([]error, 8)
+	for i := range errs {
+		i := i
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w, err := NewFromWithSettingsPath(dir, settingsPath)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			for j := 0; j < 10; j++ {
+				w.Settings().Stack = fmt.Sprintf("stack-%d-%d", i, j)
+				w.SetStackTags(tokens.QName(fmt.Sprintf("stack%d", i)), map[string]string{"round": fmt.Sprint(j)})
+				if errs[i] = w.Save(); errs[i] != nil {
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+
+	w, err := NewFromWithSettingsPath(dir, settingsPath)
+	require.NoError(t, err)
+	b, err := os.ReadFile(w.WorkspaceSettingsFile())
+	require.NoError(t, err)
+	assert.NoError(t, ValidateSettings(b))
+	assert.Contains(t, w.Settings().Stack, "stack-")
+}
+
+//nolint:paralleltest // mutates the settings lock timeout
+func TestSaveSettingsLockTimeout(t *testing.T) {
+	dir := mkTempDir(t)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "Pulumi.yaml"), []byte("name: proj\nruntime: nodejs\n"), 0o600))
+	settingsPath := SettingsPathUnder(t.TempDir())
+	w, err := NewFromWithSettingsPath(dir, settingsPath)
+	require.NoError(t, err)
+	w.Settings().Stack = "dev"
+	require.NoError(t, w.Save())
+
+	timeout := settingsLockTimeout
+	settingsLockTimeout = 10 * time.Millisecond
+	t.Cleanup(func() { settingsLockTimeout = timeout })
+
+	// Another process holds the lock.
+	other := fsutil.NewFileMutex(w.WorkspaceSettingsFile() + ".lock")
+	require.NoError(t, other.Lock())
+
+	w.Settings().Stack = "prod"
+	err = w.Save()
+	assert.EqualError(t, err, fmt.Sprintf("timed out after 10ms waiting for the lock on workspace settings file %s; "+
+		"another pulumi process may be using it", w.WorkspaceSettingsFile()))
+
+	require.NoError(t, other.Unlock())
+	settingsLockTimeout = timeout
+	require.NoError(t, w.Save())
+	reopened, err := NewFromWithSettingsPath(dir, settingsPath)
+	require.NoError(t, err)
+	assert.Equal(t, "prod", reopened.Settings().Stack)
+}